@@ -26,7 +26,7 @@ type ServerInfo struct {
 	Mem  runtime.MemStats
 }
 
-func (si *ServerInfo) ServerStats(param interface{}, reply *ServerInfo) error {
+func (si *ServerInfo) ServerStats(reply *ServerInfo) error {
 	glog.Infof("ServerStats...\n")
 
 	if reply == nil {
@@ -0,0 +1,177 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyer is implemented by requests that carry an idempotency
+// key assigned by the client, such as an Idempotency-Key HTTP header. A
+// client retrying a call sends the same key, so that a server with a
+// ResultCache answers the retry from the cache instead of running the
+// method again.
+type IdempotencyKeyer interface {
+	IdempotencyKey() string
+}
+
+// ResultCache keeps the results of calls made with an idempotency key,
+// each with the hash of the method and params of the call, which Get
+// returns for the server to tell a retry from another call reusing the
+// key. Keys are scoped to the method by the server. Implementations must
+// be safe for concurrent use.
+type ResultCache interface {
+	Get(key string) (result *Result, hash string, ok bool)
+	Put(key, hash string, result *Result)
+}
+
+// ErrKeyReused answers a call whose idempotency key was already used for
+// a call with other params.
+var ErrKeyReused = NewServerError(ERR_INVALID_REQ, "The idempotency key was used for a call with other params.", nil)
+
+// Returns the cache key of req, or "" when it has no idempotency key.
+func idempotencyKey(req Request) string {
+	r, ok := req.(IdempotencyKeyer)
+	if !ok {
+		return ""
+	}
+	key := r.IdempotencyKey()
+	if key == "" {
+		return ""
+	}
+	return req.ServiceName() + "." + req.MethodName() + ":" + key
+}
+
+// Returns the hash of the method and params of req. Params are read as
+// JSON, insignificant space aside; those of requests that can't give them
+// raw are left out.
+func callHash(req Request) string {
+	var params json.RawMessage
+	if err := req.DecodeParams(&params); err != nil {
+		params = nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(req.ServiceName() + "." + req.MethodName() + "\n")
+	if err := json.Compact(&buf, params); err != nil {
+		buf.Write(params)
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// Reports whether a call that failed with err may be answered from the
+// cache: successes and errors of the application are, but not timeouts
+// nor internal failures, which a retry should run the method again for.
+func cacheable(err error) bool {
+	if serr, ok := err.(*ServerError); ok {
+		return serr.Code != ERR_TIMEOUT && serr.Code != ERR_INTERNAL
+	}
+	return true
+}
+
+// keyedCalls tracks the calls with an idempotency key being served, so
+// that a retry arriving while the first call runs waits for its result
+// rather than running the method again.
+type keyedCalls struct {
+	mu    sync.Mutex
+	calls map[string]chan struct{}
+}
+
+// Claims key for the caller to serve the call, in which case it returns
+// nil and the caller must release key once done. Otherwise the call is
+// being served and the returned channel is closed when it is done.
+func (k *keyedCalls) claim(key string) <-chan struct{} {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if done, present := k.calls[key]; present {
+		return done
+	}
+	if k.calls == nil {
+		k.calls = make(map[string]chan struct{})
+	}
+	k.calls[key] = make(chan struct{})
+	return nil
+}
+
+func (k *keyedCalls) release(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	close(k.calls[key])
+	delete(k.calls, key)
+}
+
+//-----------------------------------------------------------------------------
+// memoryCache
+//-----------------------------------------------------------------------------
+
+type cacheEntry struct {
+	result  Result
+	hash    string // of the method and params of the call
+	expires time.Time
+}
+
+// memoryCache is a ResultCache keeping results in memory for a window.
+type memoryCache struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	swept   time.Time // last sweep of the expired entries
+}
+
+// NewMemoryCache returns a ResultCache keeping each result in memory for
+// window after it is stored.
+func NewMemoryCache(window time.Duration) ResultCache {
+	return &memoryCache{
+		window:  window,
+		entries: make(map[string]cacheEntry),
+		swept:   time.Now(),
+	}
+}
+
+func (c *memoryCache) Get(key string) (*Result, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, present := c.entries[key]
+	if !present {
+		return nil, "", false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, "", false
+	}
+	return NewResult(e.result.Value, e.result.Error), e.hash, true
+}
+
+func (c *memoryCache) Put(key, hash string, result *Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.swept) > c.window {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.swept = now
+	}
+
+	c.entries[key] = cacheEntry{
+		result:  Result{Value: result.Value, Error: result.Error},
+		hash:    hash,
+		expires: now.Add(c.window),
+	}
+}
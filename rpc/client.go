@@ -4,17 +4,97 @@
 
 package rpc
 
+import (
+	"context"
+	"reflect"
+	"sync"
+)
+
 type CallResult struct {
 	ServiceMethod string        // The name of the service and method to call.
 	Args          interface{}
 	Reply         interface{}   // The reply from the RPC server
  	Error         *ServerError  // After completion, the error status.
 	Done          chan *CallResult  
+
+	// TransportError is set when the call could not be exchanged with the
+	// server, which may then not have seen it. Error is set as well. When
+	// it is nil, Error is the error the server answered.
+	TransportError error
+
+	// Timing is how long the server took over the call, when the transport
+	// reports it, nil otherwise.
+	Timing *CallTiming
+}
+
+// SetTransportError records err as the failure to exchange the call. Error
+// is set to err if it is a ServerError, to an ERR_INTERNAL error
+// unwrapping to err otherwise.
+func (c *CallResult) SetTransportError(err error) {
+	c.TransportError = err
+	if serr, ok := err.(*ServerError); ok {
+		c.Error = serr
+	} else {
+		c.Error = WrapError(ERR_INTERNAL, err)
+	}
 }
 
+// Client makes calls to a server. Calls may be made concurrently, but each
+// call in flight needs a reply of its own: the response is decoded into
+// it as it arrives. A call whose reply is the reply of another call of
+// the client still in flight fails with ErrReplyInUse; a reply may be
+// reused once its call is done.
 type Client interface {
 	// Call invokes the named function, waits for it to complete, and returns its error status.
 	Call(serviceMethod string, args, reply interface{}) *CallResult
+	// CallContext is like Call but gives up when ctx is done, completing
+	// with an error that unwraps to ctx.Err().
+	CallContext(ctx context.Context, serviceMethod string, args, reply interface{}) *CallResult
 	// Close the connection
 	Close() error
 }
+
+// ErrReplyInUse is the error of a call whose reply is already the reply
+// of another call in flight on the same client.
+var ErrReplyInUse = NewServerError(ERR_INTERNAL, "RPC: reply in use by a call in flight", nil)
+
+// ReplyGuard tracks the replies of the calls of a client in flight, for
+// clients to refuse calls sharing them, see Client. The zero value is
+// ready to use.
+type ReplyGuard struct {
+	replies sync.Map // replyKeyType -> struct{}
+}
+
+// Acquire records reply as the reply of a call in flight, reporting false
+// if it is already. Replies other than non-nil pointers are not tracked.
+func (g *ReplyGuard) Acquire(reply interface{}) bool {
+	key, ok := replyKey(reply)
+	if !ok {
+		return true
+	}
+	_, loaded := g.replies.LoadOrStore(key, struct{}{})
+	return !loaded
+}
+
+// Release records that the call of reply is done, before handing it back
+// to the caller.
+func (g *ReplyGuard) Release(reply interface{}) {
+	if key, ok := replyKey(reply); ok {
+		g.replies.Delete(key)
+	}
+}
+
+// A reply is told apart by its address and type. Zero-sized values may
+// share their address, they are not tracked: nothing is decoded into them.
+type replyKeyType struct {
+	typ  reflect.Type
+	addr uintptr
+}
+
+func replyKey(reply interface{}) (replyKeyType, bool) {
+	v := reflect.ValueOf(reply)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Type().Elem().Size() == 0 {
+		return replyKeyType{}, false
+	}
+	return replyKeyType{v.Type(), v.Pointer()}, true
+}
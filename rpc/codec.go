@@ -0,0 +1,26 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+// Response is the response to a call, as read by a ClientCodec.
+type Response struct {
+	ServiceMethod string       // The name of the service and method called.
+	Seq           uint64       // The sequence number of the request.
+	Reply         interface{}  // Set by the caller; the result is decoded into it.
+	Error         *ServerError // The error returned by the server, if any.
+}
+
+// A ClientCodec writes RPC requests and reads RPC responses for the client
+// side of an RPC session, independently of how the bytes are carried.
+//
+// The client calls WriteRequest to send a call and ReadResponse to read the
+// response to it. ReadResponse decodes the result into the Reply set on the
+// Response; it only returns an error when the response could not be read,
+// errors reported by the server are set in Response.Error instead.
+type ClientCodec interface {
+	WriteRequest(serviceMethod string, seq uint64, args interface{}) error
+	ReadResponse(*Response) error
+	Close() error
+}
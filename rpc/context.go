@@ -0,0 +1,79 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"reflect"
+)
+
+// RequestIDer is implemented by requests that carry an id assigned by the
+// client, such as the JSON-RPC "id" member. Requests that don't implement
+// it have an empty id.
+type RequestIDer interface {
+	RequestID() string
+}
+
+// Contexter is implemented by requests that carry a context, such as the
+// one of the connection or HTTP request they arrived on. It becomes the
+// parent of the context handed to methods; requests that don't implement
+// it use context.Background.
+type Contexter interface {
+	Context() context.Context
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	metadataKey         // metadata of the call being served
+	outgoingMetadataKey // metadata of the calls made with a context
+)
+
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// RequestIDFromContext returns the id of the request a method is serving,
+// or "" when the request has none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Builds the context handed to methods that take one.
+func newCallContext(req Request) context.Context {
+	ctx := context.Background()
+	if r, ok := req.(Contexter); ok {
+		ctx = r.Context()
+	}
+
+	if r, ok := req.(RequestIDer); ok {
+		if id := r.RequestID(); id != "" {
+			ctx = context.WithValue(ctx, requestIDKey, id)
+		}
+	}
+
+	if md := requestMetadata(req); md != nil {
+		ctx = context.WithValue(ctx, metadataKey, md)
+	}
+	return ctx
+}
+
+// Reports whether the context of req is already done, meaning its caller
+// has gone away or its deadline passed.
+func requestExpired(req Request) bool {
+	if r, ok := req.(Contexter); ok {
+		return r.Context().Err() != nil
+	}
+	return false
+}
+
+// Returns a channel closed when the context of req is done, or nil, which
+// is never ready, for requests without a context.
+func requestDone(req Request) <-chan struct{} {
+	if r, ok := req.(Contexter); ok {
+		return r.Context().Done()
+	}
+	return nil
+}
@@ -4,7 +4,16 @@
 
 package rpc
 
-import "fmt"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
 
 // The error codes from and including -32768 to -32000 are reserved for pre-defined errors.
 const (
@@ -14,6 +23,7 @@ const (
 	ERR_BAD_PARAMS  = -32602
 	ERR_INTERNAL    = -32603
 	ERR_SERVER      = -32000
+	ERR_TIMEOUT     = -32001
 )
 
 var (
@@ -23,7 +33,16 @@ var (
 	ErrInvalidParams   = NewServerError(ERR_BAD_PARAMS, "Invalid method parameter(s).", nil)
 	ErrInternal        = NewServerError(ERR_INTERNAL, "Internal RPC error.", nil)
 	ErrServer          = NewServerError(ERR_SERVER, "", nil)
+	ErrTimeout         = NewServerError(ERR_TIMEOUT, "The request expired before it could be served.", nil)
+	ErrMethodTimeout   = NewServerError(ERR_TIMEOUT, "The method did not complete in time.", nil)
 )
+
+// ErrNoContent is returned by methods that legitimately have no result,
+// such as a lookup that found nothing. The call succeeds with a nil result
+// Value; transports send an explicit null result and clients leave their
+// reply untouched.
+var ErrNoContent = errors.New("rpc: no content")
+
 //-----------------------------------------------------------------------------
 // ServerError
 //-----------------------------------------------------------------------------
@@ -34,12 +53,47 @@ type ServerError struct {
 	Code    int
 	Message string   
 	Data    interface{} 
+
+	err error // cause of the error, if any
 }
 
 func (e ServerError) Error() string {
 	return fmt.Sprintf("Error: (%v), %s", e.Code, e.Message)
 }
 
+// Unwrap returns the cause of an error made with WrapError, so that it can
+// be matched with errors.Is.
+func (e *ServerError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether target is a ServerError with the same code and
+// message, so that the errors the server builds per call, such as the one
+// carrying the name of a method not found, match the package's variables
+// with errors.Is whatever their Data.
+func (e *ServerError) Is(target error) bool {
+	t, ok := target.(*ServerError)
+	return ok && t.Code == e.Code && t.Message == e.Message
+}
+
+// UnmarshalData decodes the Data of the error into v. Clients receive Data
+// as a json.RawMessage; other values are converted through their JSON
+// encoding. It does nothing when the error carries no data.
+func (e *ServerError) UnmarshalData(v interface{}) error {
+	switch data := e.Data.(type) {
+	case nil:
+		return nil
+	case json.RawMessage:
+		return json.Unmarshal(data, v)
+	default:
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(b, v)
+	}
+}
+
 //-----------------------------------------------------------------------------
 // ServerErrorCreator
 //-----------------------------------------------------------------------------
@@ -53,8 +107,162 @@ func NewServerError(code int, msg string, d interface{}) *ServerError {
 	}
 }
 
+// WrapError returns a ServerError with the given code and the message of
+// err, which it unwraps to. Clients use it to report local failures such
+// as a cancelled context.
+func WrapError(code int, err error) *ServerError {
+	return &ServerError{
+		Code: code,
+		Message: err.Error(),
+		err: err,
+	}
+}
+
 // Format message for ServerError
 func FmtServerErrorMessage(svrError *ServerError, value interface{}) *ServerError {
 	svrError.Message = fmt.Sprintf(svrError.Message, value) 
 	return svrError
-}
\ No newline at end of file
+}
+
+//-----------------------------------------------------------------------------
+// ErrorMapper
+//-----------------------------------------------------------------------------
+
+// ErrorMapper translates an error returned by a method into the
+// ServerError sent to the client. It returns false to leave the error as
+// it is.
+type ErrorMapper func(err error) (*ServerError, bool)
+
+// Applies the first mapper that handles err. Errors that already are
+// ServerErrors are left alone.
+func mapError(err error, mappers ...ErrorMapper) error {
+	if _, ok := err.(*ServerError); ok {
+		return err
+	}
+	for _, m := range mappers {
+		if m == nil {
+			continue
+		}
+		if serr, ok := m(err); ok {
+			return serr
+		}
+	}
+	return err
+}
+
+//-----------------------------------------------------------------------------
+// Error codes
+//-----------------------------------------------------------------------------
+
+type errorCode struct {
+	err  error
+	code int
+}
+
+var (
+	errorCodesMu sync.RWMutex
+	errorCodes   []errorCode
+)
+
+// RegisterErrorCode maps the sentinel error err, and any error wrapping
+// it, to code process-wide, so that transports report it consistently.
+// Registering err again replaces its code.
+func RegisterErrorCode(err error, code int) {
+	errorCodesMu.Lock()
+	defer errorCodesMu.Unlock()
+
+	for i := range errorCodes {
+		if errorCodes[i].err == err {
+			errorCodes[i].code = code
+			return
+		}
+	}
+	errorCodes = append(errorCodes, errorCode{err, code})
+}
+
+// ErrorCode returns the code registered for err with RegisterErrorCode,
+// matching with errors.Is in registration order.
+func ErrorCode(err error) (int, bool) {
+	errorCodesMu.RLock()
+	defer errorCodesMu.RUnlock()
+
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code, true
+		}
+	}
+	return 0, false
+}
+
+// Reports whether code is in the range reserved for the errors of the
+// protocol and implementation, other than the generic ERR_SERVER.
+func isReservedCode(code int) bool {
+	return code >= -32768 && code < ERR_SERVER
+}
+
+// Turns a ServerError err returned by method with a reserved code into an
+// ERR_SERVER error keeping its message and data, so that clients don't
+// mistake it for an error of the protocol.
+func coerceReservedCode(method string, err error) error {
+	serr, ok := err.(*ServerError)
+	if !ok || !isReservedCode(serr.Code) {
+		return err
+	}
+
+	glog.Warningf("method %s returned reserved error code %d, sending %d", method, serr.Code, ERR_SERVER)
+	return NewServerError(ERR_SERVER, serr.Message, serr.Data)
+}
+
+//-----------------------------------------------------------------------------
+// ValidationError
+//-----------------------------------------------------------------------------
+
+// ValidationError reports the fields of the args a method rejects, each
+// with a message. Transports answer it as an ERR_BAD_PARAMS error whose
+// Data maps the fields to their messages, which clients read with
+// UnmarshalData into a map[string]string:
+//
+//	verr := new(rpc.ValidationError)
+//	if args.Name == "" {
+//		verr.Add("name", "is required")
+//	}
+//	return verr.Err()
+type ValidationError struct {
+	Fields map[string]string // messages by field
+}
+
+// Add records msg for field, after the messages already recorded for it,
+// and returns e.
+func (e *ValidationError) Add(field, msg string) *ValidationError {
+	if e.Fields == nil {
+		e.Fields = make(map[string]string)
+	}
+	if prev, present := e.Fields[field]; present {
+		msg = prev + "; " + msg
+	}
+	e.Fields[field] = msg
+	return e
+}
+
+// Err returns e when it records some field, nil otherwise, for methods
+// to return as their error once they have checked every field.
+func (e *ValidationError) Err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for field := range e.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	msgs := make([]string, len(fields))
+	for i, field := range fields {
+		msgs[i] = field + " " + e.Fields[field]
+	}
+	return "invalid params: " + strings.Join(msgs, ", ")
+}
@@ -0,0 +1,92 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Policy selects which backend a balanced client sends a call to.
+type Policy int
+
+const (
+	RoundRobin   Policy = iota // cycle through the backends in turn
+	LeastPending               // pick the backend with the fewest calls in flight
+)
+
+// How long a backend that failed a call is skipped for.
+var backendRetryAfter = 5 * time.Second
+
+//-----------------------------------------------------------------------------
+// backend
+//-----------------------------------------------------------------------------
+
+// backend is one of the servers a client sends calls to.
+type backend struct {
+	url *url.URL
+
+	pending int32 // calls in flight
+	failed  int64 // time of the last failed call in unix nanoseconds, 0 if none
+}
+
+func (b *backend) healthy(now time.Time) bool {
+	failed := atomic.LoadInt64(&b.failed)
+	return failed == 0 || now.Sub(time.Unix(0, failed)) > backendRetryAfter
+}
+
+// Records the outcome of a call sent to the backend.
+func (b *backend) done(err error) {
+	atomic.AddInt32(&b.pending, -1)
+
+	if err != nil {
+		atomic.StoreInt64(&b.failed, time.Now().UnixNano())
+	} else {
+		atomic.StoreInt64(&b.failed, 0)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// balancer
+//-----------------------------------------------------------------------------
+
+// balancer spreads calls over backends according to a policy, skipping
+// the backends that recently failed unless all of them did.
+type balancer struct {
+	backends []*backend
+	policy   Policy
+	next     uint32
+}
+
+// Picks the backend for the next call and counts the call as pending on it.
+func (lb *balancer) pick() *backend {
+	n := uint32(len(lb.backends))
+	start := atomic.AddUint32(&lb.next, 1)
+	now := time.Now()
+
+	var best *backend
+	for i := uint32(0); i < n; i++ {
+		b := lb.backends[(start + i) % n]
+		if !b.healthy(now) {
+			continue
+		}
+		if lb.policy == RoundRobin {
+			best = b
+			break
+		}
+		if best == nil || atomic.LoadInt32(&b.pending) < atomic.LoadInt32(&best.pending) {
+			best = b
+		}
+	}
+
+	// Every backend failed recently, keep trying them in turn.
+	if best == nil {
+		best = lb.backends[start % n]
+	}
+
+	atomic.AddInt32(&best.pending, 1)
+	return best
+}
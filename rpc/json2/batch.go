@@ -0,0 +1,229 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/entuerto/av-vortex/rpc"
+)
+
+// DefaultMaxBatchSize is the number of calls a batch may hold unless the
+// handler is given another limit with MaxBatchSize.
+const DefaultMaxBatchSize = 100
+
+// MaxBatchSize limits the number of calls a batch may hold to n. A larger
+// batch is rejected as a whole with a single ERR_INVALID_REQ response,
+// none of its calls is run. n < 1 lifts the limit.
+func MaxBatchSize(n int) HandlerOption {
+	return func(h *Handler) {
+		h.maxBatch = n
+	}
+}
+
+// Reports whether the body starts with an array, a batch of calls, leaving
+// it unread.
+func isBatch(body *bufio.Reader) bool {
+	for {
+		c, err := body.Peek(1)
+		if err != nil {
+			return false
+		}
+		switch c[0] {
+		case ' ', '\t', '\r', '\n':
+			body.ReadByte()
+		default:
+			return c[0] == '['
+		}
+	}
+}
+
+// serveBatch answers a batch of calls with an array holding the response
+// of every call that is not a notification, in the order of the calls.
+// The calls run concurrently, so that a batch takes about as long as its
+// slowest call. The limit of calls in flight per client counts the batch
+// as one call.
+func (h *Handler) serveBatch(w http.ResponseWriter, r *http.Request, body *bufio.Reader, stats *callStats) {
+	batch, err := h.readBatch(body)
+
+	if stats != nil {
+		stats.RequestBytes = stats.body.n
+	}
+
+	status := http.StatusOK // of the single response rejecting the batch
+	if err == nil && h.limit != nil {
+		client := h.limit.identify(r)
+		if h.limit.acquire(client) {
+			defer h.limit.release(client)
+		} else {
+			err = ErrTooManyRequests
+			status = http.StatusTooManyRequests
+		}
+	}
+
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer putBuffer(buf)
+
+	if err != nil {
+		if stats != nil {
+			stats.Error = err
+		}
+		// The batch is answered with a single response.
+		if err := writeResponse(buf, &srvRequest{Version: "2.0"}, rpc.NewResult(nil, err)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.send(w, r, buf, status, stats)
+		return
+	}
+
+	n, err := h.runBatch(newCallInfoContext(r), batch, buf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A batch of notifications only is answered with no content.
+	if n == 0 {
+		w.WriteHeader(h.notificationStatus)
+		return
+	}
+	h.send(w, r, buf, h.successStatus, stats)
+}
+
+// Reads the calls of a batch, failing when the batch can't be parsed or
+// holds no calls or more than the handler allows.
+func (h *Handler) readBatch(body io.Reader) ([]json.RawMessage, error) {
+	var batch []json.RawMessage
+	err := jsonImpl.NewDecoder(body).Decode(&batch)
+
+	switch {
+	case err != nil:
+		return nil, rpc.NewServerError(rpc.ERR_PARSE, "RPC-JSON2: " + err.Error(), nil)
+	case len(batch) == 0:
+		return nil, rpc.NewServerError(rpc.ERR_INVALID_REQ, "RPC-JSON2: empty batch", nil)
+	case h.maxBatch > 0 && len(batch) > h.maxBatch:
+		return nil, rpc.NewServerError(rpc.ERR_INVALID_REQ,
+			fmt.Sprintf("RPC-JSON2: batch of %d calls, at most %d allowed", len(batch), h.maxBatch), nil)
+	}
+	return batch, nil
+}
+
+// Runs the calls of batch with ctx as their context, writing the array of
+// their responses to buf. Returns the number of responses, zero when the
+// batch holds notifications only.
+func (h *Handler) runBatch(ctx context.Context, batch []json.RawMessage, buf *bytes.Buffer) (int, error) {
+	// Every call is handed to the workers before waiting on any of them,
+	// so that they run concurrently.
+	calls := make([]batchCall, len(batch))
+	for i, raw := range batch {
+		calls[i] = h.startCall(ctx, raw, i)
+	}
+
+	n := 0
+	buf.WriteByte('[')
+	for i, call := range calls {
+		result := call.wait()
+		if call.recorded {
+			h.forget(call.jreq, i, result)
+		}
+		if call.err == nil && call.jreq.notification() {
+			result.Release()
+			continue
+		}
+
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		err := writeResponse(buf, call.jreq, result)
+		result.Release()
+		if err != nil {
+			// Still wait on the calls left, their untrack must run.
+			for _, call := range calls[i+1:] {
+				call.wait().Release()
+			}
+			return 0, err
+		}
+		n++
+	}
+	buf.WriteByte(']')
+	return n, nil
+}
+
+// A call of a batch, being served.
+type batchCall struct {
+	jreq     *srvRequest
+	req      rpc.Request // dispatched, jreq unless rewritten, see BeforeDispatch
+	err      error       // error reading the call, if any
+	result   *rpc.Result // result known without dispatching, if any
+	untrack  func()      // for dispatched calls, see Handler.track
+	recorded bool        // for notifications, by Handler.duplicate
+}
+
+// Deliver results on the request's own Result channel, buffered so that
+// workers never wait on it.
+var resultChannel = rpc.ResultSinkFunc(func(req rpc.Request, result *rpc.Result) {
+	req.Result() <- result
+})
+
+// Reads the call in raw, member of the batch at position i, and unless it
+// is invalid, a duplicate notification or a built-in method, hands it to
+// the workers without waiting for its result.
+func (h *Handler) startCall(ctx context.Context, raw json.RawMessage, i int) batchCall {
+	request, err := h.readRequest(ioutil.NopCloser(bytes.NewReader(raw)))
+	jreq := request.(*srvRequest)
+	jreq.ctx = ctx
+
+	if err == nil && !h.exposes(jreq.Method) {
+		err = rpc.NewServerError(rpc.ERR_NO_METHOD, rpc.ErrMethodNotFound.Message, jreq.Method)
+	}
+
+	call := batchCall{jreq: jreq, err: err}
+	switch method, builtin := systemMethods[jreq.Method]; {
+	case err != nil:
+		call.result = rpc.NewResult(nil, err)
+	case jreq.notification() && h.duplicate(jreq, i):
+		call.result = rpc.NewResult(nil, nil)
+	case builtin:
+		call.recorded = jreq.notification()
+		call.result = rpc.NewResult(method(h, jreq))
+	default:
+		call.recorded = jreq.notification()
+		untrack := h.track(jreq)
+		req, result := h.intercept(jreq)
+		if result != nil {
+			untrack()
+			call.result = result
+			break
+		}
+		call.req = req
+		call.untrack = untrack
+		h.DispatchTo(req, resultChannel)
+	}
+	return call
+}
+
+// Returns the result of the call, waiting for it if it was dispatched.
+// Like Dispatch it gives up with ErrTimeout once the request is done.
+func (call batchCall) wait() *rpc.Result {
+	if call.result != nil {
+		return call.result
+	}
+	defer call.untrack()
+
+	select {
+	case result := <-call.req.Result():
+		return result
+	case <-call.jreq.Context().Done():
+		return rpc.NewResult(nil, rpc.ErrTimeout)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/entuerto/av-vortex/rpc"
+)
+
+// ErrNoBatchResponse completes the calls of a batch whose answer holds no
+// response for them.
+var ErrNoBatchResponse = rpc.NewServerError(rpc.ERR_INTERNAL, "RPC-JSON2: no response to the call in the batch", nil)
+
+// BatchCall is one of the calls of a batch, see BatchClient.
+type BatchCall struct {
+	ServiceMethod string
+	Args          interface{}
+	Reply         interface{}
+}
+
+// BatchClient is implemented by the json2 HTTP clients, which send the
+// calls of a batch in a single request:
+//
+//	results := c.(json2.BatchClient).CallBatch([]json2.BatchCall{
+//		{"Arith.Add", &Args{1, 2}, &sum},
+//		{"Arith.Mul", &Args{3, 4}, &product},
+//	})
+type BatchClient interface {
+	rpc.Client
+
+	// CallBatch sends calls as one batch and returns once it is answered,
+	// with the results of the calls in their order, completed. Responses
+	// are matched to their calls by id, whatever order the server answers
+	// them in. Calls share the fate of the request: when it fails, they
+	// all fail with its error.
+	CallBatch(calls []BatchCall) []*rpc.CallResult
+
+	// CallBatchContext is like CallBatch but the request is made with ctx,
+	// as CallContext makes it.
+	CallBatchContext(ctx context.Context, calls []BatchCall) []*rpc.CallResult
+}
+
+func (c *client) CallBatch(calls []BatchCall) []*rpc.CallResult {
+	return c.CallBatchContext(context.Background(), calls)
+}
+
+func (c *client) CallBatchContext(ctx context.Context, calls []BatchCall) []*rpc.CallResult {
+	results := make([]*rpc.CallResult, len(calls))
+	pending := make(map[uint64]*rpc.CallResult, len(calls))
+
+	for i, call := range calls {
+		result := &rpc.CallResult{
+			ServiceMethod: call.ServiceMethod,
+			Args:          call.Args,
+			Reply:         call.Reply,
+			Done:          make(chan *rpc.CallResult, 1),
+		}
+		results[i] = result
+
+		if !c.replies.Acquire(call.Reply) {
+			result.SetTransportError(rpc.ErrReplyInUse)
+			continue
+		}
+
+		c.mutex.Lock()
+		c.seq++
+		pending[c.seq] = result
+		c.mutex.Unlock()
+	}
+
+	if len(pending) > 0 {
+		c.sendBatch(ctx, pending)
+	}
+	for _, result := range pending {
+		c.replies.Release(result.Reply)
+	}
+
+	for _, result := range results {
+		result.Done <- result
+	}
+	return results
+}
+
+// Exchanges the calls of pending, keyed by id, as one batch with a backend,
+// failing them all when the exchange fails.
+func (c *client) sendBatch(ctx context.Context, pending map[uint64]*rpc.CallResult) {
+	fail := func(err error) {
+		for _, call := range pending {
+			call.SetTransportError(err)
+		}
+	}
+
+	select {
+	case <-c.quit:
+		fail(ErrClientClosed)
+		return
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		fail(err)
+		return
+	}
+	if !c.breaker.allow() {
+		fail(ErrBreakerOpen)
+		return
+	}
+
+	b := c.lb.pick()
+	conn := newHTTPConn(ctx, c.c, b.url.String(), "")
+	conn.token = c.token
+
+	err := exchangeBatch(conn, newClientCodec(conn, c.strict), pending)
+	if err != nil && ctx.Err() != nil {
+		b.done(nil)
+		c.breaker.cancel()
+		fail(ctx.Err())
+		return
+	}
+
+	b.done(err)
+	c.breaker.record(err)
+
+	if err != nil {
+		fail(err)
+	}
+}
+
+// exchangeBatch writes the calls of pending as an array of requests over
+// conn, in the order of their ids, then reads back the responses. The
+// returned error is a failure to exchange the batch; errors reported by
+// the server, and failures to decode a reply, are set on the calls.
+func exchangeBatch(conn *httpConn, codec *clientCodec, pending map[uint64]*rpc.CallResult) error {
+	defer codec.Close()
+
+	seqs := make([]uint64, 0, len(pending))
+	for seq := range pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	conn.body.WriteByte('[')
+	for i, seq := range seqs {
+		if i > 0 {
+			conn.body.WriteByte(',')
+		}
+		call := pending[seq]
+		args, _ := SplitIdempotent(call.Args)
+		if err := codec.WriteRequest(call.ServiceMethod, seq, args); err != nil {
+			return err
+		}
+	}
+	conn.body.WriteByte(']')
+
+	var raw json.RawMessage
+	if err := codec.dec.Decode(&raw); err != nil {
+		return err
+	}
+
+	// The server answers a single error when it rejects the batch as a
+	// whole.
+	if !isArray(raw) {
+		var cresp clientResponse
+		if err := jsonImpl.Unmarshal(raw, &cresp); err != nil {
+			return err
+		}
+		var resp rpc.Response
+		if err := codec.decodeResponse(&cresp, &resp); err != nil {
+			return err
+		}
+		for _, call := range pending {
+			call.Error = resp.Error
+			if call.Error == nil {
+				call.Error = ErrNoBatchResponse
+			}
+		}
+		return nil
+	}
+
+	var cresps []clientResponse
+	if err := jsonImpl.Unmarshal(raw, &cresps); err != nil {
+		return err
+	}
+
+	answered := make(map[uint64]bool, len(cresps))
+	for i := range cresps {
+		id := cresps[i].Id
+		call := pending[id]
+		if call == nil || answered[id] {
+			continue
+		}
+		answered[id] = true
+
+		resp := rpc.Response{Reply: call.Reply}
+		if err := codec.decodeResponse(&cresps[i], &resp); err != nil {
+			call.SetTransportError(err)
+			continue
+		}
+		call.Error = resp.Error
+	}
+
+	for seq, call := range pending {
+		if !answered[seq] {
+			call.Error = ErrNoBatchResponse
+		}
+	}
+	return nil
+}
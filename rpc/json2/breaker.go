@@ -0,0 +1,153 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"sync"
+	"time"
+
+	"github.com/entuerto/av-vortex/rpc"
+)
+
+var (
+	ErrBreakerOpen = rpc.NewServerError(rpc.ERR_INTERNAL, "RPC-JSON2: circuit breaker open", nil)
+)
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // calls go through
+	BreakerOpen                         // calls fail fast
+	BreakerHalfOpen                     // one call goes through to probe the server
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+//-----------------------------------------------------------------------------
+// Breaker
+//-----------------------------------------------------------------------------
+
+// Breaker is a circuit breaker guarding the calls of a client.
+//
+// After threshold consecutive calls fail to reach the server the breaker
+// opens, and calls fail fast with ErrBreakerOpen for the cooldown period.
+// It then lets a single probe call through: the breaker closes again if
+// the probe succeeds and reopens if it fails. Errors returned by the
+// server itself show that it is reachable and don't count as failures.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mutex    sync.Mutex
+	state    BreakerState
+	failures int       // consecutive failures while closed
+	openedAt time.Time // when the breaker last opened
+	probing  bool      // a probe call is in flight
+}
+
+// NewBreaker returns a closed breaker opening after threshold consecutive
+// failures and staying open for cooldown.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() BreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// Reports whether a call may go through. A nil breaker lets every call
+// through.
+func (b *Breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		fallthrough
+
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// Releases a call let through by allow whose outcome says nothing of the
+// server, its caller having given up on it: a probe call frees the way
+// for the next one, the state and failures are left as they are.
+func (b *Breaker) cancel() {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	b.probing = false
+	b.mutex.Unlock()
+}
+
+// Records the outcome of a call let through by allow.
+func (b *Breaker) record(err error) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err == nil {
+		b.state = BreakerClosed
+		b.failures = 0
+		b.probing = false
+		return
+	}
+
+	switch b.state {
+	case BreakerClosed:
+		b.failures++
+		if b.failures < b.threshold {
+			return
+		}
+	case BreakerHalfOpen:
+		b.probing = false
+	}
+
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	b.failures = 0
+}
@@ -0,0 +1,43 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"context"
+	"net/http"
+)
+
+// CallInfo describes the HTTP request a call arrived on. Methods that take
+// a context can read it with CallInfoFromContext.
+type CallInfo struct {
+	RemoteAddr string      // network address of the caller
+	Header     http.Header // headers of the request, not to be modified
+	Subject    string      // basic auth user name, not verified
+}
+
+type contextKey int
+
+const (
+	callInfoKey contextKey = iota
+	notificationIDKey
+)
+
+// CallInfoFromContext returns the CallInfo of the HTTP request being
+// served, if any.
+func CallInfoFromContext(ctx context.Context) (*CallInfo, bool) {
+	info, ok := ctx.Value(callInfoKey).(*CallInfo)
+	return info, ok
+}
+
+// Returns the context of r with its CallInfo attached.
+func newCallInfoContext(r *http.Request) context.Context {
+	info := &CallInfo{
+		RemoteAddr: r.RemoteAddr,
+		Header:     r.Header,
+	}
+	info.Subject, _, _ = r.BasicAuth()
+
+	return context.WithValue(r.Context(), callInfoKey, info)
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/entuerto/av-vortex/rpc"
+)
+
+// CallerTokenHeader is the HTTP header carrying the token a client picks
+// for itself, at random, to have its calls cancelled with system.cancel.
+// Its calls are those the cancel can reach: a client can't cancel those of
+// another, even behind the same proxy, without knowing its token.
+const CallerTokenHeader = "Caller-Token"
+
+// CancelArgs are the params of system.cancel, {"id": 42} or [42]: the id
+// of the call to cancel, as it was sent.
+type CancelArgs struct {
+	ID json.RawMessage `json:"id"`
+}
+
+// system.cancel cancels the context of the call in flight with the given
+// id, made by the same client, and reports whether it found one. Methods
+// taking a context see it done; the call is answered once they return.
+// Clients are told apart by the token of their Caller-Token header, so
+// that the ids chosen by one client can't cancel the calls of another;
+// calls made without one can't be cancelled.
+func (h *Handler) cancel(jreq *srvRequest) (interface{}, error) {
+	var args CancelArgs
+	if err := jreq.DecodeParams(&args); err != nil {
+		return nil, rpc.NewServerError(rpc.ERR_BAD_PARAMS, rpc.ErrInvalidParams.Message, err.Error())
+	}
+
+	id := srvRequest{Id: args.ID}.RequestID()
+	if id == "" {
+		return false, nil
+	}
+	client := callClient(jreq)
+	if client == "" {
+		return false, nil
+	}
+	return h.inflight.cancel(client, id), nil
+}
+
+// Returns the client a call comes from, as far as system.cancel is
+// concerned, "" when it sent no token.
+func callClient(jreq *srvRequest) string {
+	info, ok := CallInfoFromContext(jreq.Context())
+	if !ok {
+		return ""
+	}
+	token := info.Header.Get(CallerTokenHeader)
+	if token == "" {
+		return ""
+	}
+	return hostOf(info.RemoteAddr) + " " + token
+}
+
+// inflightCalls are the calls being served by a handler, by client and
+// id, that system.cancel can cancel.
+type inflightCalls struct {
+	mutex sync.Mutex
+	calls map[inflightKey]*inflightCall
+}
+
+type inflightKey struct {
+	client, id string
+}
+
+type inflightCall struct {
+	cancel context.CancelFunc
+}
+
+// Makes jreq cancellable with system.cancel, returning the function to
+// call once it is answered. Notifications, having no id, can't be
+// cancelled, nor the calls of clients without a token. A call reusing the
+// id of a call of the same client still in flight isn't either, the
+// cancel is for the first one.
+func (h *Handler) track(jreq *srvRequest) (untrack func()) {
+	id := jreq.RequestID()
+	client := callClient(jreq)
+	if id == "" || client == "" {
+		return func() {}
+	}
+
+	key := inflightKey{client, id}
+
+	l := &h.inflight
+	l.mutex.Lock()
+	if _, present := l.calls[key]; present {
+		l.mutex.Unlock()
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(jreq.Context())
+	jreq.ctx = ctx
+	call := &inflightCall{cancel}
+	if l.calls == nil {
+		l.calls = make(map[inflightKey]*inflightCall)
+	}
+	l.calls[key] = call
+	l.mutex.Unlock()
+
+	return func() {
+		l.mutex.Lock()
+		if l.calls[key] == call {
+			delete(l.calls, key)
+		}
+		l.mutex.Unlock()
+		cancel()
+	}
+}
+
+// Cancels the call of client with the given id, reporting whether there
+// is one.
+func (l *inflightCalls) cancel(client, id string) bool {
+	l.mutex.Lock()
+	call, ok := l.calls[inflightKey{client, id}]
+	l.mutex.Unlock()
+
+	if ok {
+		call.cancel()
+	}
+	return ok
+}
+
+//-----------------------------------------------------------------------------
+// Client
+//-----------------------------------------------------------------------------
+
+// How long a client waits for system.cancel to be answered.
+const cancelTimeout = 5 * time.Second
+
+// CancelRemotely makes the client send system.cancel for the calls whose
+// context is done before they are answered, so that the server cancels
+// them too. Closing the connection does as much unless a proxy stands
+// between client and server, holding it open. The client sends its calls
+// with a token of its own, see CallerTokenHeader.
+func CancelRemotely() ClientOption {
+	return func(c *client) {
+		c.cancelRemotely = true
+		c.token = newCallerToken()
+	}
+}
+
+// Returns a token, random, for a client to send in CallerTokenHeader.
+func newCallerToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		glog.Fatal("RPC-JSON2: caller token: ", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Asks backend b to cancel the call with id seq, given up by the caller.
+func (c *client) cancelRemote(b *backend, seq uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+
+	c.mutex.Lock()
+	c.seq++
+	cancelSeq := c.seq
+	c.mutex.Unlock()
+
+	var found bool
+	call := &rpc.CallResult{
+		ServiceMethod: "system.cancel",
+		Args:          CancelArgs{ID: json.RawMessage(strconv.FormatUint(seq, 10))},
+		Reply:         &found,
+	}
+
+	conn := newHTTPConn(ctx, c.c, b.url.String(), "")
+	conn.token = c.token
+	codec := newClientCodec(conn, false)
+	if err := roundTrip(codec, call, cancelSeq); err != nil {
+		glog.Warningf("RPC-JSON2: cancelling call %d: %v", seq, err)
+	} else if call.Error != nil {
+		glog.Warningf("RPC-JSON2: cancelling call %d: %v", seq, call.Error)
+	}
+}
@@ -6,9 +6,9 @@ package json2
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
-	"io"
 	"net/http"
 	"net/url"
 	"sync"
@@ -18,7 +18,8 @@ import (
 )
 
 var (
-	ErrJsonDecoder = errors.New("Could not create JSON decoder")
+	ErrJsonDecoder  = errors.New("Could not create JSON decoder")
+	ErrClientClosed = rpc.NewServerError(rpc.ERR_INTERNAL, "RPC-JSON2: client is closed", nil)
 )
 
 //-----------------------------------------------------------------------------
@@ -29,6 +30,7 @@ type clientRequest struct {
 	Version string       `json:"jsonrpc"`
 	Method  string       `json:"method"`
 	Params  interface{}  `json:"params"`
+	Meta    rpc.Metadata `json:"metadata,omitempty"`
 	Id      uint64       `json:"id"`
 }
 
@@ -44,102 +46,273 @@ type clientResponse struct {
 }
 
 //-----------------------------------------------------------------------------
-// Client HTTP 
+// Idempotency keys
 //-----------------------------------------------------------------------------
 
-type client struct {
-	remoteURL *url.URL
-	c *http.Client
+// IdempotencyKeyHeader is the HTTP header carrying the idempotency key of
+// a call.
+const IdempotencyKeyHeader = "Idempotency-Key"
 
-	queue chan *rpc.CallResult
+// keyedArgs are the args of a call made with an idempotency key.
+type keyedArgs struct {
+	key  string
+	args interface{}
+}
 
-	mutex sync.Mutex
-	seq   uint64
-} 
+// Idempotent wraps the args of a call so that it is sent with key as its
+// idempotency key. Retrying a call with the same key is safe even for
+// methods that are not idempotent: a server with a result cache answers
+// the retry without running the method again.
+//
+//	result := c.Call("Orders.Place", json2.Idempotent(key, args), &reply)
+func Idempotent(key string, args interface{}) interface{} {
+	return keyedArgs{key, args}
+}
 
-func (c *client) encodeClientRequest(creq *clientRequest) (io.Reader, error) {
-	buf, err := json.Marshal(creq)
-	if err != nil {
-		return nil, err
+// SplitIdempotent splits args made with Idempotent into the actual args
+// and their key, "" for other args, for transports other than HTTP to
+// carry the key apart from the params, or to refuse it.
+func SplitIdempotent(args interface{}) (interface{}, string) {
+	if ka, ok := args.(keyedArgs); ok {
+		return ka.args, ka.key
+	}
+	return args, ""
+}
+
+//-----------------------------------------------------------------------------
+// StatusError
+//-----------------------------------------------------------------------------
+
+// StatusError reports an HTTP response with a status other than 2xx, for
+// which the client gives up rather than decoding the body. Redirects are
+// not followed and also end in a StatusError. The error of the call
+// unwraps to it:
+//
+//	var serr *json2.StatusError
+//	if errors.As(result.Error, &serr) && serr.StatusCode == http.StatusBadGateway {
+//		...
+//	}
+type StatusError struct {
+	StatusCode int    // e.g. 500
+	Status     string // e.g. "500 Internal Server Error"
+}
+
+func (e *StatusError) Error() string {
+	return "RPC-JSON2: unexpected HTTP status " + e.Status
+}
+
+// Stops the client from following redirects, their response is handed
+// back as it is.
+func noRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+//-----------------------------------------------------------------------------
+// httpConn
+//-----------------------------------------------------------------------------
+
+// httpConn is a connection carrying a single request/response exchange
+// over HTTP, so that a codec can run on top of it. Writes are buffered
+// into the request body, which is posted on the first Read; reads then
+// come from the response body.
+type httpConn struct {
+	ctx   context.Context
+	c     *http.Client
+	url   string
+	key   string // idempotency key, if any
+	token string // caller token, if any, see CancelRemotely
+
+	body bytes.Buffer
+	resp *http.Response
+	err  error
+}
+
+func newHTTPConn(ctx context.Context, c *http.Client, url, key string) *httpConn {
+	return &httpConn{ctx: ctx, c: c, url: url, key: key}
+}
+
+func (conn *httpConn) Write(p []byte) (int, error) {
+	return conn.body.Write(p)
+}
+
+func (conn *httpConn) Read(p []byte) (int, error) {
+	if conn.resp == nil && conn.err == nil {
+		conn.resp, conn.err = conn.post()
+	}
+	if conn.err != nil {
+		return 0, conn.err
 	}
-	return bytes.NewBuffer(buf), nil
+	return conn.resp.Body.Read(p)
 }
 
-func (c *client) decodeServerResponse(resp *http.Response, callRes *rpc.CallResult) error {
-	defer resp.Body.Close()
+func (conn *httpConn) post() (*http.Response, error) {
+	req, err := http.NewRequestWithContext(conn.ctx, "POST", conn.url, &conn.body)
+	if err != nil {
+		return nil, err
+	}
 
-	dec := json.NewDecoder(resp.Body)
-	if dec == nil {
-		return ErrJsonDecoder
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if conn.key != "" {
+		req.Header.Set(IdempotencyKeyHeader, conn.key)
 	}
+	if conn.token != "" {
+		req.Header.Set(CallerTokenHeader, conn.token)
+	}
+	setMetadataHeaders(req.Header, rpc.OutgoingMetadata(conn.ctx))
 
-	var cresp clientResponse
-	if err := dec.Decode(&cresp); err != nil {
-		return err
+	resp, err := conn.c.Do(req)
+	if err != nil {
+		return nil, err
 	}
 
-	if cresp.Error != nil {
-		var jerr jsonError
+	// Error pages and redirects are no JSON-RPC responses.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
 
-		if err := json.Unmarshal(*cresp.Error, &jerr); err != nil {
-			return err
-		}
+	// Callers should close resp.Body when done reading from it.
+	return resp, nil
+}
 
-		callRes.Error = rpc.NewServerError(jerr.Code, jerr.Message, jerr.Data)
-		return nil
+func (conn *httpConn) Close() error {
+	if conn.resp != nil {
+		return conn.resp.Body.Close()
 	}
-	return json.Unmarshal(*cresp.Result, callRes.Reply)	
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// Client HTTP 
+//-----------------------------------------------------------------------------
+
+type client struct {
+	lb      *balancer
+	c       *http.Client
+	breaker *Breaker
+	caps    capabilitiesCache
+	strict  bool // see StrictReplies
+
+	cancelRemotely bool   // see CancelRemotely
+	token          string // sent with the calls, see CancelRemotely
+
+	replies rpc.ReplyGuard // replies of the calls in flight
+
+	queue chan pendingCall
+	start sync.Once     // starts the sender on the first call
+	quit  chan struct{} // closed by Close to stop the sender
+	stop  sync.Once
+
+	mutex sync.Mutex
+	seq   uint64
+} 
+
+// A call waiting to be sent, with the context it was made with.
+type pendingCall struct {
+	ctx  context.Context
+	call *rpc.CallResult
 }
- 
+
 func (c *client) sender() {
 	for {
-		call := <- c.queue
+		var p pendingCall
+		select {
+		case p = <- c.queue:
+		case <-c.quit:
+			return
+		}
+		call := p.call
 
 		c.mutex.Lock()
 		c.seq++
-
-		creq := &clientRequest{
-			Version: "2.0",
-			Method:  call.ServiceMethod,
-			Params:  call.Args,
-			Id:      uint64(c.seq),
-		}
-
+		seq := c.seq
 		c.mutex.Unlock()
 
-		body, err := c.encodeClientRequest(creq)
-		if err != nil {
-			call.Error = rpc.ErrInternal
-			call.Error.Message = err.Error()
-			call.Done <- call
+		if err := p.ctx.Err(); err != nil {
+			call.SetTransportError(err)
+			go c.finish(call)
 			continue
 		}
 
-		req, err := http.NewRequest("POST", c.remoteURL.String(), body) 
-		if err != nil {
-			call.Error = rpc.ErrInternal
-			call.Error.Message = err.Error()
-			call.Done <- call
+		if !c.breaker.allow() {
+			call.SetTransportError(ErrBreakerOpen)
+			go c.finish(call)
 			continue
 		}
 
-		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		go c.send(p.ctx, call, seq, c.lb.pick())
+	}
+}
 
-		// Callers should close resp.Body when done reading from it.
-		if resp, err := c.c.Do(req); err != nil {
-			call.Error = rpc.ErrInternal
-			call.Error.Message = err.Error()
-		} else if err := c.decodeServerResponse(resp, call); err != nil {
-			call.Error = rpc.ErrInternal
-			call.Error.Message = err.Error()
+// Exchanges call with backend b, aborting when ctx is done. Calls given up
+// by the caller don't count as failures of the backend.
+func (c *client) send(ctx context.Context, call *rpc.CallResult, seq uint64, b *backend) {
+	_, key := SplitIdempotent(call.Args)
+	conn := newHTTPConn(ctx, c.c, b.url.String(), key)
+	conn.token = c.token
+	codec := newClientCodec(conn, c.strict)
+
+	err := roundTrip(codec, call, seq)
+	if conn.resp != nil {
+		call.Timing = parseServerTiming(conn.resp.Header.Get(ServerTimingHeader))
+	}
+	if err != nil && ctx.Err() != nil {
+		if c.cancelRemotely {
+			go c.cancelRemote(b, seq)
 		}
+		b.done(nil)
+		c.breaker.cancel()
+		call.SetTransportError(ctx.Err())
+		c.finish(call)
+		return
+	}
 
-		call.Done <- call
+	b.done(err)
+	c.breaker.record(err)
+
+	if err != nil {
+		call.SetTransportError(err)
+	}
+
+	c.finish(call)
+}
+
+// Hands call back to the caller, freeing its reply for other calls.
+func (c *client) finish(call *rpc.CallResult) {
+	c.replies.Release(call.Reply)
+	call.Done <- call
+}
+
+// roundTrip sends call through codec and reads back its response. The
+// returned error is a failure to exchange the call, errors reported by the
+// server are set on the call.
+func roundTrip(codec rpc.ClientCodec, call *rpc.CallResult, seq uint64) error {
+	defer codec.Close()
+
+	args, _ := SplitIdempotent(call.Args)
+	if err := codec.WriteRequest(call.ServiceMethod, seq, args); err != nil {
+		return err
+	}
+
+	resp := rpc.Response{Reply: call.Reply}
+	if err := codec.ReadResponse(&resp); err != nil {
+		return err
 	}
+
+	call.Error = resp.Error
+	return nil
 }
 
 // Call invokes the named function, waits for it to complete, and returns its error status.
 func (c *client) Call(serviceMethod string, args, reply interface{})  *rpc.CallResult {
+	return c.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// CallContext is like Call but the HTTP request is made with ctx: when ctx
+// is done the request is aborted and the call completes with an error
+// that unwraps to ctx.Err().
+// The metadata attached to ctx with rpc.WithMetadata are sent as headers.
+func (c *client) CallContext(ctx context.Context, serviceMethod string, args, reply interface{}) *rpc.CallResult {
 
 	result := new(rpc.CallResult)
 	result.ServiceMethod = serviceMethod
@@ -147,31 +320,93 @@ func (c *client) Call(serviceMethod string, args, reply interface{})  *rpc.CallR
 	result.Reply = reply
 	result.Done = make(chan *rpc.CallResult)
 
-	c.queue <- result
+	if !c.replies.Acquire(reply) {
+		result.SetTransportError(rpc.ErrReplyInUse)
+		go func() { result.Done <- result }()
+		return result
+	}
+
+	c.start.Do(func() { go c.sender() })
+
+	select {
+	case c.queue <- pendingCall{ctx, result}:
+	case <-c.quit:
+		result.SetTransportError(ErrClientClosed)
+		go c.finish(result)
+	}
 
 	return result
 }
 	
-// Close the connection
+// Capabilities returns the capabilities of the server, see
+// CapabilitiesClient.
+func (c *client) Capabilities() (Capabilities, error) {
+	return fetchCapabilities(c, &c.caps)
+}
+
+// Close stops the client. Calls made afterwards fail with
+// ErrClientClosed; the calls already sent complete as usual.
 func (c *client) Close() error {
+	c.stop.Do(func() { close(c.quit) })
 	return nil
 }
 
+// ClientOption configures a client.
+type ClientOption func(*client)
+
+// WithBreaker guards the calls of the client with breaker. The breaker
+// should not be shared between clients.
+func WithBreaker(breaker *Breaker) ClientOption {
+	return func(c *client) {
+		c.breaker = breaker
+	}
+}
+
+// StrictReplies makes the client fail calls whose result carries fields
+// the reply value doesn't have, rather than silently dropping them, to
+// catch version skew between client and server. The call completes with
+// an ERR_INTERNAL error, its Data the decoding error; the server is not
+// held responsible for it as for a transport failure.
+func StrictReplies() ClientOption {
+	return func(c *client) {
+		c.strict = true
+	}
+}
+
 // DialHTTP connects to an HTTP RPC-JSON2 server
 // at the specified network address and path.
-func NewClientHTTP(address, path string) rpc.Client {
-	u, err := url.Parse(address + path)
-	if err != nil {
-		glog.Fatal(err)
+func NewClientHTTP(address, path string, opts ...ClientOption) rpc.Client {
+	return NewClientHTTPBalanced([]string{address}, path, RoundRobin, opts...)
+}
+
+// NewClientHTTPBalanced returns a client spreading calls over the HTTP
+// RPC-JSON2 servers at the given addresses, all serving the same path,
+// according to policy. A server that fails a call is left out for a
+// while, unless every server has failed.
+func NewClientHTTPBalanced(addresses []string, path string, policy Policy, opts ...ClientOption) rpc.Client {
+	if len(addresses) == 0 {
+		glog.Fatal("RPC-JSON2: no server address")
 	}
-	
+
+	lb := &balancer{policy: policy}
+	for _, address := range addresses {
+		u, err := url.Parse(address + path)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		lb.backends = append(lb.backends, &backend{url: u})
+	}
+
 	httpClient:= &client{
-		remoteURL: u,
-		c: &http.Client{},
-		queue: make(chan *rpc.CallResult),
+		lb: lb,
+		c: &http.Client{CheckRedirect: noRedirect},
+		queue: make(chan pendingCall),
+		quit: make(chan struct{}),
 	}
 
-	go httpClient.sender()
+	for _, opt := range opts {
+		opt(httpClient)
+	}
 
 	return httpClient
 }
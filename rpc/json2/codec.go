@@ -0,0 +1,198 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/entuerto/av-vortex/rpc"
+)
+
+//-----------------------------------------------------------------------------
+// clientCodec
+//-----------------------------------------------------------------------------
+
+// clientCodec is the JSON-RPC 2.0 implementation of rpc.ClientCodec.
+type clientCodec struct {
+	dec Decoder
+	enc Encoder
+	w   io.Writer
+	c   io.Closer
+
+	strict bool         // fail replies carrying fields the reply value doesn't have
+	md     rpc.Metadata // sent in the requests, for transports without headers
+
+	mutex   sync.Mutex        // protects pending
+	pending map[uint64]string // service method of requests awaiting a response
+}
+
+var _ rpc.ClientCodec = (*clientCodec)(nil)
+
+// clientError is a jsonError as read by clients, leaving the data raw.
+type clientError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// NewClientCodec returns a rpc.ClientCodec speaking JSON-RPC 2.0 over conn.
+func NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return newClientCodec(conn, false)
+}
+
+// NewClientCodecMetadata is like NewClientCodec but the requests carry md
+// in their "metadata" member, for transports without headers to send
+// metadata in.
+func NewClientCodecMetadata(conn io.ReadWriteCloser, md rpc.Metadata) rpc.ClientCodec {
+	c := newClientCodec(conn, false)
+	c.md = md
+	return c
+}
+
+func newClientCodec(conn io.ReadWriteCloser, strict bool) *clientCodec {
+	return &clientCodec{
+		dec:     jsonImpl.NewDecoder(conn),
+		enc:     jsonImpl.NewEncoder(conn),
+		w:       conn,
+		c:       conn,
+		strict:  strict,
+		pending: make(map[uint64]string),
+	}
+}
+
+func (c *clientCodec) WriteRequest(serviceMethod string, seq uint64, args interface{}) error {
+	c.mutex.Lock()
+	c.pending[seq] = serviceMethod
+	c.mutex.Unlock()
+
+	if raw, ok := rawJSON(args); ok {
+		return c.writeRaw(serviceMethod, seq, raw)
+	}
+
+	creq := &clientRequest{
+		Version: "2.0",
+		Method:  serviceMethod,
+		Params:  args,
+		Meta:    c.md,
+		Id:      seq,
+	}
+	return c.enc.Encode(creq)
+}
+
+// Returns the JSON held by v when it is already encoded, as a
+// json.RawMessage, params or a reply.
+func rawJSON(v interface{}) (json.RawMessage, bool) {
+	switch raw := v.(type) {
+	case json.RawMessage:
+		return raw, true
+	case *json.RawMessage:
+		if raw != nil {
+			return *raw, true
+		}
+	}
+	return nil, false
+}
+
+// Writes a request around params as they are, where encoding/json would
+// compact them.
+func (c *clientCodec) writeRaw(serviceMethod string, seq uint64, params json.RawMessage) error {
+	if !json.Valid(params) {
+		return errors.New("RPC-JSON2: raw params are not valid JSON")
+	}
+
+	method, err := jsonImpl.Marshal(serviceMethod)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"jsonrpc":"2.0","method":`)
+	buf.Write(method)
+	buf.WriteString(`,"params":`)
+	buf.Write(params)
+	if len(c.md) > 0 {
+		md, err := jsonImpl.Marshal(c.md)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(`,"metadata":`)
+		buf.Write(md)
+	}
+	buf.WriteString(`,"id":`)
+	buf.WriteString(strconv.FormatUint(seq, 10))
+	buf.WriteString("}\n")
+
+	_, err = c.w.Write(buf.Bytes())
+	return err
+}
+
+func (c *clientCodec) ReadResponse(resp *rpc.Response) error {
+	var cresp clientResponse
+	if err := c.dec.Decode(&cresp); err != nil {
+		return err
+	}
+	return c.decodeResponse(&cresp, resp)
+}
+
+// Decodes cresp, one of the responses read, into resp.
+func (c *clientCodec) decodeResponse(cresp *clientResponse, resp *rpc.Response) error {
+	c.mutex.Lock()
+	resp.ServiceMethod = c.pending[cresp.Id]
+	delete(c.pending, cresp.Id)
+	c.mutex.Unlock()
+
+	resp.Seq = cresp.Id
+	resp.Error = nil
+
+	if cresp.Error != nil {
+		var jerr clientError
+
+		if err := jsonImpl.Unmarshal(*cresp.Error, &jerr); err != nil {
+			return err
+		}
+
+		// Keep the data raw for ServerError.UnmarshalData
+		var data interface{}
+		if len(jerr.Data) > 0 && string(jerr.Data) != "null" {
+			data = jerr.Data
+		}
+
+		resp.Error = rpc.NewServerError(jerr.Code, jerr.Message, data)
+		return nil
+	}
+	if cresp.Result == nil || resp.Reply == nil {
+		return nil
+	}
+	if c.strict {
+		return decodeStrict(*cresp.Result, resp)
+	}
+	return jsonImpl.Unmarshal(*cresp.Result, resp.Reply)
+}
+
+// Decodes result into resp.Reply, failing the call with ERR_INTERNAL when
+// result carries fields the reply doesn't have: when it only fails to
+// decode strictly, whatever the wording of the error.
+func decodeStrict(result json.RawMessage, resp *rpc.Response) error {
+	dec := jsonImpl.NewDecoder(bytes.NewReader(result))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(resp.Reply)
+	if err != nil && jsonImpl.Unmarshal(result, resp.Reply) == nil {
+		msg := fmt.Sprintf("RPC-JSON2: result of %s does not match the reply %T", resp.ServiceMethod, resp.Reply)
+		resp.Error = rpc.NewServerError(rpc.ERR_INTERNAL, msg, err.Error())
+		return nil
+	}
+	return err
+}
+
+func (c *clientCodec) Close() error {
+	return c.c.Close()
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CompressAbove makes the handler gzip the responses whose encoded body is
+// larger than threshold bytes, for clients accepting gzip. Smaller
+// responses are sent as they are, compressing them costs more than it
+// saves.
+func CompressAbove(threshold int) HandlerOption {
+	return func(h *Handler) {
+		h.compress = true
+		h.compressAbove = threshold
+	}
+}
+
+var gzipPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// Compresses body into a buffer from bufferPool, which the caller must put
+// back.
+func gzipBody(body []byte) (*bytes.Buffer, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+
+	zw := gzipPool.Get().(*gzip.Writer)
+	defer gzipPool.Put(zw)
+	zw.Reset(buf)
+
+	if _, err := zw.Write(body); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Reports whether an Accept-Encoding header value accepts gzip, that is
+// lists gzip or * without a zero quality.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		return q > 0
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"net/http"
+)
+
+// AllowOrigins lets browser clients served from origins, such as
+// "https://example.com" or "*" for any, call the handler: their calls are
+// answered with the CORS headers browsers need to read the responses, and
+// their OPTIONS preflight requests with the headers allowing the POST.
+// Requests from other origins are refused with status 403. Requests
+// without an Origin header, those of clients other than browsers, are
+// served as usual.
+func AllowOrigins(origins ...string) HandlerOption {
+	return func(h *Handler) {
+		h.cors = &corsPolicy{origins: make(map[string]bool)}
+		for _, origin := range origins {
+			if origin == "*" {
+				h.cors.any = true
+			}
+			h.cors.origins[origin] = true
+		}
+	}
+}
+
+// corsPolicy holds the origins browser clients may call from.
+type corsPolicy struct {
+	any     bool // if true, any origin may
+	origins map[string]bool
+}
+
+func (p *corsPolicy) allows(origin string) bool {
+	return p.any || p.origins[origin]
+}
+
+// Sets the CORS headers of the response to r, reporting whether it is
+// answered already: r is a preflight request, or comes from an origin
+// that is not allowed.
+func (h *Handler) serveCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if h.cors == nil || origin == "" {
+		return false
+	}
+
+	if !h.cors.allows(origin) {
+		http.Error(w, "RPC-JSON2: origin not allowed: " + origin, http.StatusForbidden)
+		return true
+	}
+
+	header := w.Header()
+	header.Set("Access-Control-Allow-Origin", origin)
+	header.Add("Vary", "Origin")
+
+	if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+
+	// Preflight: the headers the call is to send are those the client
+	// asks for, metadata headers among them.
+	header.Set("Access-Control-Allow-Methods", "POST")
+	if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		header.Set("Access-Control-Allow-Headers", requested)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
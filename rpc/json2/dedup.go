@@ -0,0 +1,154 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/entuerto/av-vortex/rpc"
+)
+
+// NotificationIDHeader is the HTTP header carrying the id a client gives a
+// notification, so that a handler deduplicating notifications can tell a
+// redelivery from a new one. The id of a request's members is no help,
+// notifications have none.
+const NotificationIDHeader = "Notification-Id"
+
+// SeenSet records the notifications a handler ran, for DedupNotifications.
+// Implementations must be safe for concurrent use.
+type SeenSet interface {
+	// Seen records key and reports whether it was recorded already,
+	// within the window the set remembers keys for.
+	Seen(key string) bool
+	// Forget removes key, recorded for a notification that didn't run.
+	Forget(key string)
+}
+
+// DedupNotifications makes the handler drop the notifications whose id,
+// sent in the Notification-Id header, seen already records for the same
+// method. Transports delivering at least once may send a notification
+// twice; the duplicate is answered like the original without running the
+// method again. A notification refused or failing is forgotten, to be run
+// when delivered again. The notifications of a batch share the id of the
+// request and are told apart by their position in it, so that a batch
+// delivered twice runs them once. Messages served by ServeMessage are
+// deduplicated by the id set with WithNotificationID. Notifications
+// without an id are always run.
+func DedupNotifications(seen SeenSet) HandlerOption {
+	return func(h *Handler) {
+		h.seen = seen
+	}
+}
+
+// WithNotificationID returns a copy of ctx carrying id, the id a transport
+// other than HTTP received a message with, for ServeMessage to drop the
+// notifications it was given already as the Notification-Id header has
+// handlers do.
+func WithNotificationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, notificationIDKey, id)
+}
+
+// Returns the id the notifications of the request served with ctx were
+// sent with, "" for none.
+func notificationID(ctx context.Context) string {
+	if id, ok := ctx.Value(notificationIDKey).(string); ok {
+		return id
+	}
+	if info, ok := CallInfoFromContext(ctx); ok {
+		return info.Header.Get(NotificationIDHeader)
+	}
+	return ""
+}
+
+// Returns the key the notification jreq is recorded with, "" when it has
+// no id. member is the position of jreq in its batch, -1 when it came
+// alone.
+func notificationKey(jreq *srvRequest, member int) string {
+	id := notificationID(jreq.Context())
+	if id == "" {
+		return ""
+	}
+
+	key := jreq.Method + ":" + id
+	if member >= 0 {
+		key += "#" + strconv.Itoa(member)
+	}
+	return key
+}
+
+// Reports whether the notification jreq was run already, recording it
+// otherwise.
+func (h *Handler) duplicate(jreq *srvRequest, member int) bool {
+	if h.seen == nil {
+		return false
+	}
+	key := notificationKey(jreq, member)
+	return key != "" && h.seen.Seen(key)
+}
+
+// Forgets the notification jreq recorded by duplicate, which wasn't run
+// after all: result is its outcome.
+func (h *Handler) forget(jreq *srvRequest, member int, result *rpc.Result) {
+	if h.seen == nil || result.Error == nil {
+		return
+	}
+	if key := notificationKey(jreq, member); key != "" {
+		h.seen.Forget(key)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// memorySeenSet
+//-----------------------------------------------------------------------------
+
+// memorySeenSet is a SeenSet keeping keys in memory for a window.
+type memorySeenSet struct {
+	window time.Duration
+
+	mutex   sync.Mutex
+	expires map[string]time.Time
+	swept   time.Time // last sweep of the expired keys
+}
+
+// NewMemorySeenSet returns a SeenSet remembering each key in memory for
+// window after it is first seen.
+func NewMemorySeenSet(window time.Duration) SeenSet {
+	return &memorySeenSet{
+		window:  window,
+		expires: make(map[string]time.Time),
+		swept:   time.Now(),
+	}
+}
+
+func (s *memorySeenSet) Seen(key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.swept) > s.window {
+		for k, expires := range s.expires {
+			if now.After(expires) {
+				delete(s.expires, k)
+			}
+		}
+		s.swept = now
+	}
+
+	if expires, present := s.expires[key]; present && !now.After(expires) {
+		return true
+	}
+	s.expires[key] = now.Add(s.window)
+	return false
+}
+
+func (s *memorySeenSet) Forget(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.expires, key)
+}
@@ -6,6 +6,7 @@ package json2
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/entuerto/av-vortex/rpc"
@@ -22,7 +23,8 @@ type jsonError struct {
 	Message string     `json:"message"` /* required */
 
 	// A Primitive or Structured value that contains additional information about the error.
-	Data interface{}   `json:"data"`    /* optional */
+	// Omitted when nil.
+	Data interface{}   `json:"data,omitempty"` /* optional */
 }
 
 func (e jsonError) Error() string {
@@ -38,17 +40,22 @@ func newJsonError(code int, message string, data interface{}) *jsonError {
 	}
 }
 
-// Creates a Json Error from a RPC server error
+// Creates a Json Error from a RPC server error. A rpc.ValidationError is
+// answered as ERR_BAD_PARAMS, its fields as data.
 func newJsonErrorFromError(err error) *jsonError {
-	serr, ok := err.(*rpc.ServerError)
-	if !ok {
-		return newJsonError(rpc.ERR_INTERNAL, err.Error(), null)
+	var verr *rpc.ValidationError
+	if errors.As(err, &verr) {
+		return newJsonError(rpc.ERR_BAD_PARAMS, verr.Error(), verr.Fields)
 	}
 
-	data := serr.Data
-	if data == nil {
-		data = null
+	serr, ok := err.(*rpc.ServerError)
+	if !ok {
+		code, registered := rpc.ErrorCode(err)
+		if !registered {
+			code = rpc.ERR_INTERNAL
+		}
+		return newJsonError(code, err.Error(), nil)
 	}
 
-	return newJsonError(serr.Code, serr.Message, data)
+	return newJsonError(serr.Code, serr.Message, serr.Data)
 }
@@ -0,0 +1,45 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"github.com/entuerto/av-vortex/rpc"
+)
+
+// ListenAndServeH2C serves srv on path at the TCP network address addr
+// over HTTP/1.1 as well as cleartext HTTP/2 (h2c), letting clients
+// multiplex concurrent calls on a single connection.
+func ListenAndServeH2C(addr, path string, srv *rpc.Server, opts ...HandlerOption) error {
+	return http.ListenAndServe(addr, newH2CHandler(path, srv, opts...))
+}
+
+func newH2CHandler(path string, srv *rpc.Server, opts ...HandlerOption) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(path, NewHandler(srv, opts...))
+	return h2c.NewHandler(mux, &http2.Server{})
+}
+
+// WithHTTP2 makes the client speak cleartext HTTP/2 (h2c) with prior
+// knowledge, as served by ListenAndServeH2C, so that concurrent calls
+// share one connection per server. Servers reached over https already
+// negotiate HTTP/2 without it.
+func WithHTTP2() ClientOption {
+	return func(c *client) {
+		c.c.Transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+	}
+}
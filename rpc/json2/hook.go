@@ -0,0 +1,60 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"github.com/entuerto/av-vortex/rpc"
+)
+
+// A RequestHook sees the calls a handler is about to hand to the server,
+// before their params are decoded into args: the raw params can be read
+// with req.DecodeParams into a json.RawMessage. It returns the request to
+// dispatch, req itself or one rewritten from it, see RenameMethod, or a
+// result to answer the call with rather than dispatching it.
+type RequestHook func(req rpc.Request) (rpc.Request, *rpc.Result)
+
+// BeforeDispatch has hook see the calls to the server's methods before
+// they are dispatched, to reject the calls a gateway blocks cheaply or to
+// rewrite them. It runs after the handler's own checks, on single calls
+// and those of batches alike; built-in system methods don't go through
+// it.
+func BeforeDispatch(hook RequestHook) HandlerOption {
+	return func(h *Handler) {
+		h.hook = hook
+	}
+}
+
+// RenameMethod returns a copy of req, a request read by a handler, calling
+// method of service instead, for a RequestHook to rewrite the calls it
+// sees. The copy keeps the params, id, context and metadata of req. Other
+// requests are returned as they are.
+func RenameMethod(req rpc.Request, service, method string) rpc.Request {
+	jreq, ok := req.(*srvRequest)
+	if !ok {
+		return req
+	}
+
+	renamed := *jreq
+	renamed.Method = service + "." + method
+	renamed.serviceName = service
+	renamed.methodName = method
+	return &renamed
+}
+
+// Runs the hook of the handler on jreq, returning the request to dispatch
+// or the result answering it.
+func (h *Handler) intercept(jreq *srvRequest) (rpc.Request, *rpc.Result) {
+	if h.hook == nil {
+		return jreq, nil
+	}
+	req, result := h.hook(jreq)
+	if result != nil {
+		return nil, result
+	}
+	if req == nil {
+		return jreq, nil
+	}
+	return req, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/entuerto/av-vortex/rpc"
+)
+
+//-----------------------------------------------------------------------------
+// inprocConn
+//-----------------------------------------------------------------------------
+
+// inprocConn carries a single request/response exchange straight to a
+// server, without a socket. Writes are buffered into the request, which is
+// run through the server on the first Read; reads then come from the
+// encoded response.
+type inprocConn struct {
+	ctx context.Context
+	h   *Handler
+	key string // idempotency key, if any
+
+	req  bytes.Buffer
+	resp *bytes.Buffer
+}
+
+func (conn *inprocConn) Write(p []byte) (int, error) {
+	return conn.req.Write(p)
+}
+
+func (conn *inprocConn) Read(p []byte) (int, error) {
+	if conn.resp == nil {
+		conn.resp = new(bytes.Buffer)
+		if err := conn.exchange(); err != nil {
+			return 0, err
+		}
+	}
+	return conn.resp.Read(p)
+}
+
+func (conn *inprocConn) exchange() error {
+	var result *rpc.Result
+
+	request, err := conn.h.readRequest(ioutil.NopCloser(&conn.req))
+	if jreq, ok := request.(*srvRequest); ok {
+		jreq.ctx = conn.ctx
+		jreq.idempotencyKey = conn.key
+		jreq.Meta = rpc.OutgoingMetadata(conn.ctx)
+	}
+
+	if err == nil {
+		result = conn.h.dispatch(request.(*srvRequest))
+	} else {
+		result = rpc.NewResult(nil, err)
+	}
+
+	err = writeResponse(conn.resp, request, result)
+	result.Release()
+	return err
+}
+
+func (conn *inprocConn) Close() error {
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// Client in process
+//-----------------------------------------------------------------------------
+
+type inprocClient struct {
+	seq     uint64 // first to keep it 64-bit aligned for sync/atomic
+	h       *Handler
+	caps    capabilitiesCache
+	replies rpc.ReplyGuard // replies of the calls in flight
+}
+
+func (c *inprocClient) send(ctx context.Context, call *rpc.CallResult, seq uint64) {
+	if err := ctx.Err(); err != nil {
+		call.SetTransportError(err)
+		c.finish(call)
+		return
+	}
+
+	_, key := SplitIdempotent(call.Args)
+	codec := NewClientCodec(&inprocConn{ctx: ctx, h: c.h, key: key})
+
+	err := roundTrip(codec, call, seq)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		call.SetTransportError(ctxErr)
+	} else if err != nil {
+		call.SetTransportError(err)
+	}
+
+	c.finish(call)
+}
+
+// Hands call back to the caller, freeing its reply for other calls.
+func (c *inprocClient) finish(call *rpc.CallResult) {
+	c.replies.Release(call.Reply)
+	call.Done <- call
+}
+
+// Call invokes the named function, waits for it to complete, and returns its error status.
+func (c *inprocClient) Call(serviceMethod string, args, reply interface{}) *rpc.CallResult {
+	return c.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// CallContext is like Call but the call is served with ctx as its context:
+// methods taking a context see it, and a call still queued when ctx is
+// done is not run. The call completes with an error that unwraps to
+// ctx.Err() once ctx is done, without waiting for the method.
+func (c *inprocClient) CallContext(ctx context.Context, serviceMethod string, args, reply interface{}) *rpc.CallResult {
+
+	result := new(rpc.CallResult)
+	result.ServiceMethod = serviceMethod
+	result.Args = args
+	result.Reply = reply
+	result.Done = make(chan *rpc.CallResult)
+
+	if !c.replies.Acquire(reply) {
+		result.SetTransportError(rpc.ErrReplyInUse)
+		go func() { result.Done <- result }()
+		return result
+	}
+
+	go c.send(ctx, result, atomic.AddUint64(&c.seq, 1))
+
+	return result
+}
+
+// Capabilities returns the capabilities of the server, see
+// CapabilitiesClient.
+func (c *inprocClient) Capabilities() (Capabilities, error) {
+	return fetchCapabilities(c, &c.caps)
+}
+
+// Close the connection
+func (c *inprocClient) Close() error {
+	return nil
+}
+
+// NewInProcClient returns a client calling srv within the process. Calls
+// go through the same JSON-RPC 2.0 encoding and decoding as over HTTP,
+// but without a socket, which keeps tests fast and deterministic.
+func NewInProcClient(srv *rpc.Server) rpc.Client {
+	return &inprocClient{h: NewHandler(srv)}
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// JSON is an implementation of JSON encoding and decoding, set with
+// SetJSON to replace encoding/json. It must behave as encoding/json does,
+// json.RawMessage and json.Number included; drop-in replacements such as
+// jsoniter or segmentio/encoding only need their encoders and decoders
+// wrapped to satisfy Encoder and Decoder.
+type JSON interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+// An Encoder writes JSON values to an output stream, as json.Encoder does.
+type Encoder interface {
+	Encode(v interface{}) error
+}
+
+// A Decoder reads JSON values from an input stream, as json.Decoder does.
+// Handlers answer a request that fails to decode according to the error:
+// syntax errors must be, or wrap, a *json.SyntaxError to be answered with
+// ERR_PARSE, and values of the wrong type a *json.UnmarshalTypeError to be
+// answered with ERR_INVALID_REQ; other errors are taken for internal
+// failures, or for unknown members under the Strict option.
+type Decoder interface {
+	Decode(v interface{}) error
+	UseNumber()
+	DisallowUnknownFields()
+}
+
+// The JSON implementation used by handlers and clients.
+var jsonImpl JSON = stdJSON{}
+
+// SetJSON makes the package encode and decode JSON with impl, or with
+// encoding/json again when impl is nil. It is not safe to call while
+// requests are served or calls made; set it up before creating handlers
+// and clients.
+func SetJSON(impl JSON) {
+	if impl == nil {
+		impl = stdJSON{}
+	}
+	jsonImpl = impl
+}
+
+// stdJSON is JSON as implemented by encoding/json.
+type stdJSON struct{}
+
+func (stdJSON) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (stdJSON) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (stdJSON) NewEncoder(w io.Writer) Encoder {
+	return json.NewEncoder(w)
+}
+
+func (stdJSON) NewDecoder(r io.Reader) Decoder {
+	return json.NewDecoder(r)
+}
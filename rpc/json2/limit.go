@@ -0,0 +1,79 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/entuerto/av-vortex/rpc"
+)
+
+var (
+	ErrTooManyRequests = rpc.NewServerError(rpc.ERR_SERVER, "RPC-JSON2: too many concurrent requests from the client", nil)
+)
+
+// LimitPerClient caps the calls each client may have in flight at n. Calls
+// past the cap are answered ErrTooManyRequests with status 429, without
+// reaching the server. identify names the client of a request, a nil
+// identify uses its remote IP.
+func LimitPerClient(n int, identify func(r *http.Request) string) HandlerOption {
+	if identify == nil {
+		identify = remoteIP
+	}
+	return func(h *Handler) {
+		h.limit = &clientLimit{
+			n:        n,
+			identify: identify,
+			inflight: make(map[string]int),
+		}
+	}
+}
+
+// Returns the IP of the client of r.
+func remoteIP(r *http.Request) string {
+	return hostOf(r.RemoteAddr)
+}
+
+// Returns the host of the network address addr, addr itself if it has no
+// port.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// clientLimit counts the calls in flight of each client.
+type clientLimit struct {
+	n        int
+	identify func(r *http.Request) string
+
+	mutex    sync.Mutex
+	inflight map[string]int
+}
+
+// Reserves a slot for client, reporting false when it has none left.
+func (l *clientLimit) acquire(client string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.inflight[client] >= l.n {
+		return false
+	}
+	l.inflight[client]++
+	return true
+}
+
+func (l *clientLimit) release(client string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.inflight[client]--; l.inflight[client] <= 0 {
+		delete(l.inflight, client)
+	}
+}
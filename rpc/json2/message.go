@@ -0,0 +1,91 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+
+	"github.com/golang/glog"
+	"github.com/entuerto/av-vortex/rpc"
+)
+
+// ServeMessage serves the JSON-RPC 2.0 request, or batch, held in msg as
+// received over a transport other than HTTP, such as a message broker,
+// with ctx as the context of its calls. It returns the response to send
+// back, or nil when there is none: for notifications, batches of them
+// only, and responses that could not be encoded.
+//
+// The limit of calls per client, tied to HTTP, doesn't apply to messages.
+// Duplicate notifications are dropped when ctx carries the id of the
+// message, see WithNotificationID.
+func (h *Handler) ServeMessage(ctx context.Context, msg []byte) []byte {
+	var buf bytes.Buffer
+
+	body := bufio.NewReader(bytes.NewReader(msg))
+	if isBatch(body) {
+		batch, err := h.readBatch(body)
+		if err != nil {
+			// The batch is answered with a single response.
+			err = writeResponse(&buf, &srvRequest{Version: "2.0"}, rpc.NewResult(nil, err))
+		} else if n, runErr := h.runBatch(ctx, batch, &buf); runErr != nil {
+			err = runErr
+		} else if n == 0 {
+			return nil
+		}
+		if err != nil {
+			glog.Error(err)
+			return nil
+		}
+		return buf.Bytes()
+	}
+
+	var result *rpc.Result
+
+	request, err := h.readRequest(ioutil.NopCloser(body))
+	jreq, _ := request.(*srvRequest)
+	if jreq != nil {
+		jreq.ctx = ctx
+	}
+
+	if err == nil && !h.exposes(jreq.Method) {
+		err = rpc.NewServerError(rpc.ERR_NO_METHOD, rpc.ErrMethodNotFound.Message, jreq.Method)
+	}
+
+	recorded := false // the notification, by duplicate
+	if err == nil && jreq.notification() {
+		if h.duplicate(jreq, -1) {
+			return nil
+		}
+		recorded = true
+	}
+
+	if err == nil {
+		untrack := h.track(jreq)
+		result = h.dispatch(jreq)
+		untrack()
+	} else {
+		result = rpc.NewResult(nil, err)
+	}
+	if recorded {
+		h.forget(jreq, -1, result)
+	}
+
+	if err == nil && jreq.notification() {
+		result.Release()
+		return nil
+	}
+
+	err = writeResponse(&buf, request, result)
+	result.Release()
+
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	return buf.Bytes()
+}
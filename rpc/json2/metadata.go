@@ -0,0 +1,58 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/entuerto/av-vortex/rpc"
+)
+
+// MetadataHeaderPrefix prefixes the HTTP headers carrying the metadata of
+// a call, see rpc.Metadata: the key trace-id is sent as the header
+// Rpc-Metadata-Trace-Id. Over transports without headers the metadata are
+// sent in the "metadata" member of the request object instead.
+const MetadataHeaderPrefix = "Rpc-Metadata-"
+
+// Metadata returns the metadata of the call: those sent as headers of the
+// HTTP request it arrived on, then those of its "metadata" member, which
+// belong to the call alone when it is part of a batch.
+func (r srvRequest) Metadata() rpc.Metadata {
+	var md rpc.Metadata
+	if info, ok := CallInfoFromContext(r.Context()); ok {
+		md = headerMetadata(info.Header)
+	}
+
+	if len(r.Meta) > 0 && md == nil {
+		md = make(rpc.Metadata, len(r.Meta))
+	}
+	for k, v := range r.Meta {
+		md[k] = v
+	}
+	return md
+}
+
+// Returns the metadata sent as headers in header, or nil.
+func headerMetadata(header http.Header) rpc.Metadata {
+	var md rpc.Metadata
+	for name, values := range header {
+		if len(name) <= len(MetadataHeaderPrefix) || !strings.HasPrefix(name, MetadataHeaderPrefix) || len(values) == 0 {
+			continue
+		}
+		if md == nil {
+			md = make(rpc.Metadata)
+		}
+		md[strings.ToLower(name[len(MetadataHeaderPrefix):])] = values[0]
+	}
+	return md
+}
+
+// Sets the headers carrying md in header.
+func setMetadataHeaders(header http.Header, md rpc.Metadata) {
+	for k, v := range md {
+		header.Set(MetadataHeaderPrefix + k, v)
+	}
+}
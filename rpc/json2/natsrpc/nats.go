@@ -0,0 +1,239 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package natsrpc carries JSON-RPC 2.0 calls over a NATS message broker
+rather than HTTP. A server subscribes to a subject and answers each
+request message on its reply subject; a client publishes its calls as
+requests on that subject.
+
+The package depends on no NATS client library: it talks to the broker
+through Conn, which a few lines wrap around a *nats.Conn of
+github.com/nats-io/nats.go:
+
+	type natsConn struct{ nc *nats.Conn }
+
+	func (c natsConn) Subscribe(subject string, handler func(*natsrpc.Msg)) (natsrpc.Subscription, error) {
+		return c.nc.Subscribe(subject, func(m *nats.Msg) {
+			handler(&natsrpc.Msg{Subject: m.Subject, Reply: m.Reply, Data: m.Data})
+		})
+	}
+
+	func (c natsConn) Publish(subject string, data []byte) error {
+		return c.nc.Publish(subject, data)
+	}
+
+	func (c natsConn) Request(ctx context.Context, subject string, data []byte) (*natsrpc.Msg, error) {
+		m, err := c.nc.RequestWithContext(ctx, subject, data)
+		if err != nil {
+			return nil, err
+		}
+		return &natsrpc.Msg{Subject: m.Subject, Reply: m.Reply, Data: m.Data}, nil
+	}
+*/
+package natsrpc
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"github.com/entuerto/av-vortex/rpc"
+	"github.com/entuerto/av-vortex/rpc/json2"
+)
+
+// Msg is a message received from the broker.
+type Msg struct {
+	Subject string // subject the message was published on
+	Reply   string // subject to publish the reply on, if any
+	Data    []byte
+}
+
+// Subscription is the interest of a Conn in a subject.
+type Subscription interface {
+	// Unsubscribe stops the delivery of messages.
+	Unsubscribe() error
+}
+
+// Conn is the connection to the broker the package needs. The broker
+// correlates a request with its reply, through the reply subject.
+type Conn interface {
+	// Subscribe calls handler with every message published on subject,
+	// one message at a time, until the subscription is unsubscribed.
+	Subscribe(subject string, handler func(msg *Msg)) (Subscription, error)
+	// Publish publishes data on subject.
+	Publish(subject string, data []byte) error
+	// Request publishes data on subject and waits for the reply, or
+	// until ctx is done.
+	Request(ctx context.Context, subject string, data []byte) (*Msg, error)
+}
+
+//-----------------------------------------------------------------------------
+// Server
+//-----------------------------------------------------------------------------
+
+// ServeNATS serves srv to the requests published on subject, dispatching
+// the calls they hold as json2.Handler.ServeMessage does, and
+// publishing the responses on their reply subject. Messages are served
+// concurrently, so that a slow call doesn't hold up the subscription. It
+// returns the subscription, to unsubscribe once done.
+func ServeNATS(conn Conn, subject string, srv *rpc.Server, opts ...json2.HandlerOption) (Subscription, error) {
+	h := json2.NewHandler(srv, opts...)
+
+	return conn.Subscribe(subject, func(msg *Msg) {
+		go serveMsg(conn, h, msg)
+	})
+}
+
+func serveMsg(conn Conn, h *json2.Handler, msg *Msg) {
+	resp := h.ServeMessage(context.Background(), msg.Data)
+	if resp == nil || msg.Reply == "" {
+		return
+	}
+	if err := conn.Publish(msg.Reply, resp); err != nil {
+		glog.Errorf("RPC-NATS: replying on %s: %v", msg.Reply, err)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// natsConn
+//-----------------------------------------------------------------------------
+
+// natsConn carries a single request/reply exchange over the broker.
+// Writes are buffered into the request, which is published on the first
+// Read; reads then come from the reply.
+type natsConn struct {
+	ctx     context.Context
+	conn    Conn
+	subject string
+
+	req  bytes.Buffer
+	resp *bytes.Reader
+}
+
+func (c *natsConn) Write(p []byte) (int, error) {
+	return c.req.Write(p)
+}
+
+func (c *natsConn) Read(p []byte) (int, error) {
+	if c.resp == nil {
+		msg, err := c.conn.Request(c.ctx, c.subject, c.req.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		c.resp = bytes.NewReader(msg.Data)
+	}
+	return c.resp.Read(p)
+}
+
+func (c *natsConn) Close() error {
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// Client
+//-----------------------------------------------------------------------------
+
+// ErrClientClosed is the error of the calls made once the client is closed.
+var ErrClientClosed = rpc.NewServerError(rpc.ERR_INTERNAL, "RPC-NATS: client is closed", nil)
+
+// ErrIdempotencyKey is the error of the calls made with json2.Idempotent
+// args: messages have no header to carry the key in, and the key can't
+// be dropped silently.
+var ErrIdempotencyKey = rpc.NewServerError(rpc.ERR_INTERNAL, "RPC-NATS: idempotency keys can't be sent over NATS", nil)
+
+type client struct {
+	conn    Conn
+	subject string
+	seq     uint64
+	closed  int32
+	replies rpc.ReplyGuard // replies of the calls in flight
+}
+
+func (c *client) send(ctx context.Context, call *rpc.CallResult, seq uint64) {
+	if err := ctx.Err(); err != nil {
+		call.SetTransportError(err)
+		c.finish(call)
+		return
+	}
+
+	conn := &natsConn{ctx: ctx, conn: c.conn, subject: c.subject}
+	codec := json2.NewClientCodecMetadata(conn, rpc.OutgoingMetadata(ctx))
+	defer codec.Close()
+
+	err := codec.WriteRequest(call.ServiceMethod, seq, call.Args)
+	if err == nil {
+		resp := rpc.Response{Reply: call.Reply}
+		if err = codec.ReadResponse(&resp); err == nil {
+			call.Error = resp.Error
+		}
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		call.SetTransportError(ctxErr)
+	} else if err != nil {
+		call.SetTransportError(err)
+	}
+
+	c.finish(call)
+}
+
+// Hands call back to the caller, freeing its reply for other calls.
+func (c *client) finish(call *rpc.CallResult) {
+	c.replies.Release(call.Reply)
+	call.Done <- call
+}
+
+// Call invokes the named function, waits for it to complete, and returns its error status.
+func (c *client) Call(serviceMethod string, args, reply interface{}) *rpc.CallResult {
+	return c.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// CallContext is like Call but the request waits for its reply until ctx
+// is done, completing then with an error that unwraps to ctx.Err().
+func (c *client) CallContext(ctx context.Context, serviceMethod string, args, reply interface{}) *rpc.CallResult {
+
+	result := new(rpc.CallResult)
+	result.ServiceMethod = serviceMethod
+	result.Args = args
+	result.Reply = reply
+	result.Done = make(chan *rpc.CallResult)
+
+	if atomic.LoadInt32(&c.closed) != 0 {
+		result.SetTransportError(ErrClientClosed)
+		go func() { result.Done <- result }()
+		return result
+	}
+
+	if _, key := json2.SplitIdempotent(args); key != "" {
+		result.SetTransportError(ErrIdempotencyKey)
+		go func() { result.Done <- result }()
+		return result
+	}
+
+	if !c.replies.Acquire(reply) {
+		result.SetTransportError(rpc.ErrReplyInUse)
+		go func() { result.Done <- result }()
+		return result
+	}
+
+	go c.send(ctx, result, atomic.AddUint64(&c.seq, 1))
+
+	return result
+}
+
+// Close the client. The connection to the broker is left open, it belongs
+// to the caller.
+func (c *client) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+// NewClientNATS returns a client making its calls as requests published
+// on subject, served by ServeNATS. Calls made with json2.Idempotent args
+// fail with ErrIdempotencyKey.
+func NewClientNATS(conn Conn, subject string) rpc.Client {
+	return &client{conn: conn, subject: subject}
+}
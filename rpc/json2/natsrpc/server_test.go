@@ -0,0 +1,228 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package natsrpc
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/entuerto/av-vortex/rpc"
+	"github.com/entuerto/av-vortex/rpc/json2"
+)
+
+type Args struct {
+	A, B int
+}
+
+type Reply struct {
+	C int
+}
+
+type Arith int
+
+func (t *Arith) Add(args Args, reply *Reply) error {
+	reply.C = args.A + args.B
+	return nil
+}
+
+func (t *Arith) Div(args Args, reply *Reply) error {
+	if args.B == 0 {
+		return errors.New("divide by zero")
+	}
+	reply.C = args.A / args.B
+	return nil
+}
+
+func (t *Arith) Lookup(ctx context.Context, key string, reply *string) error {
+	*reply = rpc.MetadataFromContext(ctx)[key]
+	return nil
+}
+
+func (t *Arith) Sleep(ctx context.Context, d time.Duration, reply *Reply) error {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// broker
+//-----------------------------------------------------------------------------
+
+// broker is a Conn delivering messages within the process.
+type broker struct {
+	mutex sync.Mutex
+	subs  map[string]func(*Msg)
+	inbox int
+}
+
+type subscription struct {
+	b       *broker
+	subject string
+}
+
+func (s subscription) Unsubscribe() error {
+	s.b.mutex.Lock()
+	delete(s.b.subs, s.subject)
+	s.b.mutex.Unlock()
+	return nil
+}
+
+func (b *broker) Subscribe(subject string, handler func(*Msg)) (Subscription, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.subs == nil {
+		b.subs = make(map[string]func(*Msg))
+	}
+	b.subs[subject] = handler
+	return subscription{b, subject}, nil
+}
+
+func (b *broker) publish(msg *Msg) error {
+	b.mutex.Lock()
+	handler := b.subs[msg.Subject]
+	b.mutex.Unlock()
+
+	if handler != nil {
+		handler(msg)
+	}
+	return nil
+}
+
+func (b *broker) Publish(subject string, data []byte) error {
+	return b.publish(&Msg{Subject: subject, Data: data})
+}
+
+func (b *broker) Request(ctx context.Context, subject string, data []byte) (*Msg, error) {
+	b.mutex.Lock()
+	b.inbox++
+	inbox := "_INBOX." + strconv.Itoa(b.inbox)
+	b.mutex.Unlock()
+
+	replies := make(chan *Msg, 1)
+	sub, _ := b.Subscribe(inbox, func(msg *Msg) { replies <- msg })
+	defer sub.Unsubscribe()
+
+	b.publish(&Msg{Subject: subject, Reply: inbox, Data: data})
+
+	select {
+	case msg := <-replies:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+func TestNATS_Calls(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+
+	b := new(broker)
+	sub, err := ServeNATS(b, "arith", s)
+	if err != nil {
+		t.Fatal("ServeNATS:", err)
+	}
+	defer sub.Unsubscribe()
+
+	c := NewClientNATS(b, "arith")
+
+	// Calls made concurrently get their own reply
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var reply Reply
+			result := c.Call("Arith.Add", &Args{i, 1}, &reply)
+			<- result.Done
+			if result.Error != nil {
+				t.Errorf("Add: expected no error but got string %q", result.Error.Error())
+			} else if reply.C != i + 1 {
+				t.Errorf("Add: expected %d got %d", i + 1, reply.C)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Metadata travel in the request object
+	var value string
+	ctx := rpc.WithMetadata(context.Background(), rpc.Metadata{"trace-id": "abc123"})
+	result := c.CallContext(ctx, "Arith.Lookup", "trace-id", &value)
+	<- result.Done
+	if result.Error != nil || value != "abc123" {
+		t.Errorf("Lookup: expected abc123 got %q, %v", value, result.Error)
+	}
+
+	// Errors of the method come back as such
+	var reply Reply
+	result = c.Call("Arith.Div", &Args{1, 0}, &reply)
+	<- result.Done
+	if result.Error == nil || result.Error.Message != "divide by zero" {
+		t.Errorf("Div: expected divide by zero got %v", result.Error)
+	}
+
+	// The call gives up once its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	result = c.CallContext(ctx, "Arith.Sleep", time.Second, &reply)
+	<- result.Done
+	if !errors.Is(result.TransportError, context.DeadlineExceeded) {
+		t.Errorf("Sleep: expected the deadline to be exceeded got %v", result.Error)
+	}
+
+	// Idempotency keys have no way to the server, the call is refused
+	result = c.Call("Arith.Add", json2.Idempotent("k-1", &Args{1, 2}), &reply)
+	<- result.Done
+	if result.Error != ErrIdempotencyKey {
+		t.Errorf("Add: expected ErrIdempotencyKey got %v", result.Error)
+	}
+
+	c.Close()
+	result = c.Call("Arith.Add", &Args{1, 2}, &reply)
+	<- result.Done
+	if result.Error != ErrClientClosed {
+		t.Errorf("Add: expected ErrClientClosed got %v", result.Error)
+	}
+}
+
+func TestNATS_Batch(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+
+	b := new(broker)
+	sub, err := ServeNATS(b, "arith", s)
+	if err != nil {
+		t.Fatal("ServeNATS:", err)
+	}
+	defer sub.Unsubscribe()
+
+	batch := `[{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2},"id":1},` +
+		`{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":3,"B":4}}]`
+	msg, err := b.Request(context.Background(), "arith", []byte(batch))
+	if err != nil {
+		t.Fatal("Request:", err)
+	}
+	if expected := `[{"jsonrpc":"2.0","id":1,"result":{"C":3}}]`; strings.Join(strings.Fields(string(msg.Data)), "") != expected {
+		t.Errorf("batch: expected %s got %s", expected, msg.Data)
+	}
+
+	// Notifications get no reply
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	notification := `{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2}}`
+	if _, err := b.Request(ctx, "arith", []byte(notification)); err != context.DeadlineExceeded {
+		t.Errorf("notification: expected no reply got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"io"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// CallStats describes a call served by a handler, as handed to the
+// observers set with ObserveCalls.
+type CallStats struct {
+	Method        string        // "Service.Method" as requested, empty if unreadable or a batch
+	ID            string        // id of the request, see rpc.RequestIDFromContext, empty for a batch
+	RequestBytes  int64         // size of the request body read
+	ResponseBytes int           // size of the response body sent, compressed or not, 0 for notifications
+	Duration      time.Duration // from the start of the request to the response
+	Error         error         // error answered, if any
+	WriteError    error         // failure to send the response, if any, the client gone for instance
+}
+
+// ObserveCalls has fn called with the stats of every call the handler
+// serves, once it is answered, to record size and latency metrics for
+// instance. fn runs on the request's goroutine and should be quick.
+func ObserveCalls(fn func(CallStats)) HandlerOption {
+	return func(h *Handler) {
+		h.observers = append(h.observers, fn)
+	}
+}
+
+// LogSlowCalls makes the handler log a warning, with the method and id of
+// the request, for every call that takes longer than threshold to answer.
+func LogSlowCalls(threshold time.Duration) HandlerOption {
+	return ObserveCalls(func(stats CallStats) {
+		if stats.Duration > threshold {
+			glog.Warningf("RPC-JSON2: slow call to %s, id %q: %v (request %d bytes, response %d bytes)",
+				stats.Method, stats.ID, stats.Duration, stats.RequestBytes, stats.ResponseBytes)
+		}
+	})
+}
+
+// Hands stats to the observers of the handler.
+func (h *Handler) observe(stats *callStats) {
+	stats.Duration = time.Since(stats.start)
+	for _, fn := range h.observers {
+		fn(stats.CallStats)
+	}
+}
+
+// callStats are the CallStats of a call being served.
+type callStats struct {
+	CallStats
+	start time.Time
+	body  *countingReader
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/entuerto/av-vortex/rpc"
+)
+
+// Register is like srv.Register but first checks that the replies of the
+// methods of rcvr can be encoded as JSON. Replies that can't, because they
+// hold a channel or a func for instance, would otherwise only fail when a
+// response is written.
+func Register(srv *rpc.Server, rcvr interface{}) error {
+	return RegisterName(srv, "", rcvr)
+}
+
+// RegisterName is like Register but uses the provided name for the type,
+// as srv.RegisterName does.
+func RegisterName(srv *rpc.Server, name string, rcvr interface{}) error {
+	if err := checkReplies(rcvr); err != nil {
+		return err
+	}
+	return srv.RegisterName(name, rcvr)
+}
+
+// RegisterWithNames is like RegisterName but publishes the methods of
+// rcvr under the names given in methods, as srv.RegisterWithNames does.
+func RegisterWithNames(srv *rpc.Server, name string, rcvr interface{}, methods map[string]string) error {
+	if err := checkReplies(rcvr); err != nil {
+		return err
+	}
+	return srv.RegisterWithNames(name, rcvr, methods)
+}
+
+// Dry-runs the encoding of a zero reply of each method of rcvr, in method
+// name order. The error names the method and carries the encoding error
+// as Data.
+func checkReplies(rcvr interface{}) error {
+	types := rpc.ReplyTypes(rcvr)
+
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		reply := reflect.New(types[name].Elem())
+		if _, err := jsonImpl.Marshal(reply.Interface()); err != nil {
+			msg := fmt.Sprintf("RPC-JSON2: reply of method %s cannot be encoded as JSON", name)
+			return rpc.NewServerError(rpc.ERR_SERVER, msg, err.Error())
+		}
+	}
+	return nil
+}
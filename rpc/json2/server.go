@@ -5,10 +5,20 @@
 package json2
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"	
+	"io/ioutil"
 	"net/http"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/entuerto/av-vortex/rpc"
@@ -21,7 +31,14 @@ import (
 type srvRequest struct {
 	rpc.Request
 
-	result chan *rpc.Result
+	ctx       context.Context
+	result    chan *rpc.Result
+	useNumber bool        // decode numbers in params as json.Number
+	strict    bool        // reject unknown fields in params
+	require   bool        // reject missing params, see RequireParams
+	timing    *callTiming // recorded by the worker, nil unless reported
+
+	idempotencyKey string
 
 	serviceName string       `json:"-"`
 	methodName  string       `json:"-"`
@@ -29,7 +46,8 @@ type srvRequest struct {
 	Version string           `json:"jsonrpc"`
 	Method  string           `json:"method"`
 	Params  *json.RawMessage `json:"params"`
-	Id      *json.RawMessage `json:"id"`
+	Meta    rpc.Metadata     `json:"metadata"` // see Metadata
+	Id      json.RawMessage  `json:"id"` // nil when absent, a null id is kept as is
 }
 
 func (r srvRequest) ServiceName() string {
@@ -40,20 +58,142 @@ func (r srvRequest) MethodName() string {
 	return r.methodName
 }
 
+// DecodeParams decodes the params into args with encoding/json, or the
+// JSON set with SetJSON, so that named params match struct fields by their
+// json tag, or their name when untagged. Positional params, an array, fill
+// the exported fields of a struct in declaration order whatever their
+// tags; there must be as many as there are fields, or the call fails with
+// ERR_BAD_PARAMS and a ParamsCount as Data. Missing or null params leave
+// args as they are, unless the handler requires params.
 func (r srvRequest) DecodeParams(args interface{}) error {
-	if args != nil {
-		return json.Unmarshal(*r.Params, &args)
+	if args == nil {
+		return nil
+	}
+	if r.Params == nil {
+		if r.require && !isEmptyStruct(args) {
+			return ErrMissingParams
+		}
+		return nil
+	}
+	if isArray(*r.Params) {
+		if v := reflect.ValueOf(args); v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Struct {
+			return r.decodePositional(v.Elem())
+		}
+	}
+	return r.decode(*r.Params, args)
+}
+
+// ErrMissingParams answers the calls sent without params, or with null
+// ones, when the handler requires them, see RequireParams.
+var ErrMissingParams = rpc.NewServerError(rpc.ERR_BAD_PARAMS, "RPC-JSON2: missing params", nil)
+
+// Reports whether args points to a struct without fields, which params
+// have nothing to fill in.
+func isEmptyStruct(args interface{}) bool {
+	t := reflect.TypeOf(args)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && t.NumField() == 0
+}
+
+// Decodes data into v with the decoding options of the request.
+func (r srvRequest) decode(data []byte, v interface{}) error {
+	if !r.useNumber && !r.strict {
+		return jsonImpl.Unmarshal(data, &v)
+	}
+
+	dec := jsonImpl.NewDecoder(bytes.NewReader(data))
+	if r.useNumber {
+		dec.UseNumber()
+	}
+	if r.strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(&v)
+}
+
+// Decodes positional params into the exported fields of the struct v, in
+// declaration order.
+func (r srvRequest) decodePositional(v reflect.Value) error {
+	var params []json.RawMessage
+	if err := jsonImpl.Unmarshal(*r.Params, &params); err != nil {
+		return err
+	}
+
+	var fields []int
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Type().Field(i); f.PkgPath == "" && f.Tag.Get("json") != "-" {
+			fields = append(fields, i)
+		}
+	}
+	if len(params) != len(fields) {
+		return rpc.NewServerError(rpc.ERR_BAD_PARAMS, rpc.ErrInvalidParams.Message,
+			ParamsCount{Expected: len(fields), Actual: len(params)})
+	}
+
+	for i, param := range params {
+		if err := r.decode(param, v.Field(fields[i]).Addr().Interface()); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// ParamsCount is the Data of the error answering positional params that
+// are not as many as the fields of the args they fill.
+type ParamsCount struct {
+	Expected int `json:"expected"` // fields of the args
+	Actual   int `json:"actual"`   // params sent
+}
+
+// Reports whether data holds a JSON array.
+func isArray(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return len(data) > 0 && data[0] == '['
+}
+
 func (r srvRequest) Result() chan *rpc.Result {
 	return r.result
 }
 
+// Context returns the context of the HTTP request the call arrived on.
+func (r srvRequest) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// RequestID returns the text of a string id, or the JSON encoding of
+// any other kind of id.
+func (r srvRequest) RequestID() string {
+	if r.Id == nil || string(r.Id) == "null" {
+		return ""
+	}
+
+	var id string
+	if err := jsonImpl.Unmarshal(r.Id, &id); err == nil {
+		return id
+	}
+	return string(r.Id)
+}
+
+// IdempotencyKey returns the key sent by the client in the
+// Idempotency-Key header, if any.
+func (r srvRequest) IdempotencyKey() string {
+	return r.idempotencyKey
+}
+
+// A request without an id is a notification, the client expects no
+// response. A null id is still an id.
+func (r srvRequest) notification() bool {
+	return r.Id == nil
+}
+
 func newRequest() *srvRequest {
 	return &srvRequest{
-		result: make(chan *rpc.Result),
+		result: make(chan *rpc.Result, 1), // the worker hands the result over without waiting
 	}
 }
 
@@ -63,60 +203,197 @@ func newRequest() *srvRequest {
 
 type srvResponse struct {
 	Version string            `json:"jsonrpc"`
-	Id      *json.RawMessage  `json:"id"`
+	Id      json.RawMessage   `json:"id"`
 	Result  interface{}       `json:"result,omitempty"`
 	Error   *jsonError        `json:"error,omitempty"`
 }
 
 
-func readRequest(reader io.ReadCloser) (rpc.Request, error) {
+func (h *Handler) readRequest(reader io.ReadCloser) (rpc.Request, error) {
 	glog.V(2).Infof("[%p] ReadRequest...\n", reader)
 	defer reader.Close()
 
-	dec := json.NewDecoder(reader)
+	dec := jsonImpl.NewDecoder(reader)
 	if dec == nil {
-		rpc.ErrInternal.Message = "Could not create JSON decoder"
-		return nil, rpc.ErrInternal
+		return nil, rpc.NewServerError(rpc.ERR_INTERNAL, "Could not create JSON decoder", nil)
+	}
+	if h.strict {
+		dec.DisallowUnknownFields()
 	}
 
 	jreq := newRequest()
+	jreq.useNumber = h.useNumber
+	jreq.strict = h.strict
+	jreq.require = h.requireParams
 
 	if err := dec.Decode(&jreq); err != nil {
-		rpc.ErrInternal.Message = err.Error()
-		return jreq, rpc.ErrInternal 
+		return jreq, decodeError(err, h.strict)
 	}
 
-	if jreq.Version != "2.0" {
-		rpc.ErrInvalidRequest.Message = "RPC-JSON2: Invalid version"
-		return jreq, rpc.ErrInvalidRequest 
+	if err := validateRequest(jreq, h.versions); err != nil {
+		return jreq, err
 	}
 
 	// find service
-	dot := strings.LastIndex(jreq.Method, ".")
-	if dot < 0 {
-		rpc.ErrInvalidRequest.Message = "RPC-JSON2: service/method request ill-formed" 
-		rpc.ErrInvalidRequest.Data = jreq.Method
-		return jreq, rpc.ErrInvalidRequest 
+	service, method, err := h.resolveMethod(jreq.Method)
+	if err != nil {
+		if serr, ok := err.(*rpc.ServerError); ok {
+			return jreq, serr
+		}
+		return jreq, rpc.NewServerError(rpc.ERR_INVALID_REQ, "RPC-JSON2: " + err.Error(), jreq.Method)
 	}
-
-	jreq.serviceName = jreq.Method[:dot]
-	jreq.methodName  = jreq.Method[dot+1:]
+	jreq.serviceName = service
+	jreq.methodName  = method
 	return jreq, nil  
 }
 
+// ErrEmptyRequest answers requests whose body holds no JSON value at all.
+var ErrEmptyRequest = rpc.NewServerError(rpc.ERR_INVALID_REQ, "RPC-JSON2: empty request", nil)
+
+// Seconds the clients of a server not ready, or shutting down, are told to
+// wait before trying again.
+const retryAfter = "1"
+
+// Reports whether err is the server refusing a call for the time being,
+// not ready or shutting down.
+func unavailable(err error) bool {
+	return err == rpc.ErrNotReady || err == rpc.ErrShutdown
+}
+
+// Returns the error answering a request whose body failed to decode with
+// err: ErrEmptyRequest when it was empty or only white space, ERR_PARSE
+// when it was not valid JSON, truncated included, ERR_INVALID_REQ when a
+// member had the wrong type, ERR_INTERNAL otherwise. In strict mode the
+// other errors are ERR_INVALID_REQ as well, the unknown members it rejects
+// being reported differently by each JSON implementation. Errors are told
+// apart by the types encoding/json reports them with, see Decoder.
+func decodeError(err error, strict bool) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == io.EOF:
+		return ErrEmptyRequest
+	case err == io.ErrUnexpectedEOF || errors.As(err, &syntaxErr):
+		return rpc.NewServerError(rpc.ERR_PARSE, "RPC-JSON2: " + err.Error(), nil)
+	case errors.As(err, &typeErr) || strict:
+		return rpc.NewServerError(rpc.ERR_INVALID_REQ, "RPC-JSON2: " + err.Error(), nil)
+	}
+	return rpc.NewServerError(rpc.ERR_INTERNAL, err.Error(), nil)
+}
+
+// MethodResolver derives the service and the method a call is dispatched
+// to from the method member of its request. A call it fails to resolve
+// is rejected with ERR_INVALID_REQ, or with the error itself when it is
+// a *rpc.ServerError.
+type MethodResolver func(name string) (service, method string, err error)
+
+// ResolveMethods makes the handler resolve the method of calls with
+// resolve rather than by splitting it at its last dot, for APIs naming
+// their methods "Service/Method" for instance. The built-in system
+// methods keep their names whatever the resolver.
+func ResolveMethods(resolve MethodResolver) HandlerOption {
+	return func(h *Handler) {
+		h.resolve = resolve
+	}
+}
+
+// splitMethod is the default MethodResolver, splitting "Service.Method"
+// at its last dot.
+func splitMethod(name string) (string, string, error) {
+	dot := strings.LastIndex(name, ".")
+	if dot <= 0 || dot == len(name) - 1 {
+		return "", "", errors.New("method must be of the form Service.Method")
+	}
+	return name[:dot], name[dot+1:], nil
+}
+
+// Returns the service and method the call to name is dispatched to.
+func (h *Handler) resolveMethod(name string) (string, string, error) {
+	if _, builtin := systemMethods[name]; builtin || h.resolve == nil {
+		return splitMethod(name)
+	}
+	return h.resolve(name)
+}
+
+// Checks the members of the request envelope, returning an
+// ERR_INVALID_REQ error whose Data holds the offending value.
+func validateRequest(jreq *srvRequest, versions []string) error {
+	if versions == nil {
+		versions = defaultVersions
+	}
+
+	switch {
+	case jreq.Version == "":
+		return rpc.NewServerError(rpc.ERR_INVALID_REQ, "RPC-JSON2: missing jsonrpc member", nil)
+
+	case !acceptsVersion(versions, jreq.Version):
+		return rpc.NewServerError(rpc.ERR_INVALID_REQ,
+			"RPC-JSON2: unsupported jsonrpc version, expected " + strings.Join(versions, " or "), jreq.Version)
+
+	case jreq.Method == "":
+		return rpc.NewServerError(rpc.ERR_INVALID_REQ, "RPC-JSON2: missing or empty method member", nil)
+	}
+	return nil
+}
+
+// The versions of the protocol handlers accept unless told otherwise.
+var defaultVersions = []string{"2.0"}
+
+// Reports whether version is one of versions.
+func acceptsVersion(versions []string, version string) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// writeResponse encodes the response to request in full before writing
+// it to writer, so that a failure to encode it writes nothing: a result
+// that can't be encoded is answered with an ERR_INTERNAL error instead,
+// and other encoding errors are returned. A failure to write the encoded
+// response is returned as a *WriteError.
 func writeResponse(writer io.Writer, request rpc.Request, result *rpc.Result) error {
 	glog.V(2).Infof("[%p]  WriteResponse...\n", writer)
 
-	enc := json.NewEncoder(writer)
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer putBuffer(buf)
+
+	if err := encodeResult(buf, request, result); err != nil {
+		return err
+	}
+	if _, err := writer.Write(buf.Bytes()); err != nil {
+		return &WriteError{Err: err}
+	}
+	return nil
+}
+
+// WriteError is the failure to write a response that was encoded, the
+// client having gone away for instance, as opposed to a failure to
+// encode it.
+type WriteError struct {
+	Err error
+}
+
+func (e *WriteError) Error() string {
+	return "RPC-JSON2: writing the response: " + e.Err.Error()
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// Encodes the response to request into buf.
+func encodeResult(buf *bytes.Buffer, request rpc.Request, result *rpc.Result) error {
+	enc := jsonImpl.NewEncoder(buf)
 	if enc == nil {
-		rpc.ErrInternal.Message = "Could not create JSON encoder"
-		return rpc.ErrInternal 
+		return rpc.NewServerError(rpc.ERR_INTERNAL, "Could not create JSON encoder", nil)
 	} 
 
 	jreq, ok := request.(*srvRequest)
 	if !ok {
-		rpc.ErrInternal.Message = "Could not cast to JSON request"
-		return rpc.ErrInternal 
+		return rpc.NewServerError(rpc.ERR_INTERNAL, "Could not cast to JSON request", nil)
 	} 
 
 	jresp := srvResponse{
@@ -126,50 +403,500 @@ func writeResponse(writer io.Writer, request rpc.Request, result *rpc.Result) er
 
 	if result.Error != nil {
 		jresp.Error = newJsonErrorFromError(result.Error) 
+	} else if result.Value == nil {
+		jresp.Result = null // rpc.ErrNoContent, result is still required
 	} else {
 		jresp.Result = result.Value
 	}
+
+	if raw, ok := rawJSON(jresp.Result); ok && jresp.Error == nil {
+		if len(raw) == 0 {
+			raw = null
+		}
+		if json.Valid(raw) {
+			return writeRawResult(buf, jresp, raw)
+		}
+		jresp.Result = nil
+		jresp.Error = newJsonError(rpc.ERR_INTERNAL, "RPC-JSON2: raw result of " + jreq.Method + " is not valid JSON", nil)
+		return enc.Encode(jresp)
+	}
+
+	// A result that can't be encoded, cyclic for instance, is answered
+	// with an error rather than failing the HTTP request. Whatever the
+	// encoder wrote before failing is dropped.
+	err := encodeResponse(enc, jresp)
+	if err != nil && jresp.Error == nil {
+		glog.Errorf("RPC-JSON2: encoding the result of %s: %v", jreq.Method, err)
+
+		buf.Reset()
+		enc = jsonImpl.NewEncoder(buf)
+		jresp.Result = nil
+		jresp.Error = newJsonError(rpc.ERR_INTERNAL, "RPC-JSON2: could not encode the result of " + jreq.Method, err.Error())
+		return enc.Encode(jresp)
+	}
+	return err
+}
+
+// Writes the response jresp around the encoded result raw as it is, where
+// encoding/json would compact and escape it.
+func writeRawResult(writer io.Writer, jresp srvResponse, raw json.RawMessage) error {
+	version, err := jsonImpl.Marshal(jresp.Version)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"jsonrpc":`)
+	buf.Write(version)
+	buf.WriteString(`,"id":`)
+	if len(jresp.Id) > 0 {
+		buf.Write(jresp.Id)
+	} else {
+		buf.Write(null)
+	}
+	buf.WriteString(`,"result":`)
+	buf.Write(raw)
+	buf.WriteString("}\n")
+
+	_, err = writer.Write(buf.Bytes())
+	return err
+}
+
+// Encodes jresp, turning a panic of a MarshalJSON method into an error.
+func encodeResponse(enc Encoder, jresp srvResponse) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while encoding: %v", r)
+		}
+	}()
 	return enc.Encode(jresp)
 }
 
+// Buffers responses are encoded into before being written.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// Larger buffers are left to the garbage collector rather than pinned in
+// the pool by one big response.
+const maxPooledBuffer = 64 << 10
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		buf.Reset()
+		bufferPool.Put(buf)
+	}
+}
+
 //-----------------------------------------------------------------------------
 // Handle HTTP requests
 //-----------------------------------------------------------------------------
 
-func HandleHTTP(path string, srv *rpc.Server) {
-	http.Handle(path, &handler{srv})
+// HandleHTTP registers a handler for srv on path in http.DefaultServeMux
+// and returns it, so that it can be closed.
+func HandleHTTP(path string, srv *rpc.Server, opts ...HandlerOption) *Handler {
+	h := NewHandler(srv, opts...)
+	http.Handle(path, h)
+	return h
 }
 
-type handler struct {
+// Shutdown drains hs and srv without dropping calls: hs stops accepting
+// connections and waits for the calls in flight to be answered, then srv
+// shuts down. Handlers for a server that is shutting down answer 503.
+func Shutdown(ctx context.Context, hs *http.Server, srv *rpc.Server) error {
+	if err := hs.Shutdown(ctx); err != nil {
+		return err
+	}
+	return srv.Shutdown(ctx)
+}
+
+// SchemaHandler returns a handler answering GET requests with the schema
+// of the methods of srv, as described by srv.Schema.
+func SchemaHandler(srv *rpc.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "RPC-JSON2: GET method required, received " + r.Method, http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("x-content-type-options", "nosniff")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := jsonImpl.NewEncoder(w).Encode(srv.Schema()); err != nil {
+			glog.Error(err)
+		}
+	})
+}
+
+// NewHandler returns a handler serving JSON-RPC 2.0 calls to srv.
+func NewHandler(srv *rpc.Server, opts ...HandlerOption) *Handler {
+	h := &Handler{
+		Server:             srv,
+		maxBatch:           DefaultMaxBatchSize,
+		successStatus:      http.StatusOK,
+		notificationStatus: http.StatusNoContent,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// NewCodec returns a rpc.Codec building handlers with opts, to mount a
+// server with rpc.MountAll.
+func NewCodec(opts ...HandlerOption) rpc.Codec {
+	return func(srv *rpc.Server) http.Handler {
+		return NewHandler(srv, opts...)
+	}
+}
+
+// HandlerOption configures a handler.
+type HandlerOption func(*Handler)
+
+// UseNumber makes the handler decode numbers in params as json.Number
+// rather than float64 when they land in an interface{}, so that large
+// integers keep their precision.
+func UseNumber() HandlerOption {
+	return func(h *Handler) {
+		h.useNumber = true
+	}
+}
+
+// AllowMethods restricts the handler to the given "Service.Method" names,
+// as sent by clients. Calls to other methods fail with ERR_NO_METHOD
+// without reaching the server.
+func AllowMethods(methods ...string) HandlerOption {
+	return func(h *Handler) {
+		if h.allow == nil {
+			h.allow = make(map[string]bool)
+		}
+		for _, m := range methods {
+			h.allow[m] = true
+		}
+	}
+}
+
+// DenyMethods hides the given "Service.Method" names, as sent by clients,
+// from the handler. Calls to them fail with ERR_NO_METHOD without
+// reaching the server.
+func DenyMethods(methods ...string) HandlerOption {
+	return func(h *Handler) {
+		if h.deny == nil {
+			h.deny = make(map[string]bool)
+		}
+		for _, m := range methods {
+			h.deny[m] = true
+		}
+	}
+}
+
+// Strict makes the handler reject requests carrying unknown members with
+// ERR_INVALID_REQ, and params carrying fields the method's args don't have
+// with ERR_BAD_PARAMS, rather than silently ignoring them.
+func Strict() HandlerOption {
+	return func(h *Handler) {
+		h.strict = true
+	}
+}
+
+// AcceptVersions sets the values of the jsonrpc member the handler
+// accepts, only "2.0" by default, to serve a transitional version of the
+// protocol during an upgrade. "2.0" is no longer accepted unless listed.
+// Responses carry the version of the request they answer; requests of
+// other versions are rejected with ERR_INVALID_REQ, the version received
+// as data.
+func AcceptVersions(versions ...string) HandlerOption {
+	return func(h *Handler) {
+		h.versions = append([]string(nil), versions...)
+	}
+}
+
+// RequireParams makes the handler reject the calls sent with missing or
+// null params with ErrMissingParams, an ERR_BAD_PARAMS error, when their
+// method takes args, an empty struct aside. By default such calls reach
+// the method with zero args.
+func RequireParams() HandlerOption {
+	return func(h *Handler) {
+		h.requireParams = true
+	}
+}
+
+// PrettyPrint makes the handler indent the JSON of its responses, batches
+// included, for people to read them while debugging. Responses are
+// compact by default.
+func PrettyPrint() HandlerOption {
+	return func(h *Handler) {
+		h.pretty = true
+	}
+}
+
+// SuccessStatus sets the HTTP status of responses carrying a result, and
+// of the responses to batches, 200 by default. Responses carrying an
+// error are still sent with 200.
+func SuccessStatus(code int) HandlerOption {
+	return func(h *Handler) {
+		h.successStatus = code
+	}
+}
+
+// NotificationStatus sets the HTTP status of the empty responses to
+// notifications, and to batches holding notifications only, 204 by
+// default. Gateways that require 200 can have it.
+func NotificationStatus(code int) HandlerOption {
+	return func(h *Handler) {
+		h.notificationStatus = code
+	}
+}
+
+// EditHeaders has fn adjust the headers of every response once the handler
+// set its own, the nosniff option and the JSON content type, so they can
+// be overridden or removed when a gateway manages them.
+func EditHeaders(fn func(http.Header)) HandlerOption {
+	return func(h *Handler) {
+		h.editHeaders = append(h.editHeaders, fn)
+	}
+}
+
+// Handler is an http.Handler serving JSON-RPC 2.0 calls to the server it
+// embeds.
+//
+// A method replying with a json.RawMessage, its reply a *json.RawMessage,
+// has it sent verbatim as the result, without decoding and encoding it
+// again, as a proxy forwarding replies would. The raw reply must be valid
+// JSON, otherwise the call is answered with ERR_INTERNAL; an empty one is
+// sent as null.
+type Handler struct {
 	*rpc.Server
+
+	useNumber     bool
+	strict        bool
+	requireParams bool            // reject missing params, see RequireParams
+	allow         map[string]bool // exposed methods, nil to expose all of them
+	deny          map[string]bool // hidden methods
+	resolve       MethodResolver  // nil to split methods at their last dot
+	hook          RequestHook     // sees calls before dispatch, may be nil
+	versions      []string        // accepted jsonrpc versions, nil for 2.0 only
+
+	editHeaders []func(http.Header)
+
+	pretty bool // indent responses, see PrettyPrint
+	timing bool // report the timing of calls, see ServerTiming
+
+	compress      bool
+	compressAbove int // size in bytes from which responses are compressed
+
+	limit *clientLimit // calls in flight per client, nil for no limit
+
+	cors *corsPolicy // origins browsers may call from, nil for no CORS headers
+
+	maxBatch int // calls a batch may hold, 0 for no limit
+
+	successStatus      int // of responses carrying results
+	notificationStatus int // of the empty responses to notifications
+
+	observers []func(CallStats)
+
+	inflight inflightCalls // calls system.cancel can cancel
+
+	seen SeenSet // notifications run, nil not to deduplicate them
+}
+
+// Close stops the handler and the server behind it: new calls are answered
+// 503, and Close returns once the calls in flight have been answered and
+// the server's workers stopped. Other handlers mounting the same server
+// stop along with it.
+func (h *Handler) Close() error {
+	return h.Server.Shutdown(context.Background())
 }
 
-func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// Reports whether the handler exposes method.
+func (h *Handler) exposes(method string) bool {
+	if h.allow != nil && !h.allow[method] {
+		return false
+	}
+	return !h.deny[method]
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.serveCORS(w, r) {
+		return
+	}
+
 	if r.Method != "POST" {
 		http.Error(w, "RPC-JSON2: POST method required, received " + r.Method, http.StatusMethodNotAllowed)
 		return
 	}
 
+	if h.ShuttingDown() {
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, "RPC-JSON2: server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	glog.V(0).Infoln("New connection established")
 	
 	var result *rpc.Result
+	status := http.StatusOK
+
+	var stats *callStats
+	if len(h.observers) > 0 {
+		stats = &callStats{start: time.Now(), body: &countingReader{ReadCloser: r.Body}}
+		r.Body = stats.body
+		defer h.observe(stats)
+	}
+
+	body := bufio.NewReader(r.Body)
+	if isBatch(body) {
+		h.serveBatch(w, r, body, stats)
+		return
+	}
+
+	request, err := h.readRequest(ioutil.NopCloser(body))
+	jreq, _ := request.(*srvRequest)
 
-	request, err := readRequest(r.Body)
+	if jreq != nil {
+		jreq.ctx = newCallInfoContext(r)
+		jreq.idempotencyKey = r.Header.Get(IdempotencyKeyHeader)
+		if h.timing {
+			jreq.timing = new(callTiming)
+		}
+	}
+
+	if stats != nil {
+		stats.RequestBytes = stats.body.n
+		if jreq != nil {
+			stats.Method = jreq.Method
+			stats.ID = jreq.RequestID()
+		}
+	}
+
+	if err == nil && !h.exposes(jreq.Method) {
+		err = rpc.NewServerError(rpc.ERR_NO_METHOD, rpc.ErrMethodNotFound.Message, jreq.Method)
+	}
+
+	recorded := false // the notification, by duplicate
+	if err == nil && jreq.notification() {
+		if h.duplicate(jreq, -1) {
+			w.WriteHeader(h.notificationStatus)
+			return
+		}
+		recorded = true
+	}
+
+	if err == nil && h.limit != nil {
+		client := h.limit.identify(r)
+		if h.limit.acquire(client) {
+			defer h.limit.release(client)
+		} else {
+			err = ErrTooManyRequests
+			status = http.StatusTooManyRequests
+		}
+	}
 
 	if err == nil {
-	    h.RequestQueue <- request
-    	result = <-request.Result() // this blocks
+		untrack := h.track(jreq)
+		result = h.dispatch(jreq)
+		untrack()
 	} else {
 		result = rpc.NewResult(nil, err)
 	}
+	if recorded {
+		h.forget(jreq, -1, result)
+	}
+
+	if stats != nil {
+		stats.Error = result.Error
+	}
+
+	// A notification the server refused is answered like a call, for its
+	// sender to deliver it again.
+	if err == nil && jreq.notification() && !unavailable(result.Error) {
+		result.Release()
+		w.WriteHeader(h.notificationStatus)
+		return
+	}
+
+	switch {
+	case result.Error == nil:
+		status = h.successStatus
+	case unavailable(result.Error):
+		// Tells load balancers and readiness probes to wait, see rpc.Server.SetReady.
+		w.Header().Set("Retry-After", retryAfter)
+		status = http.StatusServiceUnavailable
+	}
+
+	// Encoding into a buffer first lets the response carry a
+	// Content-Length rather than being chunked.
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer putBuffer(buf)
+
+	err = writeResponse(buf, request, result)
+	result.Release()
+
+	if jreq != nil && jreq.timing != nil {
+		if t := jreq.timing.get(); t != nil {
+			w.Header().Set(ServerTimingHeader, formatServerTiming(t))
+		}
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		glog.Error(err)
+		return
+	}
+
+	h.send(w, r, buf, status, stats)
+}
+
+// send writes the response body encoded in buf with its headers,
+// indenting it when the handler pretty prints responses and compressing it
+// when the client accepts it.
+func (h *Handler) send(w http.ResponseWriter, r *http.Request, buf *bytes.Buffer, status int, stats *callStats) {
+	if h.pretty {
+		ibuf := bufferPool.Get().(*bytes.Buffer)
+		defer putBuffer(ibuf)
+
+		if err := json.Indent(ibuf, buf.Bytes(), "", "  "); err == nil {
+			buf = ibuf
+		}
+	}
 
 	// Prevents Internet Explorer from MIME-sniffing a response away
 	// from the declared content-type
 	w.Header().Set("x-content-type-options", "nosniff")
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
-	if err := writeResponse(w, request, result); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		glog.Error(err)
+	for _, fn := range h.editHeaders {
+		fn(w.Header())
+	}
+
+	if h.compress {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if buf.Len() > h.compressAbove && acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			zbuf, err := gzipBody(buf.Bytes())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				glog.Error(err)
+				return
+			}
+			defer putBuffer(zbuf)
+
+			buf = zbuf
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+
+	if stats != nil {
+		stats.ResponseBytes = buf.Len()
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		// The response was encoded, the client is likely gone.
+		glog.Warningf("RPC-JSON2: writing the response to %s: %v", r.RemoteAddr, err)
+		if stats != nil {
+			stats.WriteError = err
+		}
 	}
 }
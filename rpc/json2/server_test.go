@@ -5,12 +5,24 @@
 package json2
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/http/httptest"
-	_ "runtime"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
-	_ "sync/atomic"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/entuerto/av-vortex/rpc"
 )
@@ -34,7 +46,7 @@ func startServer() {
 	srv = rpc.NewServer()
 	srv.Register(new(Arith))
 
-	testHttpSrv = httptest.NewServer(&handler{srv})
+	testHttpSrv = httptest.NewServer(NewHandler(srv))
 }
 
 //-----------------------------------------------------------------------------
@@ -98,6 +110,137 @@ func TestJson2RPC_GoodCalls(t *testing.T) {
 	}
 }
 
+func TestJson2RPC_RawParams(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	h := NewHandler(s)
+
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	c := NewClientHTTP(ts.URL, "/")
+
+	params := json.RawMessage(`{ "A": 7,  "B": 8 }`)
+	for _, args := range []interface{}{params, &params} {
+		var reply Reply
+		result := c.Call("Arith.Add", args, &reply)
+		<- result.Done
+		if result.Error != nil {
+			t.Fatal("Add: unexpected error", result.Error)
+		}
+		if reply.C != 15 {
+			t.Errorf("Add: expected 15 got %d", reply.C)
+		}
+		if !bytes.Contains(body, []byte(`"params":{ "A": 7,  "B": 8 },`)) {
+			t.Errorf("expected the params to be sent verbatim got %s", body)
+		}
+	}
+
+	var reply Reply
+	result := c.Call("Arith.Add", json.RawMessage(`{"A": 7,`), &reply)
+	<- result.Done
+	if result.TransportError == nil {
+		t.Errorf("expected invalid raw params to fail got %v", result.Error)
+	}
+}
+
+type Proxy int
+
+// Forward replies with args.A as raw JSON, formatted as a backend would.
+func (p *Proxy) Forward(args Args, reply *json.RawMessage) error {
+	switch args.A {
+	case 0:
+		*reply = json.RawMessage(`{ "C": 3,  "Note": "<a&b>" }`)
+	case 1:
+		*reply = json.RawMessage(`{"C": 3,`)
+	}
+	return nil
+}
+
+func TestJson2RPC_RawResult(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Proxy))
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	tests := []struct {
+		a    int
+		body string
+	}{
+		{0, `{"jsonrpc":"2.0","id":1,"result":{ "C": 3,  "Note": "<a&b>" }}`},
+		{2, `{"jsonrpc":"2.0","id":1,"result":null}`},
+	}
+	for _, tt := range tests {
+		body := fmt.Sprintf(`{"jsonrpc":"2.0","method":"Proxy.Forward","params":{"A":%d},"id":1}`, tt.a)
+		resp, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if got := strings.TrimSpace(string(data)); got != tt.body {
+			t.Errorf("%d: expected the result verbatim\n%s\ngot\n%s", tt.a, tt.body, got)
+		}
+	}
+
+	// Invalid raw JSON is not sent
+	var reply Reply
+	result := NewClientHTTP(ts.URL, "/").Call("Proxy.Forward", &Args{A: 1}, &reply)
+	<- result.Done
+	if result.Error == nil || result.Error.Code != rpc.ERR_INTERNAL {
+		t.Errorf("expected an internal error got %v", result.Error)
+	}
+}
+
+type Basket struct {
+	C    int
+	Unit string
+}
+
+type Grocer int
+
+func (t *Grocer) Add(args Args, reply *Basket) error {
+	reply.C = args.A + args.B
+	reply.Unit = "apples"
+	return nil
+}
+
+func TestJson2RPC_StrictReplies(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterName("Arith", new(Grocer))
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	// The extra field is dropped by default
+	var reply Reply
+	result := NewClientHTTP(ts.URL, "/").Call("Arith.Add", &Args{1, 2}, &reply)
+	<- result.Done
+	if result.Error != nil || reply.C != 3 {
+		t.Fatalf("Add: expected 3 got %d, %v", reply.C, result.Error)
+	}
+
+	// and fails the call in strict mode
+	result = NewClientHTTP(ts.URL, "/", StrictReplies()).Call("Arith.Add", &Args{1, 2}, &Reply{})
+	<- result.Done
+	if result.Error == nil || result.Error.Code != rpc.ERR_INTERNAL || result.TransportError != nil {
+		t.Errorf("Add: expected a reply mismatch error got %v, %v", result.Error, result.TransportError)
+	}
+
+	// Replies matching the result are fine
+	var full Basket
+	result = NewClientHTTP(ts.URL, "/", StrictReplies()).Call("Arith.Add", &Args{1, 2}, &full)
+	<- result.Done
+	if result.Error != nil || full.Unit != "apples" {
+		t.Errorf("Add: expected apples got %+v, %v", full, result.Error)
+	}
+}
+
 func TestJson2RPC_MethodNotFound(t *testing.T) {
 	var args *Args
 	var result *rpc.CallResult
@@ -105,61 +248,3456 @@ func TestJson2RPC_MethodNotFound(t *testing.T) {
 
 	once.Do(startServer)
 
-	c := NewClientHTTP(testHttpSrv.URL, "/")
+	c := NewClientHTTP(testHttpSrv.URL, "/")
+
+	// Nonexistent method
+	args = &Args{7, 0}
+	result = c.Call("Arith.BadOperation", args, &reply)
+	<- result.Done
+
+	// expect an error
+	if result.Error == nil {
+		t.Error("BadOperation: expected error")
+	} else if result.Error.Code != rpc.ERR_NO_METHOD {
+		t.Errorf("BadOperation: expected can't find method error; got %q", result.Error)
+	}
+}
+
+func TestJson2RPC_Fallback(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	s.SetFallback(func(serviceMethod string, req rpc.Request) (interface{}, error) {
+		if serviceMethod != "Unknown.Thing" {
+			return nil, rpc.NewServerError(rpc.ERR_NO_METHOD, "no fallback for " + serviceMethod, nil)
+		}
+		var params json.RawMessage
+		if err := req.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		return map[string]string{"handled": serviceMethod, "params": string(params)}, nil
+	})
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	c := NewClientHTTP(ts.URL, "/")
+
+	var reply map[string]string
+	result := c.Call("Unknown.Thing", []int{1, 2}, &reply)
+	<- result.Done
+	if result.Error != nil {
+		t.Fatal("Thing: unexpected error", result.Error)
+	}
+	if reply["handled"] != "Unknown.Thing" || reply["params"] != "[1,2]" {
+		t.Errorf("Thing: expected the fallback result got %v", reply)
+	}
+
+	// Unknown methods of registered services fall back too
+	result = c.Call("Arith.Pow", &Args{2, 3}, &reply)
+	<- result.Done
+	if result.Error == nil || result.Error.Message != "no fallback for Arith.Pow" {
+		t.Errorf("Pow: expected the fallback error got %v", result.Error)
+	}
+
+	// Registered methods don't
+	var sum Reply
+	result = c.Call("Arith.Add", &Args{2, 3}, &sum)
+	<- result.Done
+	if result.Error != nil || sum.C != 5 {
+		t.Errorf("Add: expected 5 got %d, %v", sum.C, result.Error)
+	}
+}
+
+func TestJson2RPC_UnknownService(t *testing.T) {
+	var args *Args
+	var result *rpc.CallResult
+	var reply Reply
+
+	once.Do(startServer)
+
+	c := NewClientHTTP(testHttpSrv.URL, "/")
+
+	// Unknown service
+	args = &Args{7, 8}
+	result = c.Call("Arith.Unknown", args, &reply)
+	<- result.Done
+
+	if result.Error == nil {
+		t.Error("expected error calling unknown service")
+	} else if result.Error.Code != rpc.ERR_NO_METHOD {
+		t.Error("expected error about method; got", result.Error)
+	}
+}
+
+func TestJson2RPC_MethodErrorMessage(t *testing.T) {
+	var args *Args
+	var result *rpc.CallResult
+	var reply Reply
+
+	once.Do(startServer)
+
+	c := NewClientHTTP(testHttpSrv.URL, "/")
+
+	// Error test
+	args = &Args{7, 0}
+	result = c.Call("Arith.Div", args, &reply)
+	<- result.Done
+
+	// expect an error: zero divide
+	if result.Error == nil {
+		t.Error("Div: expected error")
+	} else if result.Error.Message != "divide by zero" {
+		t.Error("Div: expected divide by zero error; got", result.Error)
+	}
+}
+
+type Validator int
+
+var ErrValidation = errors.New("validation failed")
+
+func (v *Validator) Check(args Args, reply *Reply) error {
+	return ErrValidation
+}
+
+func TestJson2RPC_ErrorData(t *testing.T) {
+	once.Do(startServer)
+
+	tests := []struct {
+		method string
+		data   bool
+	}{
+		{"Arith.Div", false},  // a plain error has no data
+		{"Arith.Nope", true},  // the missing method is the data
+	}
+	for _, tt := range tests {
+		body := `{"jsonrpc":"2.0","method":"` + tt.method + `","params":{"A":1,"B":0},"id":1}`
+		resp, err := http.Post(testHttpSrv.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var jresp struct {
+			Error map[string]json.RawMessage
+		}
+		err = json.NewDecoder(resp.Body).Decode(&jresp)
+		resp.Body.Close()
+		if err != nil || jresp.Error == nil {
+			t.Fatalf("%s: expected an error response got %v", tt.method, err)
+		}
+
+		if _, data := jresp.Error["data"]; data != tt.data {
+			t.Errorf("%s: expected data member %v got %v", tt.method, tt.data, data)
+		}
+	}
+}
+
+func TestJson2RPC_ErrorMapper(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Validator))
+	s.SetServiceErrorMapper("Validator", func(err error) (*rpc.ServerError, bool) {
+		if err != ErrValidation {
+			return nil, false
+		}
+		return rpc.NewServerError(rpc.ERR_BAD_PARAMS, err.Error(), map[string]string{"field": "A"}), true
+	})
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	var reply Reply
+	c := NewClientHTTP(ts.URL, "/")
+	result := c.Call("Validator.Check", &Args{}, &reply)
+	<- result.Done
+
+	if result.Error == nil {
+		t.Fatal("Check: expected error")
+	}
+	if result.Error.Code != rpc.ERR_BAD_PARAMS || result.Error.Message != "validation failed" {
+		t.Errorf("Check: expected (%d) validation failed got %v", rpc.ERR_BAD_PARAMS, result.Error)
+	}
+
+	var data struct {
+		Field string
+	}
+	if err := result.Error.UnmarshalData(&data); err != nil {
+		t.Errorf("Check: %v", err)
+	} else if data.Field != "A" {
+		t.Errorf("Check: expected the field in the error data got %s", result.Error.Data)
+	}
+}
+
+type Slow int
+
+func (s *Slow) Run(args Args, reply *Reply) error {
+	return fmt.Errorf("run: %w", context.DeadlineExceeded)
+}
+
+func TestJson2RPC_RegisterErrorCode(t *testing.T) {
+	rpc.RegisterErrorCode(context.DeadlineExceeded, rpc.ERR_TIMEOUT)
+
+	s := rpc.NewServer()
+	s.Register(new(Slow))
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	var reply Reply
+	c := NewClientHTTP(ts.URL, "/")
+	result := c.Call("Slow.Run", &Args{}, &reply)
+	<- result.Done
+
+	if result.Error == nil {
+		t.Fatal("Run: expected error")
+	}
+	if result.Error.Code != rpc.ERR_TIMEOUT {
+		t.Errorf("Run: expected code %d got %v", rpc.ERR_TIMEOUT, result.Error)
+	}
+}
+
+type Generic int
+
+func (g *Generic) Echo(args map[string]interface{}, reply *string) error {
+	*reply = fmt.Sprint(args["n"])
+	return nil
+}
+
+func TestJson2RPC_UseNumber(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Generic))
+
+	tests := []struct {
+		opts []HandlerOption
+		want string
+	}{
+		// float64 can't hold 2^53 + 1
+		{nil, "9.007199254740992e+15"},
+		{[]HandlerOption{UseNumber()}, "9007199254740993"},
+	}
+	for _, tt := range tests {
+		ts := httptest.NewServer(NewHandler(s, tt.opts...))
+
+		var reply string
+		c := NewClientHTTP(ts.URL, "/")
+		result := c.Call("Generic.Echo", map[string]int64{"n": 9007199254740993}, &reply)
+		<- result.Done
+		ts.Close()
+
+		if result.Error != nil {
+			t.Errorf("Echo: expected no error but got string %q", result.Error.Error())
+		} else if reply != tt.want {
+			t.Errorf("Echo: expected %s got %s", tt.want, reply)
+		}
+	}
+}
+
+type Span struct {
+	To   int `json:"to"`
+	From int `json:"from,omitempty"`
+	Skip int `json:"-"`
+	note string
+}
+
+type Ruler int
+
+func (r *Ruler) Length(args Span, reply *int) error {
+	*reply = args.To - args.From + args.Skip
+	return nil
+}
+
+type Math int
+
+func (m *Math) Sum(a, b int, reply *int) error {
+	*reply = a + b
+	return nil
+}
+
+func (m *Math) Join(ctx context.Context, sep string, parts []string, reply *string) error {
+	*reply = strings.Join(parts, sep)
+	return nil
+}
+
+func TestJson2RPC_SeveralArgs(t *testing.T) {
+	s := rpc.NewServer()
+	if err := s.Register(new(Math)); err != nil {
+		t.Fatal("Register Math:", err)
+	}
+	c := NewInProcClient(s)
+
+	var sum int
+	result := c.Call("Math.Sum", []int{2, 3}, &sum)
+	<- result.Done
+	if result.Error != nil || sum != 5 {
+		t.Errorf("Sum: expected 5 got %d, %v", sum, result.Error)
+	}
+
+	var joined string
+	result = c.Call("Math.Join", []interface{}{"-", []string{"a", "b"}}, &joined)
+	<- result.Done
+	if result.Error != nil || joined != "a-b" {
+		t.Errorf("Join: expected a-b got %q, %v", joined, result.Error)
+	}
+
+	result = c.Call("Math.Sum", []int{1, 2, 3}, &sum)
+	<- result.Done
+	if result.Error == nil || result.Error.Code != rpc.ERR_BAD_PARAMS {
+		t.Errorf("Sum: expected invalid params for 3 params got %v", result.Error)
+	}
+}
+
+type Baggage int
+
+func (t *Baggage) Lookup(ctx context.Context, key string, reply *string) error {
+	*reply = rpc.MetadataFromContext(ctx)[key]
+	return nil
+}
+
+func TestJson2RPC_Metadata(t *testing.T) {
+	s := rpc.NewServer()
+	if err := s.Register(new(Baggage)); err != nil {
+		t.Fatal("Register Baggage:", err)
+	}
+
+	ctx := rpc.WithMetadata(context.Background(), rpc.Metadata{"Trace-Id": "abc123"})
+
+	for _, c := range []rpc.Client{NewClientHTTP(testServerURL(t, NewHandler(s)), "/"), NewInProcClient(s)} {
+		var value string
+		result := c.CallContext(ctx, "Baggage.Lookup", "trace-id", &value)
+		<- result.Done
+		if result.Error != nil || value != "abc123" {
+			t.Errorf("Lookup: expected abc123 got %q, %v", value, result.Error)
+		}
+
+		result = c.Call("Baggage.Lookup", "trace-id", &value)
+		<- result.Done
+		if result.Error != nil || value != "" {
+			t.Errorf("Lookup: expected no metadata got %q, %v", value, result.Error)
+		}
+	}
+
+	// In the request object, the metadata belong to the call alone
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader(
+		`[{"jsonrpc":"2.0","method":"Baggage.Lookup","params":"trace-id","metadata":{"trace-id":"own"},"id":1},` +
+		`{"jsonrpc":"2.0","method":"Baggage.Lookup","params":"trace-id","id":2}]`))
+	r.Header.Set(MetadataHeaderPrefix + "Trace-Id", "shared")
+	NewHandler(s).ServeHTTP(w, r)
+
+	var resps []struct {
+		Result string
+		Id     int
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resps); err != nil {
+		t.Fatalf("batch: %v, %s", err, w.Body)
+	}
+	if len(resps) != 2 || resps[0].Result != "own" || resps[1].Result != "shared" {
+		t.Errorf("batch: expected own and shared got %s", w.Body)
+	}
+}
+
+// Stall reports the metadata of its calls, then blocks until they are
+// cancelled.
+type Stall struct {
+	waiting   chan string
+	cancelled chan struct{}
+}
+
+func (t *Stall) Wait(ctx context.Context, key string, reply *string) error {
+	t.waiting <- rpc.MetadataFromContext(ctx)[key]
+	<-ctx.Done()
+	close(t.cancelled)
+	return ctx.Err()
+}
+
+// Relay forwards its calls to Baggage.Wait on another server.
+type Relay struct {
+	backend rpc.Client
+}
+
+func (t *Relay) Wait(ctx context.Context, key string, reply *string) error {
+	result := t.backend.CallContext(rpc.ForwardContext(ctx), "Baggage.Wait", key, reply)
+	<- result.Done
+	if result.TransportError != nil {
+		return result.TransportError
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func TestJson2RPC_ForwardContext(t *testing.T) {
+	waiting := make(chan string, 1)
+	cancelled := make(chan struct{})
+
+	backend := rpc.NewServer()
+	backend.RegisterName("Baggage", &Stall{waiting, cancelled})
+	s := rpc.NewServer()
+	s.Register(&Relay{NewClientHTTP(testServerURL(t, NewHandler(backend)), "/")})
+
+	ctx, cancel := context.WithCancel(rpc.WithMetadata(context.Background(), rpc.Metadata{"trace-id": "abc123"}))
+	defer cancel()
+
+	var value string
+	result := NewClientHTTP(testServerURL(t, NewHandler(s)), "/").CallContext(ctx, "Relay.Wait", "trace-id", &value)
+
+	// The metadata reach the backend, and cancelling the call cancels the
+	// one it made
+	select {
+	case got := <-waiting:
+		if got != "abc123" {
+			t.Errorf("Wait: expected abc123 forwarded got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait: the backend was never called")
+	}
+	cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait: the backend call was not cancelled")
+	}
+	<- result.Done
+}
+
+func TestJson2RPC_ResolveMethods(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+
+	slash := func(name string) (string, string, error) {
+		i := strings.Index(name, "/")
+		if i <= 0 || i == len(name) - 1 {
+			return "", "", errors.New("method must be of the form Service/Method")
+		}
+		return name[:i], name[i+1:], nil
+	}
+	c := NewClientHTTP(testServerURL(t, NewHandler(s, ResolveMethods(slash))), "/")
+
+	var reply Reply
+	result := c.Call("Arith/Add", &Args{7, 8}, &reply)
+	<- result.Done
+	if result.Error != nil || reply.C != 15 {
+		t.Errorf("Arith/Add: expected 15 got %d, %v", reply.C, result.Error)
+	}
+
+	result = c.Call("Arith.Add", &Args{7, 8}, &reply)
+	<- result.Done
+	if result.Error == nil || result.Error.Code != rpc.ERR_INVALID_REQ {
+		t.Errorf("Arith.Add: expected invalid request got %v", result.Error)
+	}
+
+	// Built-ins keep their names
+	var exists bool
+	result = c.Call("system.methodExists", MethodArgs{"Arith/Mul"}, &exists)
+	<- result.Done
+	if result.Error != nil || !exists {
+		t.Errorf("methodExists: expected Arith/Mul to exist got %v, %v", exists, result.Error)
+	}
+}
+
+func TestJson2RPC_ParamsMapping(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Ruler))
+	s.Register(new(Arith))
+	h := NewHandler(s)
+
+	tests := []struct {
+		method string
+		params string
+		result int
+		code   int // error code, 0 for none
+	}{
+		// Named params match json tags
+		{"Ruler.Length", `{"to": 10, "from": 3}`, 7, 0},
+		{"Ruler.Length", `{"to": 10}`, 10, 0},
+		{"Ruler.Length", `{"to": 10, "Skip": 5}`, 10, 0},
+
+		// Positional params fill fields in declaration order
+		{"Ruler.Length", `[10, 3]`, 7, 0},
+		{"Ruler.Length", ` [10]`, 0, rpc.ERR_BAD_PARAMS},
+		{"Ruler.Length", `[10, 3, 5]`, 0, rpc.ERR_BAD_PARAMS},
+		{"Ruler.Length", `["10"]`, 0, rpc.ERR_BAD_PARAMS},
+		{"Arith.Mul", `[6, 7]`, 42, 0},
+	}
+	for _, tt := range tests {
+		body := `{"jsonrpc":"2.0","method":"` + tt.method + `","params":` + tt.params + `,"id":1}`
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+
+		var jresp struct {
+			Result json.RawMessage
+			Error  *jsonError
+		}
+		if err := json.NewDecoder(w.Body).Decode(&jresp); err != nil {
+			t.Fatalf("%s: %v", tt.params, err)
+		}
+
+		if tt.code != 0 {
+			if jresp.Error == nil || jresp.Error.Code != tt.code {
+				t.Errorf("%s: expected code %d got %v", tt.params, tt.code, jresp.Error)
+			}
+			continue
+		}
+		if jresp.Error != nil {
+			t.Errorf("%s: unexpected error %v", tt.params, jresp.Error)
+			continue
+		}
+
+		var result int
+		if tt.method == "Arith.Mul" {
+			var reply Reply
+			json.Unmarshal(jresp.Result, &reply)
+			result = reply.C
+		} else {
+			json.Unmarshal(jresp.Result, &result)
+		}
+		if result != tt.result {
+			t.Errorf("%s: expected %d got %d", tt.params, tt.result, result)
+		}
+	}
+}
+
+type Account struct {
+	Name  string
+	Email string
+}
+
+type Signup int
+
+func (s *Signup) Create(args Account, reply *string) error {
+	verr := new(rpc.ValidationError)
+	if args.Name == "" {
+		verr.Add("name", "is required")
+	}
+	if !strings.Contains(args.Email, "@") {
+		verr.Add("email", "is not an address")
+	}
+	if err := verr.Err(); err != nil {
+		return err
+	}
+	*reply = args.Name
+	return nil
+}
+
+func TestJson2RPC_ValidationError(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Signup))
+	c := NewClientHTTP(testServerURL(t, NewHandler(s)), "/")
+
+	var reply string
+	result := c.Call("Signup.Create", &Account{Email: "nobody"}, &reply)
+	<- result.Done
+	if result.Error == nil || result.Error.Code != rpc.ERR_BAD_PARAMS {
+		t.Fatalf("Create: expected invalid params got %v", result.Error)
+	}
+
+	var fields map[string]string
+	if err := result.Error.UnmarshalData(&fields); err != nil {
+		t.Fatal("UnmarshalData:", err)
+	}
+	if len(fields) != 2 || fields["name"] != "is required" || fields["email"] != "is not an address" {
+		t.Errorf("Create: expected the fields name and email got %v", fields)
+	}
+
+	result = c.Call("Signup.Create", &Account{Name: "jo", Email: "jo@example.com"}, &reply)
+	<- result.Done
+	if result.Error != nil || reply != "jo" {
+		t.Errorf("Create: expected jo got %q, %v", reply, result.Error)
+	}
+}
+
+func TestJson2RPC_PositionalCount(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	h := NewHandler(s)
+
+	for params, actual := range map[string]int{`[7]`: 1, `[7, 8, 9]`: 3} {
+		body := `{"jsonrpc":"2.0","method":"Arith.Add","params":` + params + `,"id":1}`
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+
+		var jresp struct {
+			Error *struct {
+				Code int
+				Data ParamsCount
+			}
+		}
+		if err := json.NewDecoder(w.Body).Decode(&jresp); err != nil {
+			t.Fatalf("%s: %v", params, err)
+		}
+		if jresp.Error == nil || jresp.Error.Code != rpc.ERR_BAD_PARAMS {
+			t.Errorf("%s: expected invalid params got %+v", params, jresp.Error)
+			continue
+		}
+		if jresp.Error.Data != (ParamsCount{Expected: 2, Actual: actual}) {
+			t.Errorf("%s: expected 2 fields and %d params got %+v", params, actual, jresp.Error.Data)
+		}
+	}
+}
+
+func TestJson2RPC_SystemMethodExists(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	ts := httptest.NewServer(NewHandler(s, DenyMethods("Arith.Div")))
+	defer ts.Close()
+
+	c := NewClientHTTP(ts.URL, "/")
+
+	tests := []struct {
+		params   interface{}
+		expected bool
+	}{
+		{MethodArgs{"Arith.Add"}, true},
+		{[]string{"Arith.Mul"}, true},
+		{MethodArgs{"Arith.Pow"}, false},
+		{MethodArgs{"Arith.Div"}, false}, // hidden
+		{MethodArgs{"Unknown.Add"}, false},
+		{MethodArgs{"Arith"}, false},
+		{MethodArgs{"system.methodExists"}, true},
+	}
+	for _, tt := range tests {
+		var exists bool
+		result := c.Call("system.methodExists", tt.params, &exists)
+		<- result.Done
+		if result.Error != nil {
+			t.Errorf("%v: unexpected error %v", tt.params, result.Error)
+		} else if exists != tt.expected {
+			t.Errorf("%v: expected %v got %v", tt.params, tt.expected, exists)
+		}
+	}
+
+	var exists bool
+	result := c.Call("system.methodExists", []int{42}, &exists)
+	<- result.Done
+	if result.Error == nil || result.Error.Code != rpc.ERR_BAD_PARAMS {
+		t.Errorf("expected an invalid params error got %v", result.Error)
+	}
+}
+
+func TestJson2RPC_SystemPing(t *testing.T) {
+	s := rpc.NewServer()
+
+	for _, c := range []rpc.Client{NewClientHTTP(testServerURL(t, NewHandler(s)), "/"), NewInProcClient(s)} {
+		var pong string
+		result := c.Call("system.ping", nil, &pong)
+		<- result.Done
+		if result.Error != nil || pong != "pong" {
+			t.Errorf("ping: expected pong got %q, %v", pong, result.Error)
+		}
+	}
+
+	// Handlers can do without it
+	c := NewClientHTTP(testServerURL(t, NewHandler(s, DenyMethods("system.ping"))), "/")
+	var pong string
+	result := c.Call("system.ping", nil, &pong)
+	<- result.Done
+	if result.Error == nil || result.Error.Code != rpc.ERR_NO_METHOD {
+		t.Errorf("ping: expected no such method got %q, %v", pong, result.Error)
+	}
+}
+
+// Waiter blocks until the context of its calls is done.
+type Waiter struct {
+	started chan struct{}
+	stopped chan error
+}
+
+func (w *Waiter) Wait(ctx context.Context, args Args, reply *Reply) error {
+	w.started <- struct{}{}
+	select {
+	case <-ctx.Done():
+		w.stopped <- ctx.Err()
+		return ctx.Err()
+	case <-time.After(5 * time.Second):
+		w.stopped <- nil
+		return nil
+	}
+}
+
+func TestJson2RPC_SystemCancel(t *testing.T) {
+	waiter := &Waiter{make(chan struct{}, 1), make(chan error, 1)}
+	s := rpc.NewServer()
+	s.Register(waiter)
+	url := testServerURL(t, NewHandler(s))
+
+	post := func(token, body string) (*http.Response, error) {
+		req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set(CallerTokenHeader, token)
+		}
+		return http.DefaultClient.Do(req)
+	}
+
+	go func() {
+		resp, err := post("t-1", `{"jsonrpc":"2.0","method":"Waiter.Wait","params":{},"id":"w-1"}`)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-waiter.started
+
+	// Only the client that made the call, by its token, can cancel it
+	for _, tt := range []struct {
+		token, id string
+		found     bool
+	}{
+		{"t-1", "w-2", false},
+		{"", "w-1", false},
+		{"t-2", "w-1", false},
+		{"t-1", "w-1", true},
+	} {
+		resp, err := post(tt.token, `{"jsonrpc":"2.0","method":"system.cancel","params":{"id":` + strconv.Quote(tt.id) + `},"id":1}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out struct {
+			Result bool
+			Error  *jsonError
+		}
+		err = json.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil || out.Error != nil || out.Result != tt.found {
+			t.Errorf("%q, %s: expected %v got %v, %v, %v", tt.token, tt.id, tt.found, out.Result, out.Error, err)
+		}
+	}
+
+	select {
+	case err := <-waiter.stopped:
+		if err != context.Canceled {
+			t.Errorf("expected the call to be cancelled got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the call was not cancelled")
+	}
+}
+
+func TestJson2RPC_CancelRemotely(t *testing.T) {
+	waiter := &Waiter{make(chan struct{}, 1), make(chan error, 1)}
+	s := rpc.NewServer()
+	s.Register(waiter)
+	h := NewHandler(s)
+
+	cancels := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if bytes.Contains(body, []byte("system.cancel")) {
+			cancels <- string(body)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := NewClientHTTP(ts.URL, "/", CancelRemotely()).CallContext(ctx, "Waiter.Wait", &Args{}, &Reply{})
+	<-waiter.started
+	cancel()
+	<- result.Done
+
+	select {
+	case body := <-cancels:
+		if !strings.Contains(body, `"params":{"id":1}`) {
+			t.Errorf("expected the cancel of call 1 got %s", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("system.cancel was not sent")
+	}
+}
+
+// Twins.Wait takes args.A milliseconds unless its context is done first.
+type Twins struct {
+	started chan struct{}
+	stopped chan error
+}
+
+func (w *Twins) Wait(ctx context.Context, args Args, reply *Reply) error {
+	w.started <- struct{}{}
+	select {
+	case <-ctx.Done():
+		w.stopped <- ctx.Err()
+		return ctx.Err()
+	case <-time.After(time.Duration(args.A) * time.Millisecond):
+		w.stopped <- nil
+		return nil
+	}
+}
+
+// Clients behind the same address pick the same ids, a client cancelling
+// its call doesn't cancel that of the other.
+func TestJson2RPC_CancelRemotelyCollidingIds(t *testing.T) {
+	twins := &Twins{make(chan struct{}, 2), make(chan error, 2)}
+	s := rpc.NewServer()
+	s.Register(twins)
+	url := testServerURL(t, NewHandler(s))
+
+	a := NewClientHTTP(url, "/", CancelRemotely())
+	b := NewClientHTTP(url, "/", CancelRemotely())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resultB := b.CallContext(ctx, "Twins.Wait", &Args{A: 5000}, &Reply{})
+	<-twins.started
+	resultA := a.Call("Twins.Wait", &Args{A: 200}, &Reply{})
+	<-twins.started
+	cancel()
+	<- resultB.Done
+
+	select {
+	case err := <-twins.stopped:
+		if err != context.Canceled {
+			t.Errorf("expected the call of b to be cancelled first got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the call of b was not cancelled")
+	}
+
+	<- resultA.Done
+	if resultA.Error != nil || resultA.TransportError != nil {
+		t.Errorf("a: expected its call answered got %v, %v", resultA.Error, resultA.TransportError)
+	}
+	if err := <-twins.stopped; err != nil {
+		t.Errorf("a: expected its call to run to completion got %v", err)
+	}
+}
+
+func TestJson2RPC_SystemCapabilities(t *testing.T) {
+	s := rpc.NewServer()
+
+	handlers := map[string]*Handler{"plain": NewHandler(s), "compressed": NewHandler(s, CompressAbove(1024))}
+	for name, h := range handlers {
+		c := NewClientHTTP(testServerURL(t, h), "/").(CapabilitiesClient)
+
+		caps, err := c.Capabilities()
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+		if !caps.Notifications || !caps.Batch || caps.Streaming || caps.MaxBodySize != 0 {
+			t.Errorf("%s: unexpected capabilities %+v", name, caps)
+		}
+		if hasGzip := len(caps.Compression) == 1 && caps.Compression[0] == "gzip"; hasGzip != h.compress {
+			t.Errorf("%s: expected gzip %v got %v", name, h.compress, caps.Compression)
+		}
+	}
+
+	// Capabilities are asked once
+	calls := int32(0)
+	h := NewHandler(s)
+	c := NewClientHTTP(testServerURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		h.ServeHTTP(w, r)
+	})), "/").(CapabilitiesClient)
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Capabilities(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected one call to system.capabilities got %d", n)
+	}
+
+	if _, err := NewInProcClient(s).(CapabilitiesClient).Capabilities(); err != nil {
+		t.Errorf("in process: unexpected error %v", err)
+	}
+}
+
+// Returns the URL of a test server for h, closed at the end of the test.
+func testServerURL(t *testing.T, h http.Handler) string {
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+func TestJson2RPC_NamespacedService(t *testing.T) {
+	var args *Args
+	var result *rpc.CallResult
+	var reply Reply
+
+	once.Do(startServer)
+
+	if err := srv.RegisterName("v1.math", new(Arith)); err != nil {
+		t.Fatal("RegisterName v1.math:", err)
+	}
+
+	c := NewClientHTTP(testHttpSrv.URL, "/")
+
+	args = &Args{7, 8}
+	result = c.Call("v1.math.Add", args, &reply)
+	<- result.Done
+
+	if result.Error != nil {
+		t.Errorf("v1.math.Add: expected no error but got string %q", result.Error.Error())
+	}
+	if reply, ok := result.Reply.(*Reply); !ok || reply.C != args.A + args.B {
+		t.Errorf("v1.math.Add: expected %d got %d", args.A + args.B, reply.C)
+	}
+}
+
+type ArithV2 int
+
+func (t *ArithV2) Add(args Args, reply *Reply) error {
+	reply.C = args.A + 2 * args.B
+	return nil
+}
+
+func TestJson2RPC_Versions(t *testing.T) {
+	once.Do(startServer)
+
+	if err := srv.RegisterVersion("Calc", "1", new(Arith)); err != nil {
+		t.Fatal("RegisterVersion Calc@1:", err)
+	}
+	if err := srv.RegisterVersion("Calc", "2", new(ArithV2)); err != nil {
+		t.Fatal("RegisterVersion Calc@2:", err)
+	}
+
+	c := NewClientHTTP(testHttpSrv.URL, "/")
+
+	tests := []struct {
+		method string
+		want   int
+	}{
+		{"Calc@1.Add", 11},
+		{"Calc@2.Add", 21},
+		{"Calc.Add", 11},
+	}
+
+	for _, test := range tests {
+		var reply Reply
+
+		result := c.Call(test.method, &Args{1, 10}, &reply)
+		<- result.Done
+
+		if result.Error != nil {
+			t.Errorf("%s: expected no error but got string %q", test.method, result.Error.Error())
+		} else if reply.C != test.want {
+			t.Errorf("%s: expected %d got %d", test.method, test.want, reply.C)
+		}
+	}
+}
+
+type Tracer int
+
+func (t *Tracer) ID(ctx context.Context, args Args, reply *string) error {
+	*reply = rpc.RequestIDFromContext(ctx)
+	return nil
+}
+
+func TestJson2RPC_RequestID(t *testing.T) {
+	once.Do(startServer)
+
+	if err := srv.Register(new(Tracer)); err != nil {
+		t.Fatal("Register Tracer:", err)
+	}
+
+	tests := []struct {
+		id, want string
+	}{
+		{`"call-42"`, "call-42"},
+		{`42`, "42"},
+	}
+
+	for _, test := range tests {
+		body := `{"jsonrpc":"2.0","method":"Tracer.ID","params":{},"id":` + test.id + `}`
+
+		resp, err := http.Post(testHttpSrv.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out struct {
+			Result string
+		}
+		err = json.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+
+		if err != nil {
+			t.Errorf("id %s: %v", test.id, err)
+		} else if out.Result != test.want {
+			t.Errorf("id %s: expected %q got %q", test.id, test.want, out.Result)
+		}
+	}
+}
+
+func TestJson2RPC_ResponseIds(t *testing.T) {
+	for _, id := range []string{`"call-42"`, `42`, `-1.5e3`, `null`} {
+		body := `{"jsonrpc":"2.0","method":"Arith.Add","params":{},"id":` + id + `}`
+
+		req, err := new(Handler).readRequest(ioutil.NopCloser(strings.NewReader(body)))
+		if err != nil {
+			t.Fatalf("id %s: %v", id, err)
+		}
+		if req.(*srvRequest).notification() {
+			t.Errorf("id %s: expected a call, not a notification", id)
+		}
+
+		var buf bytes.Buffer
+		if err := writeResponse(&buf, req, rpc.NewResult("ok", nil)); err != nil {
+			t.Fatalf("id %s: %v", id, err)
+		}
+
+		want := `{"jsonrpc":"2.0","id":` + id + `,"result":"ok"}` + "\n"
+		if buf.String() != want {
+			t.Errorf("id %s: expected %s got %s", id, want, buf.String())
+		}
+	}
+}
+
+func TestJson2RPC_Notification(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Whoami))
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"jsonrpc":"2.0","method":"Whoami.Name","params":{},"id":null}`, http.StatusOK},
+		{`{"jsonrpc":"2.0","method":"Whoami.Name","params":{}}`, http.StatusNoContent},
+	}
+	for _, test := range tests {
+		resp, err := http.Post(ts.URL, "application/json", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: expected status %d got %d", test.body, test.status, resp.StatusCode)
+		}
+		if test.status == http.StatusNoContent && len(body) != 0 {
+			t.Errorf("%s: expected no body got %s", test.body, body)
+		}
+	}
+}
+
+func TestJson2RPC_UnreadableRequest(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{``, rpc.ERR_INVALID_REQ},
+		{" \n\t ", rpc.ERR_INVALID_REQ},
+		{`{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1`, rpc.ERR_PARSE},
+		{`{"jsonrpc":"2.0",}`, rpc.ERR_PARSE},
+		{`{"jsonrpc":"2.0","method":5,"params":{"A":1,"B":2}}`, rpc.ERR_INVALID_REQ},
+		{`"Arith.Add"`, rpc.ERR_INVALID_REQ},
+	}
+	for _, test := range tests {
+		resp, err := http.Post(ts.URL, "application/json", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var jresp struct {
+			Id    *json.RawMessage `json:"id"`
+			Error *jsonError       `json:"error"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&jresp)
+		resp.Body.Close()
+
+		if err != nil {
+			t.Errorf("%q: expected a response got %v", test.body, err)
+			continue
+		}
+		if jresp.Error == nil || jresp.Error.Code != test.code {
+			t.Errorf("%q: expected code %d got %+v", test.body, test.code, jresp.Error)
+		} else if !strings.HasPrefix(jresp.Error.Message, "RPC-JSON2: ") {
+			t.Errorf("%q: expected a RPC-JSON2 error got %q", test.body, jresp.Error.Message)
+		}
+		if jresp.Id != nil {
+			t.Errorf("%q: expected a null id got %s", test.body, *jresp.Id)
+		}
+	}
+}
+
+func TestJson2RPC_AcceptVersions(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	ts := httptest.NewServer(NewHandler(s, AcceptVersions("2.0", "2.1")))
+	defer ts.Close()
+	def := httptest.NewServer(NewHandler(s))
+	defer def.Close()
+
+	call := func(url, version string) (*srvResponse, error) {
+		body := `{"jsonrpc":"` + version + `","method":"Arith.Add","params":{"A":1,"B":2},"id":1}`
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		var jresp srvResponse
+		return &jresp, json.NewDecoder(resp.Body).Decode(&jresp)
+	}
+
+	for _, version := range []string{"2.0", "2.1"} {
+		jresp, err := call(ts.URL, version)
+		if err != nil || jresp.Error != nil || jresp.Version != version {
+			t.Errorf("%s: expected a %s result got %+v, %v", version, version, jresp, err)
+		}
+	}
+
+	jresp, err := call(ts.URL, "3.0")
+	if err != nil || jresp.Error == nil || jresp.Error.Code != rpc.ERR_INVALID_REQ || jresp.Error.Data != "3.0" {
+		t.Errorf("3.0: expected an invalid request error got %+v, %v", jresp, err)
+	}
+
+	// Handlers accept 2.0 only by default
+	if jresp, err := call(def.URL, "2.1"); err != nil || jresp.Error == nil || jresp.Error.Code != rpc.ERR_INVALID_REQ {
+		t.Errorf("2.1: expected an invalid request error got %+v, %v", jresp, err)
+	}
+}
+
+func TestJson2RPC_AllowOrigins(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	h := NewHandler(s, AllowOrigins("https://app.example.com"))
+
+	serve := func(method, origin string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", strings.NewReader(`{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2},"id":1}`))
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// Preflight
+	w := serve("OPTIONS", "https://app.example.com", map[string]string{
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "Content-Type, Rpc-Metadata-Trace-Id",
+	})
+	if w.Code != http.StatusNoContent ||
+		w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		w.Header().Get("Access-Control-Allow-Methods") != "POST" ||
+		w.Header().Get("Access-Control-Allow-Headers") != "Content-Type, Rpc-Metadata-Trace-Id" {
+		t.Errorf("preflight: unexpected response %d %v", w.Code, w.Header())
+	}
+
+	// The call itself
+	w = serve("POST", "https://app.example.com", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		!strings.Contains(w.Body.String(), `"result":{"C":3}`) {
+		t.Errorf("POST: unexpected response %d %v %s", w.Code, w.Header(), w.Body)
+	}
+
+	// Other origins are refused, preflight or not
+	for _, method := range []string{"OPTIONS", "POST"} {
+		w = serve(method, "https://evil.example.com", map[string]string{"Access-Control-Request-Method": "POST"})
+		if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%s from another origin: expected 403 got %d %v", method, w.Code, w.Header())
+		}
+	}
+
+	// Clients other than browsers are served as before, POST only
+	if w = serve("POST", "", nil); w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("POST without origin: unexpected response %d %v", w.Code, w.Header())
+	}
+	if w = serve("OPTIONS", "", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("OPTIONS without origin: expected 405 got %d", w.Code)
+	}
+}
+
+func TestJson2RPC_RequireParams(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","method":"Arith.Add","params":null,"id":1}`,
+		`{"jsonrpc":"2.0","method":"Arith.Add","id":1}`,
+	} {
+		// By default the method gets zero args
+		w := httptest.NewRecorder()
+		NewHandler(s).ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		if !strings.Contains(w.Body.String(), `"result":{"C":0}`) {
+			t.Errorf("%s: expected a zero result got %s", body, w.Body)
+		}
+
+		w = httptest.NewRecorder()
+		NewHandler(s, RequireParams()).ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		var jresp srvResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &jresp); err != nil || jresp.Error == nil || jresp.Error.Code != rpc.ERR_BAD_PARAMS {
+			t.Errorf("%s: expected ERR_BAD_PARAMS got %s", body, w.Body)
+		}
+	}
+}
+
+func TestJson2RPC_PrettyPrint(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+
+	call := `{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2},"id":1}`
+	tests := []struct {
+		opts []HandlerOption
+		body string
+	}{
+		{nil, `{"jsonrpc":"2.0","id":1,"result":{"C":3}}` + "\n"},
+		{[]HandlerOption{PrettyPrint()}, "{\n  \"jsonrpc\": \"2.0\",\n  \"id\": 1,\n  \"result\": {\n    \"C\": 3\n  }\n}\n"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		NewHandler(s, test.opts...).ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(call)))
+		if w.Body.String() != test.body {
+			t.Errorf("expected\n%s\ngot\n%s", test.body, w.Body)
+		}
+		if w.Header().Get("Content-Length") != strconv.Itoa(len(test.body)) {
+			t.Errorf("expected a Content-Length of %d got %s", len(test.body), w.Header().Get("Content-Length"))
+		}
+	}
+}
+
+func TestJson2RPC_BeforeDispatch(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+
+	blocked := rpc.NewServerError(rpc.ERR_SERVER, "blocked by the gateway", nil)
+	var seen []string
+	var mutex sync.Mutex
+
+	h := NewHandler(s, BeforeDispatch(func(req rpc.Request) (rpc.Request, *rpc.Result) {
+		var params json.RawMessage
+		req.DecodeParams(&params)
+		mutex.Lock()
+		seen = append(seen, string(params))
+		mutex.Unlock()
+
+		switch req.ServiceName() + "." + req.MethodName() {
+		case "Arith.Sum":
+			return RenameMethod(req, "Arith", "Add"), nil
+		case "Arith.Div":
+			return nil, rpc.NewResult(nil, blocked)
+		}
+		return req, nil
+	}))
+	c := NewClientHTTP(testServerURL(t, h), "/")
+
+	var reply Reply
+	result := c.Call("Arith.Sum", &Args{1, 2}, &reply)
+	<- result.Done
+	if result.Error != nil || reply.C != 3 {
+		t.Errorf("Sum: expected 3 got %d, %v", reply.C, result.Error)
+	}
+
+	result = c.Call("Arith.Div", &Args{4, 2}, &reply)
+	<- result.Done
+	if result.Error == nil || result.Error.Message != blocked.Message {
+		t.Errorf("Div: expected to be blocked got %v", result.Error)
+	}
+
+	// Calls of batches go through the hook as well
+	var sum, quotient Reply
+	results := c.(BatchClient).CallBatch([]BatchCall{
+		{"Arith.Sum", &Args{3, 4}, &sum},
+		{"Arith.Div", &Args{4, 2}, &quotient},
+	})
+	if results[0].Error != nil || sum.C != 7 {
+		t.Errorf("batch Sum: expected 7 got %d, %v", sum.C, results[0].Error)
+	}
+	if results[1].Error == nil || results[1].Error.Message != blocked.Message {
+		t.Errorf("batch Div: expected to be blocked got %v", results[1].Error)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(seen) != 4 || seen[0] != `{"A":1,"B":2}` {
+		t.Errorf("expected the hook to see the raw params of 4 calls got %q", seen)
+	}
+}
+
+func TestJson2RPC_SuccessStatus(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+
+	call := `{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2},"id":1}`
+	failed := `{"jsonrpc":"2.0","method":"Arith.Div","params":{"A":1,"B":0},"id":1}`
+	notification := `{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2}}`
+
+	tests := []struct {
+		name   string
+		opts   []HandlerOption
+		status map[string]int
+	}{
+		{"defaults", nil, map[string]int{
+			call: http.StatusOK, failed: http.StatusOK, notification: http.StatusNoContent,
+			"[" + call + "]": http.StatusOK, "[" + notification + "]": http.StatusNoContent,
+		}},
+		{"configured", []HandlerOption{SuccessStatus(http.StatusAccepted), NotificationStatus(http.StatusOK)}, map[string]int{
+			call: http.StatusAccepted, failed: http.StatusOK, notification: http.StatusOK,
+			"[" + call + "]": http.StatusAccepted, "[" + notification + "]": http.StatusOK,
+		}},
+	}
+	for _, tt := range tests {
+		ts := httptest.NewServer(NewHandler(s, tt.opts...))
+
+		for body, status := range tt.status {
+			resp, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != status {
+				t.Errorf("%s, %s: expected status %d got %d", tt.name, body, status, resp.StatusCode)
+			}
+		}
+		ts.Close()
+	}
+}
+
+func TestJson2RPC_Ready(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	url := testServerURL(t, NewHandler(s))
+
+	body := `{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2},"id":1}`
+	for _, tt := range []struct {
+		ready  bool
+		status int
+	}{
+		{false, http.StatusServiceUnavailable},
+		{true, http.StatusOK},
+	} {
+		s.SetReady(tt.ready)
+
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var jresp struct {
+			Result *Reply
+			Error  *jsonError
+		}
+		err = json.NewDecoder(resp.Body).Decode(&jresp)
+		resp.Body.Close()
+
+		if err != nil || resp.StatusCode != tt.status {
+			t.Fatalf("ready %v: expected status %d got %d, %v", tt.ready, tt.status, resp.StatusCode, err)
+		}
+		if tt.ready && (jresp.Result == nil || jresp.Result.C != 3) {
+			t.Errorf("ready: expected 3 got %+v", jresp)
+		}
+		if !tt.ready && (jresp.Error == nil || jresp.Error.Code != rpc.ERR_SERVER) {
+			t.Errorf("not ready: expected a server error got %+v", jresp)
+		}
+		if !tt.ready && resp.Header.Get("Retry-After") == "" {
+			t.Errorf("not ready: expected a Retry-After header")
+		}
+	}
+
+	// Notifications refused are not taken for delivered
+	counter := new(Counter)
+	s.Register(counter)
+	notification := `{"jsonrpc":"2.0","method":"Counter.Hit","params":{}}`
+	for _, tt := range []struct {
+		ready  bool
+		status int
+		hits   int32
+	}{
+		{false, http.StatusServiceUnavailable, 0},
+		{true, http.StatusNoContent, 1},
+	} {
+		s.SetReady(tt.ready)
+
+		resp, err := http.Post(url, "application/json", strings.NewReader(notification))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("notification, ready %v: expected status %d got %d", tt.ready, tt.status, resp.StatusCode)
+		}
+		if !tt.ready && resp.Header.Get("Retry-After") == "" {
+			t.Errorf("notification, not ready: expected a Retry-After header")
+		}
+		if hits := atomic.LoadInt32(&counter.hits); hits != tt.hits {
+			t.Errorf("notification, ready %v: expected %d runs got %d", tt.ready, tt.hits, hits)
+		}
+	}
+}
+
+func TestJson2RPC_CallBatch(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	h := NewHandler(s)
+
+	// Answers the batches backwards, responses must be matched by id
+	reversed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+
+		var resps []json.RawMessage
+		if err := json.Unmarshal(rec.Body.Bytes(), &resps); err != nil {
+			w.Write(rec.Body.Bytes())
+			return
+		}
+		for i, j := 0, len(resps) - 1; i < j; i, j = i + 1, j - 1 {
+			resps[i], resps[j] = resps[j], resps[i]
+		}
+		json.NewEncoder(w).Encode(resps)
+	})
+
+	for _, handler := range []http.Handler{h, reversed} {
+		c := NewClientHTTP(testServerURL(t, handler), "/").(BatchClient)
+
+		var sum, quotient, product Reply
+		results := c.CallBatch([]BatchCall{
+			{"Arith.Add", &Args{1, 2}, &sum},
+			{"Arith.Div", &Args{1, 0}, &quotient},
+			{"Arith.Mul", &Args{3, 4}, &product},
+			{"Arith.Add", &Args{5, 6}, &sum}, // sum is in use
+		})
+		if len(results) != 4 {
+			t.Fatalf("CallBatch: expected 4 results got %d", len(results))
+		}
+		for _, result := range results {
+			<- result.Done
+		}
+
+		if results[0].Error != nil || sum.C != 3 {
+			t.Errorf("Add: expected 3 got %d, %v", sum.C, results[0].Error)
+		}
+		if results[1].Error == nil || results[1].Error.Message != "divide by zero" || results[1].TransportError != nil {
+			t.Errorf("Div: expected divide by zero got %v", results[1].Error)
+		}
+		if results[2].Error != nil || product.C != 12 {
+			t.Errorf("Mul: expected 12 got %d, %v", product.C, results[2].Error)
+		}
+		if results[3].TransportError != rpc.ErrReplyInUse {
+			t.Errorf("Add: expected ErrReplyInUse got %v", results[3].TransportError)
+		}
+	}
+
+	// A batch the server rejects as a whole fails every call
+	c := NewClientHTTP(testServerURL(t, NewHandler(s, MaxBatchSize(1))), "/").(BatchClient)
+	results := c.CallBatch([]BatchCall{
+		{"Arith.Add", &Args{1, 2}, &Reply{}},
+		{"Arith.Add", &Args{3, 4}, &Reply{}},
+	})
+	for i, result := range results {
+		if result.Error == nil || result.Error.Code != rpc.ERR_INVALID_REQ {
+			t.Errorf("%d: expected ERR_INVALID_REQ got %v", i, result.Error)
+		}
+	}
+}
+
+func TestJson2RPC_Batch(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	body := `[
+		{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2},"id":1},
+		{"jsonrpc":"2.0","method":"Arith.Mul","params":{"A":3,"B":4}},
+		{"jsonrpc":"2.0","method":"Arith.Nope","params":{},"id":2},
+		1,
+		{"jsonrpc":"2.0","method":"Arith.Mul","params":{"A":5,"B":6},"id":3}
+	]`
+	resp, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var responses []struct {
+		Id     json.RawMessage
+		Result *Reply
+		Error  *jsonError
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&responses); err != nil {
+		t.Fatal("decoding the batch response:", err)
+	}
+
+	// The notification is not answered.
+	if len(responses) != 4 {
+		t.Fatalf("expected 4 responses got %d", len(responses))
+	}
+	if r := responses[0]; string(r.Id) != "1" || r.Result == nil || r.Result.C != 3 {
+		t.Errorf("Arith.Add: unexpected response %+v", r)
+	}
+	if r := responses[1]; string(r.Id) != "2" || r.Error == nil || r.Error.Code != rpc.ERR_NO_METHOD {
+		t.Errorf("Arith.Nope: unexpected response %+v", r)
+	}
+	if r := responses[2]; string(r.Id) != "null" || r.Error == nil {
+		t.Errorf("1: unexpected response %+v", r)
+	}
+	if r := responses[3]; string(r.Id) != "3" || r.Result == nil || r.Result.C != 30 {
+		t.Errorf("Arith.Mul: unexpected response %+v", r)
+	}
+
+	// A batch of notifications only has no response.
+	body = `[{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2}}]`
+	resp, err = http.Post(ts.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("notifications: expected status %d got %d", http.StatusNoContent, resp.StatusCode)
+	}
+}
+
+type Napper int
+
+// Nap sleeps for A milliseconds and replies with A.
+func (n *Napper) Nap(args Args, reply *Reply) error {
+	time.Sleep(time.Duration(args.A) * time.Millisecond)
+	reply.C = args.A
+	return nil
+}
+
+func TestJson2RPC_ServerTiming(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Napper))
+
+	var reply Reply
+	result := NewClientHTTP(testServerURL(t, NewHandler(s, ServerTiming())), "/").Call("Napper.Nap", &Args{A: 20}, &reply)
+	<- result.Done
+	if result.Error != nil {
+		t.Fatalf("Nap: expected no error got %v", result.Error)
+	}
+	timing := result.Timing
+	if timing == nil {
+		t.Fatal("Nap: expected the timing of the call")
+	}
+	if timing.Exec < 20 * time.Millisecond || timing.Exec > 5 * time.Second {
+		t.Errorf("Nap: expected to run for about 20ms got %v", timing.Exec)
+	}
+	if timing.Wait < 0 || timing.Wait > time.Second {
+		t.Errorf("Nap: expected a short wait got %v", timing.Wait)
+	}
+
+	// Timing is opt-in
+	result = NewClientHTTP(testServerURL(t, NewHandler(s)), "/").Call("Napper.Nap", &Args{A: 1}, &reply)
+	<- result.Done
+	if result.Error != nil || result.Timing != nil {
+		t.Errorf("Nap: expected no timing got %+v, %v", result.Timing, result.Error)
+	}
+}
+
+func TestJson2RPC_SharedReply(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Napper))
+
+	for _, c := range []rpc.Client{NewClientHTTP(testServerURL(t, NewHandler(s)), "/"), NewInProcClient(s)} {
+		var reply Reply
+		slow := c.Call("Napper.Nap", &Args{A: 50}, &reply)
+
+		// A reply can't be shared with a call in flight
+		result := c.Call("Napper.Nap", &Args{A: 1}, &reply)
+		<- result.Done
+		if result.Error != rpc.ErrReplyInUse {
+			t.Errorf("Nap: expected ErrReplyInUse got %v", result.Error)
+		}
+
+		<- slow.Done
+		if slow.Error != nil || reply.C != 50 {
+			t.Errorf("Nap: expected 50 got %d, %v", reply.C, slow.Error)
+		}
+
+		// but can be reused once it is done
+		result = c.Call("Napper.Nap", &Args{A: 1}, &reply)
+		<- result.Done
+		if result.Error != nil || reply.C != 1 {
+			t.Errorf("Nap: expected 1 got %d, %v", reply.C, result.Error)
+		}
+	}
+}
+
+func TestJson2RPC_BatchConcurrent(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Napper))
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	naps := []int{100, 20, 60, 80}
+	calls := make([]string, len(naps))
+	for i, ms := range naps {
+		calls[i] = fmt.Sprintf(`{"jsonrpc":"2.0","method":"Napper.Nap","params":{"A":%d},"id":%d}`, ms, i)
+	}
+
+	start := time.Now()
+	resp, err := http.Post(ts.URL, "application/json", strings.NewReader("[" + strings.Join(calls, ",") + "]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var responses []struct {
+		Id     int
+		Result Reply
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&responses); err != nil {
+		t.Fatal("decoding the batch response:", err)
+	}
+	elapsed := time.Since(start)
+
+	// Responses follow the order of the calls, not their completion.
+	if len(responses) != len(naps) {
+		t.Fatalf("expected %d responses got %d", len(naps), len(responses))
+	}
+	for i, r := range responses {
+		if r.Id != i || r.Result.C != naps[i] {
+			t.Errorf("response %d: expected id %d and %d got %+v", i, i, naps[i], r)
+		}
+	}
+
+	// Run one after the other the calls would take 260ms.
+	if elapsed >= 200 * time.Millisecond {
+		t.Errorf("expected the calls to run concurrently, the batch took %v", elapsed)
+	}
+}
+
+// The members of a batch run concurrently; each unknown method is answered
+// with its own name as Data.
+func TestJson2RPC_BatchUnknownMethods(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	var calls, names []string
+	for i := 0; i < 8; i++ {
+		if i % 2 == 0 {
+			calls = append(calls, fmt.Sprintf(`{"jsonrpc":"2.0","method":"Arith.Nope%d","params":{},"id":%d}`, i, i))
+		} else {
+			calls = append(calls, fmt.Sprintf(`{"jsonrpc":"2.0","method":"Nope%d.Add","params":{},"id":%d}`, i, i))
+		}
+		names = append(names, fmt.Sprintf("Nope%d", i))
+	}
+
+	resp, err := http.Post(ts.URL, "application/json", strings.NewReader("[" + strings.Join(calls, ",") + "]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var responses []struct {
+		Id    int
+		Error *jsonError
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&responses); err != nil {
+		t.Fatal("decoding the batch response:", err)
+	}
+
+	if len(responses) != len(calls) {
+		t.Fatalf("expected %d responses got %d", len(calls), len(responses))
+	}
+	for i, r := range responses {
+		if r.Error == nil || r.Error.Code != rpc.ERR_NO_METHOD || r.Error.Data != names[i] {
+			t.Errorf("response %d: expected ERR_NO_METHOD with data %q got %+v", i, names[i], r.Error)
+		}
+	}
+}
+
+type Counter struct {
+	hits int32
+}
+
+func (c *Counter) Hit(args Args, reply *int32) error {
+	*reply = atomic.AddInt32(&c.hits, 1)
+	return nil
+}
+
+func TestJson2RPC_MaxBatchSize(t *testing.T) {
+	counter := new(Counter)
+	s := rpc.NewServer()
+	s.Register(counter)
+	ts := httptest.NewServer(NewHandler(s, MaxBatchSize(2)))
+	defer ts.Close()
+
+	call := `{"jsonrpc":"2.0","method":"Counter.Hit","params":{},"id":1}`
+	for _, n := range []int{2, 3} {
+		body := "[" + strings.TrimSuffix(strings.Repeat(call + ",", n), ",") + "]"
+		resp, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if n <= 2 {
+			var responses []json.RawMessage
+			if err := json.Unmarshal(data, &responses); err != nil || len(responses) != n {
+				t.Errorf("batch of %d: expected %d responses got %s", n, n, data)
+			}
+			continue
+		}
+
+		// Over the limit the batch is rejected with a single response.
+		var jresp struct {
+			Id    json.RawMessage
+			Error *jsonError
+		}
+		if err := json.Unmarshal(data, &jresp); err != nil {
+			t.Fatalf("batch of %d: expected a single response got %s", n, data)
+		}
+		if jresp.Error == nil || jresp.Error.Code != rpc.ERR_INVALID_REQ || string(jresp.Id) != "null" {
+			t.Errorf("batch of %d: expected invalid request error got %s", n, data)
+		}
+	}
+
+	if hits := atomic.LoadInt32(&counter.hits); hits != 2 {
+		t.Errorf("expected 2 calls run got %d", hits)
+	}
+}
+
+func TestJson2RPC_DedupNotifications(t *testing.T) {
+	counter := new(Counter)
+	s := rpc.NewServer()
+	s.Register(counter)
+	url := testServerURL(t, NewHandler(s, DedupNotifications(NewMemorySeenSet(time.Minute))))
+
+	notify := func(id string) {
+		req, _ := http.NewRequest("POST", url, strings.NewReader(`{"jsonrpc":"2.0","method":"Counter.Hit","params":{}}`))
+		if id != "" {
+			req.Header.Set(NotificationIDHeader, id)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("%q: expected status %d got %d", id, http.StatusNoContent, resp.StatusCode)
+		}
+	}
+
+	// Notifications are run once per id, always without one
+	for _, id := range []string{"n-1", "n-1", "n-2", "", ""} {
+		notify(id)
+	}
+
+	if hits := atomic.LoadInt32(&counter.hits); hits != 4 {
+		t.Errorf("expected 4 runs got %d", hits)
+	}
+
+	// A batch delivered twice runs its notifications once each
+	batch := `[{"jsonrpc":"2.0","method":"Counter.Hit","params":{}},` +
+		`{"jsonrpc":"2.0","method":"Counter.Hit","params":{}},` +
+		`{"jsonrpc":"2.0","method":"Counter.Hit","params":{},"id":1}]`
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", url, strings.NewReader(batch))
+		req.Header.Set(NotificationIDHeader, "b-1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resps []srvResponse
+		err = json.NewDecoder(resp.Body).Decode(&resps)
+		resp.Body.Close()
+		if err != nil || len(resps) != 1 {
+			t.Errorf("batch: expected the response to the call got %v, %v", resps, err)
+		}
+	}
+	if hits := atomic.LoadInt32(&counter.hits); hits != 8 {
+		t.Errorf("batch: expected 8 runs got %d", hits)
+	}
+}
+
+// A notification refused isn't taken for run, its redelivery is run.
+func TestJson2RPC_DedupRefused(t *testing.T) {
+	counter := new(Counter)
+	s := rpc.NewServer()
+	s.Register(counter)
+	h := NewHandler(s, DedupNotifications(NewMemorySeenSet(time.Minute)))
+	url := testServerURL(t, h)
+
+	notify := func(body string) int {
+		req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+		req.Header.Set(NotificationIDHeader, "n-1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	single := `{"jsonrpc":"2.0","method":"Counter.Hit","params":{}}`
+	batch := `[{"jsonrpc":"2.0","method":"Counter.Hit","params":{}}]`
+	msg := []byte(single)
+	msgCtx := WithNotificationID(context.Background(), "m-1")
+
+	s.SetReady(false)
+	if status := notify(single); status != http.StatusServiceUnavailable {
+		t.Errorf("not ready: expected status %d got %d", http.StatusServiceUnavailable, status)
+	}
+	notify(batch)
+	h.ServeMessage(msgCtx, msg)
+	if hits := atomic.LoadInt32(&counter.hits); hits != 0 {
+		t.Fatalf("not ready: expected no run got %d", hits)
+	}
+
+	// Delivered again once ready, each is run once
+	s.SetReady(true)
+	for i := 0; i < 2; i++ {
+		if status := notify(single); status != http.StatusNoContent {
+			t.Errorf("ready: expected status %d got %d", http.StatusNoContent, status)
+		}
+		notify(batch)
+		h.ServeMessage(msgCtx, msg)
+	}
+	if hits := atomic.LoadInt32(&counter.hits); hits != 3 {
+		t.Errorf("ready: expected 3 runs got %d", hits)
+	}
+}
+
+func TestJson2RPC_DedupMessages(t *testing.T) {
+	counter := new(Counter)
+	s := rpc.NewServer()
+	s.Register(counter)
+	h := NewHandler(s, DedupNotifications(NewMemorySeenSet(time.Minute)))
+
+	msg := []byte(`{"jsonrpc":"2.0","method":"Counter.Hit","params":{}}`)
+	for _, id := range []string{"m-1", "m-1", "m-2"} {
+		if resp := h.ServeMessage(WithNotificationID(context.Background(), id), msg); resp != nil {
+			t.Errorf("%q: expected no response got %s", id, resp)
+		}
+	}
+	h.ServeMessage(context.Background(), msg)
+
+	// and so are those of batches
+	batch := []byte(`[{"jsonrpc":"2.0","method":"Counter.Hit","params":{}}]`)
+	for i := 0; i < 2; i++ {
+		h.ServeMessage(WithNotificationID(context.Background(), "b-1"), batch)
+	}
+
+	if hits := atomic.LoadInt32(&counter.hits); hits != 4 {
+		t.Errorf("expected 4 runs got %d", hits)
+	}
+}
+
+func TestJson2RPC_MethodFilter(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+
+	tests := []struct {
+		opt     HandlerOption
+		exposed map[string]bool
+	}{
+		{AllowMethods("Arith.Add"), map[string]bool{"Arith.Add": true, "Arith.Mul": false}},
+		{DenyMethods("Arith.Add"), map[string]bool{"Arith.Add": false, "Arith.Mul": true}},
+	}
+	for _, tt := range tests {
+		ts := httptest.NewServer(NewHandler(s, tt.opt))
+		c := NewClientHTTP(ts.URL, "/")
+
+		for method, exposed := range tt.exposed {
+			var reply Reply
+			result := c.Call(method, &Args{2, 3}, &reply)
+			<- result.Done
+
+			if exposed && result.Error != nil {
+				t.Errorf("%s: expected no error but got string %q", method, result.Error.Error())
+			}
+			if !exposed && (result.Error == nil || result.Error.Code != rpc.ERR_NO_METHOD) {
+				t.Errorf("%s: expected can't find method error; got %v", method, result.Error)
+			}
+		}
+		ts.Close()
+	}
+}
+
+func TestJson2RPC_H2C(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+
+	var (
+		mu    sync.Mutex
+		conns = make(map[string]bool)
+		h1    int32
+	)
+	h := newH2CHandler("/rpc", s)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			atomic.AddInt32(&h1, 1)
+		}
+		mu.Lock()
+		conns[r.RemoteAddr] = true
+		mu.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	c := NewClientHTTP(ts.URL, "/rpc", WithHTTP2())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var reply Reply
+			result := c.Call("Arith.Mul", &Args{i, 3}, &reply)
+			<- result.Done
+			if result.Error != nil {
+				t.Errorf("Mul: expected no error but got string %q", result.Error.Error())
+			} else if reply.C != i * 3 {
+				t.Errorf("Mul: expected %d got %d", i * 3, reply.C)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&h1); n != 0 {
+		t.Errorf("expected every call over HTTP/2, %d were not", n)
+	}
+	if len(conns) != 1 {
+		t.Errorf("expected the calls to share one connection got %d", len(conns))
+	}
+}
+
+type Blob int
+
+func (b *Blob) Get(args Args, reply *string) error {
+	*reply = strings.Repeat("x", 16 << 10)
+	return nil
+}
+
+func TestJson2RPC_ContentLength(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Blob))
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	// Large enough that net/http would chunk it without a Content-Length
+	body := `{"jsonrpc":"2.0","method":"Blob.Get","params":{},"id":1}`
+	resp, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if len(resp.TransferEncoding) != 0 {
+		t.Errorf("expected no transfer encoding got %v", resp.TransferEncoding)
+	}
+	if resp.ContentLength != int64(len(out)) {
+		t.Errorf("expected Content-Length %d got %d", len(out), resp.ContentLength)
+	}
+}
+
+func TestJson2RPC_CompressAbove(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	s.Register(new(Blob))
+	h := NewHandler(s, CompressAbove(1024))
+
+	tests := []struct {
+		method     string
+		accept     string
+		compressed bool
+	}{
+		{"Blob.Get", "gzip", true},
+		{"Blob.Get", "deflate, gzip;q=0.5", true},
+		{"Blob.Get", "gzip;q=0", false},
+		{"Blob.Get", "", false},
+		{"Arith.Add", "gzip", false}, // below the threshold
+	}
+	for _, tt := range tests {
+		body := `{"jsonrpc":"2.0","method":"` + tt.method + `","params":{"A":1,"B":2},"id":1}`
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		if tt.accept != "" {
+			req.Header.Set("Accept-Encoding", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if got := w.Header().Get("Content-Encoding") == "gzip"; got != tt.compressed {
+			t.Errorf("%s, %q: expected compressed %v got %v", tt.method, tt.accept, tt.compressed, got)
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s, %q: expected Vary: Accept-Encoding got %q", tt.method, tt.accept, w.Header().Get("Vary"))
+		}
+		if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(w.Body.Len()) {
+			t.Errorf("%s, %q: expected Content-Length %d got %s", tt.method, tt.accept, w.Body.Len(), cl)
+		}
+
+		var out io.Reader = w.Body
+		if tt.compressed {
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("%s, %q: %v", tt.method, tt.accept, err)
+			}
+			out = zr
+		}
+		var jresp struct {
+			Result json.RawMessage
+			Error  *jsonError
+		}
+		if err := json.NewDecoder(out).Decode(&jresp); err != nil || jresp.Error != nil {
+			t.Errorf("%s, %q: expected a result got %v, %v", tt.method, tt.accept, err, jresp.Error)
+		}
+	}
+
+	// The client gets compressed responses transparently
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	var blob string
+	result := NewClientHTTP(ts.URL, "/").Call("Blob.Get", &Args{}, &blob)
+	<- result.Done
+	if result.Error != nil || len(blob) != 16 << 10 {
+		t.Errorf("Get: expected %d bytes got %d, %v", 16 << 10, len(blob), result.Error)
+	}
+}
+
+func TestJson2RPC_ObserveCalls(t *testing.T) {
+	release := make(chan struct{})
+	s := rpc.NewServer()
+	s.Register(new(Blob))
+	s.Register(&Whoami{"server", release})
+
+	var mutex sync.Mutex
+	var calls []CallStats
+	h := NewHandler(s, LogSlowCalls(10 * time.Millisecond), ObserveCalls(func(stats CallStats) {
+		mutex.Lock()
+		calls = append(calls, stats)
+		mutex.Unlock()
+	}))
+
+	requests := []string{
+		`{"jsonrpc":"2.0","method":"Blob.Get","params":{},"id":"big"}`,
+		`{"jsonrpc":"2.0","method":"Whoami.Slow","params":{},"id":"slow"}`,
+		`{"jsonrpc":"2.0","method":"Blob.Gone","params":{},"id":3}`,
+	}
+	for _, body := range requests {
+		if strings.Contains(body, "Slow") {
+			time.AfterFunc(30 * time.Millisecond, func() { close(release) })
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	}
+
+	if len(calls) != len(requests) {
+		t.Fatalf("expected %d observed calls got %d", len(requests), len(calls))
+	}
+
+	big := calls[0]
+	if big.Method != "Blob.Get" || big.ID != "big" || big.Error != nil {
+		t.Errorf("Get: unexpected stats %+v", big)
+	}
+	if big.RequestBytes != int64(len(requests[0])) {
+		t.Errorf("Get: expected %d request bytes got %d", len(requests[0]), big.RequestBytes)
+	}
+	if big.ResponseBytes < 16 << 10 {
+		t.Errorf("Get: expected at least %d response bytes got %d", 16 << 10, big.ResponseBytes)
+	}
+
+	if slow := calls[1]; slow.ID != "slow" || slow.Duration < 20 * time.Millisecond {
+		t.Errorf("Slow: expected a duration of at least 20ms got %+v", slow)
+	}
+
+	if gone := calls[2]; gone.Error == nil || gone.ID != "3" {
+		t.Errorf("Gone: expected the error to be observed got %+v", gone)
+	}
+}
+
+func TestJson2RPC_Strict(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+
+	tests := []struct {
+		body    string
+		lenient int // error code without Strict, 0 for none
+		strict  int // error code with Strict
+	}{
+		{`{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2},"id":1}`, 0, 0},
+		{`{"jsonrpc":"2.0","method":"Arith.Add","parms":{"A":1,"B":2},"params":{},"id":1}`, 0, rpc.ERR_INVALID_REQ},
+		{`{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"b2":2},"id":1}`, 0, rpc.ERR_BAD_PARAMS},
+	}
+
+	for _, strict := range []bool{false, true} {
+		var opts []HandlerOption
+		if strict {
+			opts = append(opts, Strict())
+		}
+		ts := httptest.NewServer(NewHandler(s, opts...))
+
+		for _, test := range tests {
+			want := test.lenient
+			if strict {
+				want = test.strict
+			}
+
+			resp, err := http.Post(ts.URL, "application/json", strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out struct {
+				Error *jsonError
+			}
+			err = json.NewDecoder(resp.Body).Decode(&out)
+			resp.Body.Close()
+
+			if err != nil {
+				t.Errorf("strict %v, %s: %v", strict, test.body, err)
+			} else if want == 0 && out.Error != nil {
+				t.Errorf("strict %v, %s: expected no error got %v", strict, test.body, out.Error)
+			} else if want != 0 && (out.Error == nil || out.Error.Code != want) {
+				t.Errorf("strict %v, %s: expected error %d got %v", strict, test.body, want, out.Error)
+			}
+		}
+		ts.Close()
+	}
+}
+
+type Directory int
+
+func (d *Directory) Lookup(args Args, reply *Reply) error {
+	return rpc.ErrNoContent
+}
+
+func TestJson2RPC_NoContent(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Directory))
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	// The response carries an explicit null result
+	body := `{"jsonrpc":"2.0","method":"Directory.Lookup","params":{},"id":1}`
+	resp, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if want := `{"jsonrpc":"2.0","id":1,"result":null}` + "\n"; string(out) != want {
+		t.Errorf("expected %s got %s", want, out)
+	}
+
+	// The client leaves the reply untouched
+	reply := Reply{42}
+	c := NewClientHTTP(ts.URL, "/")
+	result := c.Call("Directory.Lookup", &Args{}, &reply)
+	<- result.Done
+
+	if result.Error != nil {
+		t.Errorf("Lookup: expected no error but got string %q", result.Error.Error())
+	}
+	if reply.C != 42 {
+		t.Errorf("Lookup: expected the reply untouched got %d", reply.C)
+	}
+}
+
+func TestJson2RPC_EditHeaders(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+
+	tests := []struct {
+		opts        []HandlerOption
+		nosniff     string
+		contentType string
+	}{
+		{nil, "nosniff", "application/json; charset=utf-8"},
+		{[]HandlerOption{EditHeaders(func(h http.Header) {
+			h.Del("x-content-type-options")
+			h.Set("Content-Type", "application/json-rpc")
+		})}, "", "application/json-rpc"},
+	}
+
+	body := `{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2},"id":1}`
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		NewHandler(s, test.opts...).ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+
+		if got := w.Header().Get("x-content-type-options"); got != test.nosniff {
+			t.Errorf("expected x-content-type-options %q got %q", test.nosniff, got)
+		}
+		if got := w.Header().Get("Content-Type"); got != test.contentType {
+			t.Errorf("expected Content-Type %q got %q", test.contentType, got)
+		}
+	}
+}
+
+type Audit int
+
+type AuditReply struct {
+	RemoteAddr, Agent, Subject string
+}
+
+func (t *Audit) Who(ctx context.Context, args Args, reply *AuditReply) error {
+	info, ok := CallInfoFromContext(ctx)
+	if !ok {
+		return errors.New("no call info")
+	}
+	reply.RemoteAddr = info.RemoteAddr
+	reply.Agent = info.Header.Get("X-Agent")
+	reply.Subject = info.Subject
+	return nil
+}
+
+func TestJson2RPC_CallInfo(t *testing.T) {
+	once.Do(startServer)
+
+	if err := srv.Register(new(Audit)); err != nil {
+		t.Fatal("Register Audit:", err)
+	}
+
+	body := `{"jsonrpc":"2.0","method":"Audit.Who","params":{},"id":1}`
+	req, err := http.NewRequest("POST", testHttpSrv.URL, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Agent", "tester")
+	req.SetBasicAuth("alice", "secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		Result AuditReply
+		Error  *jsonError
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Error != nil {
+		t.Fatalf("Who: expected no error but got %v", out.Error)
+	}
+
+	if !strings.HasPrefix(out.Result.RemoteAddr, "127.0.0.1:") {
+		t.Errorf("Who: expected a loopback remote address got %q", out.Result.RemoteAddr)
+	}
+	if out.Result.Agent != "tester" {
+		t.Errorf("Who: expected agent %q got %q", "tester", out.Result.Agent)
+	}
+	if out.Result.Subject != "alice" {
+		t.Errorf("Who: expected subject %q got %q", "alice", out.Result.Subject)
+	}
+}
+
+func TestJson2RPC_ReadRequestSplit(t *testing.T) {
+	tests := []struct {
+		method        string
+		service, name string
+	}{
+		{"Arith.Add", "Arith", "Add"},
+		{"v1.math.Add", "v1.math", "Add"},
+		{"a.b.c.Add", "a.b.c", "Add"},
+	}
+
+	for _, test := range tests {
+		body := `{"jsonrpc":"2.0","method":"` + test.method + `","params":{},"id":1}`
+
+		req, err := new(Handler).readRequest(ioutil.NopCloser(strings.NewReader(body)))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.method, err)
+			continue
+		}
+		if req.ServiceName() != test.service || req.MethodName() != test.name {
+			t.Errorf("%s: expected %s / %s got %s / %s", test.method,
+				test.service, test.name, req.ServiceName(), req.MethodName())
+		}
+	}
+}
+
+func TestJson2RPC_ReadRequestInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		msg  string
+		data interface{}
+	}{
+		{"missing jsonrpc", `{"method":"Arith.Add","id":1}`, "missing jsonrpc member", nil},
+		{"wrong version", `{"jsonrpc":"1.0","method":"Arith.Add","id":1}`, "unsupported jsonrpc version", "1.0"},
+		{"missing method", `{"jsonrpc":"2.0","id":1}`, "missing or empty method", nil},
+		{"empty method", `{"jsonrpc":"2.0","method":"","id":1}`, "missing or empty method", nil},
+		{"no dot", `{"jsonrpc":"2.0","method":"Add","id":1}`, "Service.Method", "Add"},
+		{"no service", `{"jsonrpc":"2.0","method":".Add","id":1}`, "Service.Method", ".Add"},
+		{"no method", `{"jsonrpc":"2.0","method":"Arith.","id":1}`, "Service.Method", "Arith."},
+	}
+
+	for _, test := range tests {
+		_, err := new(Handler).readRequest(ioutil.NopCloser(strings.NewReader(test.body)))
+
+		serr, ok := err.(*rpc.ServerError)
+		if !ok {
+			t.Errorf("%s: expected a ServerError got %v", test.name, err)
+			continue
+		}
+		if serr.Code != rpc.ERR_INVALID_REQ {
+			t.Errorf("%s: expected code %d got %d", test.name, rpc.ERR_INVALID_REQ, serr.Code)
+		}
+		if !strings.Contains(serr.Message, test.msg) {
+			t.Errorf("%s: expected message about %q got %q", test.name, test.msg, serr.Message)
+		}
+		if serr.Data != test.data {
+			t.Errorf("%s: expected data %v got %v", test.name, test.data, serr.Data)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+type Whoami struct {
+	name    string
+	release chan struct{} // Slow blocks until it is closed
+}
+
+func (w *Whoami) Name(args Args, reply *string) error {
+	*reply = w.name
+	return nil
+}
+
+func (w *Whoami) Slow(args Args, reply *string) error {
+	<-w.release
+	*reply = w.name
+	return nil
+}
+
+func newWhoamiServer(name string, release chan struct{}) *httptest.Server {
+	s := rpc.NewServer()
+	s.Register(&Whoami{name, release})
+	return httptest.NewServer(NewHandler(s))
+}
+
+func callName(c rpc.Client, method string) (string, *rpc.ServerError) {
+	var name string
+	result := c.Call(method, &Args{}, &name)
+	<- result.Done
+	return name, result.Error
+}
+
+func TestJson2RPC_CallContext(t *testing.T) {
+	release := make(chan struct{})
+	ts := newWhoamiServer("server", release)
+	defer ts.Close()
+	defer close(release)
+
+	c := NewClientHTTP(ts.URL, "/")
+
+	if name, err := callName(c, "Whoami.Name"); err != nil || name != "server" {
+		t.Fatalf("Name: expected server got %q, %v", name, err)
+	}
+
+	// The in-flight request is aborted on cancel
+	ctx, cancel := context.WithCancel(context.Background())
+	var name string
+	result := c.CallContext(ctx, "Whoami.Slow", &Args{}, &name)
+	time.AfterFunc(20 * time.Millisecond, cancel)
+
+	select {
+	case <-result.Done:
+	case <-time.After(time.Second):
+		t.Fatal("Slow: expected the call to complete once cancelled")
+	}
+	if !errors.Is(result.Error, context.Canceled) {
+		t.Errorf("Slow: expected context.Canceled got %v", result.Error)
+	}
+
+	// Deadlines flow into the request too
+	ctx, cancel = context.WithTimeout(context.Background(), 20 * time.Millisecond)
+	defer cancel()
+	result = c.CallContext(ctx, "Whoami.Slow", &Args{}, &name)
+	<- result.Done
+	if !errors.Is(result.Error, context.DeadlineExceeded) {
+		t.Errorf("Slow: expected context.DeadlineExceeded got %v", result.Error)
+	}
+
+	// A call made with a done context is not sent
+	result = NewInProcClient(rpc.NewServer()).CallContext(ctx, "Whoami.Name", &Args{}, &name)
+	<- result.Done
+	if !errors.Is(result.Error, context.DeadlineExceeded) {
+		t.Errorf("in process: expected context.DeadlineExceeded got %v", result.Error)
+	}
+}
+
+func TestJson2RPC_MountAll(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+
+	mux := http.NewServeMux()
+	rpc.MountAll(mux, s, map[string]rpc.Codec{
+		"/rpc":        NewCodec(),
+		"/rpc-strict": NewCodec(Strict()),
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	clients := []rpc.Client{
+		NewClientHTTP(ts.URL, "/rpc"),
+		NewClientHTTP(ts.URL, "/rpc-strict"),
+	}
+
+	// Both transports hit the shared worker pool at once
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for _, c := range clients {
+			wg.Add(1)
+			go func(c rpc.Client, i int) {
+				defer wg.Done()
+
+				var reply Reply
+				result := c.Call("Arith.Add", &Args{i, 1}, &reply)
+				<- result.Done
+				if result.Error != nil {
+					t.Errorf("Add: unexpected error %v", result.Error)
+				} else if reply.C != i + 1 {
+					t.Errorf("Add: expected %d got %d", i + 1, reply.C)
+				}
+			}(c, i)
+		}
+	}
+	wg.Wait()
+
+	// Each route keeps the options of its codec
+	body := `{"jsonrpc": "2.0", "method": "Arith.Add", "params": {"A": 1, "B": 2, "X": 3}, "id": 1}`
+	for path, code := range map[string]int{"/rpc": 0, "/rpc-strict": rpc.ERR_BAD_PARAMS} {
+		resp, err := http.Post(ts.URL + path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var jresp struct {
+			Error *jsonError
+		}
+		json.NewDecoder(resp.Body).Decode(&jresp)
+		resp.Body.Close()
+
+		switch {
+		case code == 0 && jresp.Error != nil:
+			t.Errorf("%s: unexpected error %v", path, jresp.Error)
+		case code != 0 && (jresp.Error == nil || jresp.Error.Code != code):
+			t.Errorf("%s: expected code %d got %v", path, code, jresp.Error)
+		}
+	}
+}
+
+func TestJson2RPC_LimitPerClient(t *testing.T) {
+	const limit = 3
+
+	release := make(chan struct{})
+	s := rpc.NewServer()
+	s.Register(&Whoami{"server", release})
+	h := NewHandler(s, LimitPerClient(limit, func(r *http.Request) string {
+		return r.Header.Get("X-Client")
+	}))
+
+	post := func(client string) *httptest.ResponseRecorder {
+		body := `{"jsonrpc":"2.0","method":"Whoami.Slow","params":{},"id":1}`
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("X-Client", client)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	var wg sync.WaitGroup
+	codes := make(chan int, limit)
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- post("noisy").Code
+		}()
+	}
+	for s.Stats().Busy < limit {
+		time.Sleep(time.Millisecond)
+	}
+
+	// One more from the same client overflows
+	w := post("noisy")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d got %d", http.StatusTooManyRequests, w.Code)
+	}
+	var jresp struct {
+		Error *jsonError
+	}
+	if err := json.NewDecoder(w.Body).Decode(&jresp); err != nil || jresp.Error == nil || jresp.Error.Code != rpc.ERR_SERVER {
+		t.Errorf("expected an ERR_SERVER error got %v, %v", jresp.Error, err)
+	}
+
+	// Other clients are not held back
+	quiet := make(chan int, 1)
+	go func() { quiet <- post("quiet").Code }()
+	for s.Stats().Busy < limit + 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("expected the calls within the limit to succeed got status %d", code)
+		}
+	}
+	if code := <-quiet; code != http.StatusOK {
+		t.Errorf("expected the other client to succeed got status %d", code)
+	}
+
+	// The slots are freed once the calls complete
+	if w := post("noisy"); w.Code != http.StatusOK {
+		t.Errorf("expected status %d after the calls completed got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestJson2RPC_SchemaHandler(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	ts := httptest.NewServer(SchemaHandler(s))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var schema map[string]*rpc.MethodSchema
+	if err := json.NewDecoder(resp.Body).Decode(&schema); err != nil {
+		t.Fatal(err)
+	}
+	add := schema["Arith.Add"]
+	if add == nil || add.Params.Properties["A"] == nil || add.Result.Properties["C"] == nil {
+		t.Errorf("expected the schema of Arith.Add got %+v", add)
+	}
+	if len(schema) != 3 {
+		t.Errorf("expected 3 methods got %d", len(schema))
+	}
+}
+
+func TestJson2RPC_Shutdown(t *testing.T) {
+	release := make(chan struct{})
+	s := rpc.NewServer()
+	s.Register(&Whoami{"slow", release})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &http.Server{Handler: NewHandler(s)}
+	go hs.Serve(ln)
+
+	c := NewClientHTTP("http://" + ln.Addr().String(), "/")
+
+	type outcome struct {
+		name string
+		err  *rpc.ServerError
+	}
+	served := make(chan outcome)
+	go func() {
+		name, err := callName(c, "Whoami.Slow")
+		served <- outcome{name, err}
+	}()
+	for s.Stats().Busy == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- Shutdown(context.Background(), hs, s)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	if o := <-served; o.err != nil || o.name != "slow" {
+		t.Errorf("Slow: expected the call in flight to complete got %q, %v", o.name, o.err)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+
+	// A handler for the shut down server turns callers away
+	w := httptest.NewRecorder()
+	body := `{"jsonrpc":"2.0","method":"Whoami.Name","params":{},"id":1}`
+	NewHandler(s).ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestJson2RPC_HandlerClose(t *testing.T) {
+	// Settles the goroutine count, workers exit asynchronously.
+	goroutines := func(want int) int {
+		deadline := time.Now().Add(time.Second)
+		for {
+			n := runtime.NumGoroutine()
+			if n <= want || time.Now().After(deadline) {
+				return n
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	before := runtime.NumGoroutine()
+
+	body := `{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2},"id":1}`
+	for i := 0; i < 20; i++ {
+		s := rpc.NewServer()
+		s.Register(new(Arith))
+		h := NewHandler(s)
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d got %d", http.StatusOK, w.Code)
+		}
+
+		if err := h.Close(); err != nil {
+			t.Fatal("Close:", err)
+		}
+		if !s.ShuttingDown() {
+			t.Fatal("expected Close to shut the server down")
+		}
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected status %d after Close got %d", http.StatusServiceUnavailable, w.Code)
+		}
+	}
+
+	if after := goroutines(before); after > before {
+		t.Errorf("expected %d goroutines after closing the handlers got %d", before, after)
+	}
+}
+
+func TestJson2RPC_InProcClient(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	c := NewInProcClient(s)
+
+	var reply Reply
+	result := c.Call("Arith.Add", &Args{7, 8}, &reply)
+	<- result.Done
+	if result.Error != nil {
+		t.Errorf("Add: expected no error but got string %q", result.Error.Error())
+	} else if reply.C != 15 {
+		t.Errorf("Add: expected 15 got %d", reply.C)
+	}
+
+	result = c.Call("Arith.Div", &Args{7, 0}, &reply)
+	<- result.Done
+	if result.Error == nil || result.Error.Message != "divide by zero" {
+		t.Errorf("Div: expected divide by zero error; got %v", result.Error)
+	}
+
+	result = c.Call("Arith.Unknown", &Args{}, &reply)
+	<- result.Done
+	if result.Error == nil || result.Error.Code != rpc.ERR_NO_METHOD {
+		t.Errorf("Unknown: expected can't find method error; got %v", result.Error)
+	}
+}
+
+type Node struct {
+	Name string
+	Next *Node
+}
+
+type Graph int
+
+func (g *Graph) Loop(args Args, reply *Node) error {
+	reply.Name = "loop"
+	reply.Next = reply
+	return nil
+}
+
+type Panicky struct{}
+
+func (Panicky) MarshalJSON() ([]byte, error) {
+	panic("cannot marshal")
+}
+
+func (g *Graph) Panic(args Args, reply *Panicky) error {
+	return nil
+}
+
+func TestJson2RPC_UnencodableResult(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Graph))
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	for _, method := range []string{"Graph.Loop", "Graph.Panic"} {
+		body := `{"jsonrpc": "2.0", "method": "` + method + `", "params": {}, "id": 1}`
+		resp, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var jresp struct {
+			Result json.RawMessage
+			Error  *jsonError
+		}
+		err = json.NewDecoder(resp.Body).Decode(&jresp)
+		resp.Body.Close()
+
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected a JSON-RPC response got status %d, %v", method, resp.StatusCode, err)
+		}
+		if jresp.Error == nil || jresp.Error.Code != rpc.ERR_INTERNAL || !strings.Contains(jresp.Error.Message, method) {
+			t.Errorf("%s: expected an internal error naming the method got %+v", method, jresp.Error)
+		}
+		if jresp.Result != nil {
+			t.Errorf("%s: expected no result got %s", method, jresp.Result)
+		}
+	}
+}
+
+// streamingJSON is encoding/json with an encoder writing what it could
+// encode before failing, as streaming encoders do.
+type streamingJSON struct {
+	stdJSON
+}
+
+type streamingEncoder struct {
+	w io.Writer
+}
+
+func (streamingJSON) NewEncoder(w io.Writer) Encoder {
+	return streamingEncoder{w}
+}
+
+func (e streamingEncoder) Encode(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		e.w.Write([]byte(`{"jsonrpc":"2.0","result":{"Name":"loop","Next":`))
+		return err
+	}
+	_, err = e.w.Write(append(data, '\n'))
+	return err
+}
+
+func TestJson2RPC_PartialEncoding(t *testing.T) {
+	SetJSON(streamingJSON{})
+	t.Cleanup(func() { SetJSON(nil) })
+
+	s := rpc.NewServer()
+	s.Register(new(Graph))
+
+	// What the encoder wrote before failing doesn't reach the client,
+	// even within a batch.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader(
+		`[{"jsonrpc":"2.0","method":"Graph.Loop","params":{},"id":1},` +
+		`{"jsonrpc":"2.0","method":"Graph.Loop","params":{},"id":2}]`))
+	NewHandler(s).ServeHTTP(w, r)
+
+	var resps []struct {
+		Error *jsonError
+		Id    int
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resps); err != nil {
+		t.Fatalf("expected a JSON-RPC batch response got %v: %s", err, w.Body)
+	}
+	if len(resps) != 2 {
+		t.Fatalf("expected 2 responses got %s", w.Body)
+	}
+	for i, resp := range resps {
+		if resp.Error == nil || resp.Error.Code != rpc.ERR_INTERNAL || resp.Id != i + 1 {
+			t.Errorf("expected an internal error for call %d got %+v", i + 1, resp)
+		}
+	}
+}
+
+// brokenWriter is a http.ResponseWriter whose connection is gone.
+type brokenWriter struct {
+	header http.Header
+}
+
+func (w *brokenWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *brokenWriter) WriteHeader(status int) {}
+
+func (w *brokenWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestJson2RPC_WriteFailure(t *testing.T) {
+	// Write failures are told apart from encoding failures
+	jreq := &srvRequest{Version: "2.0", Id: json.RawMessage("1")}
+	err := writeResponse(new(brokenWriter), jreq, rpc.NewResult(&Reply{3}, nil))
+	var werr *WriteError
+	if !errors.As(err, &werr) || !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("expected a WriteError got %v", err)
+	}
+
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+
+	var stats CallStats
+	h := NewHandler(s, ObserveCalls(func(cs CallStats) { stats = cs }))
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader(`{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2},"id":1}`))
+	h.ServeHTTP(new(brokenWriter), r)
+
+	if stats.Error != nil {
+		t.Errorf("expected the call to succeed got %v", stats.Error)
+	}
+	if stats.WriteError != io.ErrClosedPipe {
+		t.Errorf("expected the write failure to be observed got %v", stats.WriteError)
+	}
+}
+
+type Feed int
+
+type FeedReply struct {
+	Updates chan int
+}
+
+func (f *Feed) Open(args Args, reply *FeedReply) error {
+	return nil
+}
+
+func TestJson2RPC_RegisterChecksReplies(t *testing.T) {
+	s := rpc.NewServer()
+
+	if err := Register(s, new(Arith)); err != nil {
+		t.Fatal("Register Arith:", err)
+	}
+
+	err := Register(s, new(Feed))
+	serr, ok := err.(*rpc.ServerError)
+	if !ok || serr.Code != rpc.ERR_SERVER || !strings.Contains(serr.Message, "Open") {
+		t.Fatalf("Register Feed: expected an error naming Open got %v", err)
+	}
+	if serr.Data == nil {
+		t.Error("Register Feed: expected the encoding error as data")
+	}
+
+	// The service was not published
+	if err := s.Register(new(Feed)); err != nil {
+		t.Errorf("expected Feed to be left unregistered got %v", err)
+	}
+}
+
+type Ledger struct {
+	charges int32
+}
+
+func (l *Ledger) Charge(args Args, reply *Reply) error {
+	reply.C = int(atomic.AddInt32(&l.charges, 1)) * args.A
+	return nil
+}
+
+func TestJson2RPC_Idempotent(t *testing.T) {
+	s := rpc.NewServer()
+	ledger := new(Ledger)
+	s.Register(ledger)
+	s.SetResultCache(rpc.NewMemoryCache(time.Minute))
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	clients := map[string]rpc.Client{
+		"http":   NewClientHTTP(ts.URL, "/"),
+		"inproc": NewInProcClient(s),
+	}
+
+	for name, c := range clients {
+		key := "charge-" + name
+		before := atomic.LoadInt32(&ledger.charges)
+
+		var first, retry Reply
+		result := c.Call("Ledger.Charge", Idempotent(key, &Args{10, 0}), &first)
+		<- result.Done
+		if result.Error != nil {
+			t.Fatalf("%s: Charge: unexpected error %v", name, result.Error)
+		}
+
+		result = c.Call("Ledger.Charge", Idempotent(key, &Args{10, 0}), &retry)
+		<- result.Done
+		if result.Error != nil {
+			t.Fatalf("%s: Charge retried: unexpected error %v", name, result.Error)
+		}
+
+		if n := atomic.LoadInt32(&ledger.charges) - before; n != 1 {
+			t.Errorf("%s: expected the method to run once got %d", name, n)
+		}
+		if retry != first {
+			t.Errorf("%s: expected the retry to get %+v got %+v", name, first, retry)
+		}
+
+		// The key is refused for a charge of another amount
+		var other Reply
+		result = c.Call("Ledger.Charge", Idempotent(key, &Args{20, 0}), &other)
+		<- result.Done
+		if result.Error == nil || result.Error.Code != rpc.ERR_INVALID_REQ {
+			t.Errorf("%s: Charge with other params: expected ERR_INVALID_REQ got %v", name, result.Error)
+		}
+		if n := atomic.LoadInt32(&ledger.charges) - before; n != 1 {
+			t.Errorf("%s: expected the method to run once got %d", name, n)
+		}
+	}
+}
+
+func TestJson2RPC_BalancedRoundRobin(t *testing.T) {
+	a := newWhoamiServer("a", nil)
+	defer a.Close()
+	b := newWhoamiServer("b", nil)
+	defer b.Close()
+
+	c := NewClientHTTPBalanced([]string{a.URL, b.URL}, "/", RoundRobin)
+
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		name, err := callName(c, "Whoami.Name")
+		if err != nil {
+			t.Fatalf("Name: expected no error but got string %q", err.Error())
+		}
+		seen[name]++
+	}
+
+	if seen["a"] != 3 || seen["b"] != 3 {
+		t.Errorf("expected calls spread evenly got %v", seen)
+	}
+}
+
+func TestJson2RPC_BalancedLeastPending(t *testing.T) {
+	release := make(chan struct{})
+
+	a := newWhoamiServer("a", release)
+	defer a.Close()
+	b := newWhoamiServer("b", release)
+	defer b.Close()
+
+	c := NewClientHTTPBalanced([]string{a.URL, b.URL}, "/", LeastPending)
+
+	var slow string
+	result := c.Call("Whoami.Slow", &Args{}, &slow)
+
+	// While the slow call is pending all calls go to the other backend
+	first, _ := callName(c, "Whoami.Name")
+	for i := 0; i < 3; i++ {
+		name, err := callName(c, "Whoami.Name")
+		if err != nil {
+			t.Fatalf("Name: expected no error but got string %q", err.Error())
+		}
+		if name != first {
+			t.Errorf("expected all calls on %q got one on %q", first, name)
+		}
+	}
+
+	close(release)
+	<- result.Done
+
+	if slow == first {
+		t.Errorf("expected the slow call on the other backend than %q", first)
+	}
+}
+
+func TestJson2RPC_BalancedSkipsFailed(t *testing.T) {
+	live := newWhoamiServer("live", nil)
+	defer live.Close()
+	// Stays bound, so its port can't be taken by another server, but drops
+	// every connection without an answer.
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer dead.Close()
+
+	c := NewClientHTTPBalanced([]string{dead.URL, live.URL}, "/", RoundRobin)
+
+	failures := 0
+	for i := 0; i < 6; i++ {
+		name, err := callName(c, "Whoami.Name")
+		if err != nil {
+			failures++
+		} else if name != "live" {
+			t.Errorf("expected the live backend got %q", name)
+		}
+	}
+
+	if failures != 1 {
+		t.Errorf("expected the dead backend to fail once and be skipped, failed %d times", failures)
+	}
+}
+
+// Waits for the number of goroutines to drop to at most n, returning it.
+func waitGoroutines(n int) int {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return runtime.NumGoroutine()
+}
+
+func TestJson2RPC_ClientClose(t *testing.T) {
+	once.Do(startServer)
+
+	// Clients start no goroutine until they are called
+	before := runtime.NumGoroutine()
+	clients := make([]rpc.Client, 50)
+	for i := range clients {
+		clients[i] = NewClientHTTP(testHttpSrv.URL, "/")
+	}
+	if n := runtime.NumGoroutine(); n > before + 5 {
+		t.Errorf("expected no goroutine per idle client, %d before and %d after", before, n)
+	}
 
-	// Nonexistent method
-	args = &Args{7, 0}
-	result = c.Call("Arith.BadOperation", args, &reply)
+	for _, c := range clients {
+		var reply Reply
+		result := c.Call("Arith.Add", &Args{1, 2}, &reply)
+		<- result.Done
+		if result.Error != nil {
+			t.Fatalf("Add: expected no error but got string %q", result.Error.Error())
+		}
+	}
+	if n := runtime.NumGoroutine(); n < before + len(clients) {
+		t.Errorf("expected a sender per client called, %d before and %d after", before, n)
+	}
+
+	// and stop their sender once closed
+	for _, c := range clients {
+		c.Close()
+	}
+	if n := waitGoroutines(before + 10); n > before + 10 {
+		t.Errorf("expected the senders to stop, %d before and %d after", before, n)
+	}
+
+	var reply Reply
+	result := clients[0].Call("Arith.Add", &Args{1, 2}, &reply)
 	<- result.Done
+	if result.Error != ErrClientClosed {
+		t.Errorf("Add: expected ErrClientClosed got %v", result.Error)
+	}
+}
 
-	// expect an error
-	if result.Error == nil {
-		t.Error("BadOperation: expected error")
-	} else if result.Error.Code != rpc.ERR_NO_METHOD {
-		t.Errorf("BadOperation: expected can't find method error; got %q", result.Error)
+func TestJson2RPC_StatusError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "<html><body>Internal Server Error</body></html>")
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/rpc", http.StatusFound)
+	})
+	reached := int32(0)
+	mux.HandleFunc("/rpc", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reached, 1)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for path, code := range map[string]int{"/broken": http.StatusInternalServerError, "/moved": http.StatusFound} {
+		var reply Reply
+		result := NewClientHTTP(ts.URL, path).Call("Arith.Add", &Args{1, 2}, &reply)
+		<- result.Done
+
+		var serr *StatusError
+		if !errors.As(result.Error, &serr) {
+			t.Errorf("%s: expected a StatusError got %v", path, result.Error)
+			continue
+		}
+		if serr.StatusCode != code {
+			t.Errorf("%s: expected status %d got %d", path, code, serr.StatusCode)
+		}
+	}
+
+	if n := atomic.LoadInt32(&reached); n != 0 {
+		t.Errorf("expected the redirect not to be followed, reached %d times", n)
 	}
 }
 
-func TestJson2RPC_UnknownService(t *testing.T) {
-	var args *Args
-	var result *rpc.CallResult
+func TestJson2RPC_TransportError(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	ts := httptest.NewServer(NewHandler(s))
+
 	var reply Reply
+	c := NewClientHTTP(ts.URL, "/")
 
-	once.Do(startServer)
+	// The server rejects the call
+	result := c.Call("Arith.Div", &Args{1, 0}, &reply)
+	<- result.Done
+	if result.TransportError != nil {
+		t.Errorf("Div: expected no transport error got %v", result.TransportError)
+	}
+	if result.Error == nil || result.Error.Message != "divide by zero" {
+		t.Errorf("Div: expected divide by zero got %v", result.Error)
+	}
 
-	c := NewClientHTTP(testHttpSrv.URL, "/")
+	// and serves the others
+	result = c.Call("Arith.Add", &Args{1, 2}, &reply)
+	<- result.Done
+	if result.TransportError != nil || result.Error != nil {
+		t.Errorf("Add: expected success got %v, %v", result.TransportError, result.Error)
+	}
 
-	// Unknown service
-	args = &Args{7, 8}
-	result = c.Call("Arith.Unknown", args, &reply)
+	// The server can't be reached
+	ts.Close()
+	result = c.Call("Arith.Add", &Args{1, 2}, &reply)
 	<- result.Done
+	if result.TransportError == nil {
+		t.Error("Add: expected a transport error")
+	}
+	if result.Error == nil || result.Error.Code != rpc.ERR_INTERNAL || !errors.Is(result.Error, result.TransportError) {
+		t.Errorf("Add: expected an internal error wrapping the transport error got %v", result.Error)
+	}
+	var serr *StatusError
+	if errors.As(result.TransportError, &serr) {
+		t.Errorf("Add: expected a network error got %v", serr)
+	}
 
-	if result.Error == nil {
-		t.Error("expected error calling unknown service")
-	} else if result.Error.Code != rpc.ERR_NO_METHOD {
-		t.Error("expected error about method; got", result.Error)
+	// Error pages are transport errors too
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer broken.Close()
+
+	result = NewClientHTTP(broken.URL, "/").Call("Arith.Add", &Args{1, 2}, &reply)
+	<- result.Done
+	if !errors.As(result.TransportError, &serr) || serr.StatusCode != http.StatusBadGateway {
+		t.Errorf("Add: expected a 502 StatusError got %v", result.TransportError)
 	}
 }
 
-func TestJson2RPC_MethodErrorMessage(t *testing.T) {
-	var args *Args
-	var result *rpc.CallResult
+// flakyHandler fails every call with a non JSON-RPC response while down
+// is set, and counts the calls that reach it.
+type flakyHandler struct {
+	http.Handler
+	down  int32
+	calls int32
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&h.calls, 1)
+	if atomic.LoadInt32(&h.down) != 0 {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func TestJson2RPC_Breaker(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(&Whoami{"server", nil})
+	flaky := &flakyHandler{Handler: NewHandler(s), down: 1}
+	ts := httptest.NewServer(flaky)
+	defer ts.Close()
+
+	const cooldown = 50 * time.Millisecond
+	breaker := NewBreaker(2, cooldown)
+	c := NewClientHTTP(ts.URL, "/", WithBreaker(breaker))
+
+	expectState := func(want BreakerState) {
+		if got := breaker.State(); got != want {
+			t.Fatalf("expected breaker %s got %s", want, got)
+		}
+	}
+
+	// closed -> open after two consecutive failures
+	for i := 0; i < 2; i++ {
+		expectState(BreakerClosed)
+		if _, err := callName(c, "Whoami.Name"); err == nil || err == ErrBreakerOpen {
+			t.Fatalf("call %d: expected a transport error got %v", i, err)
+		}
+	}
+	expectState(BreakerOpen)
+
+	// open: calls fail fast without reaching the server
+	if _, err := callName(c, "Whoami.Name"); err != ErrBreakerOpen {
+		t.Fatalf("expected ErrBreakerOpen got %v", err)
+	}
+	if n := atomic.LoadInt32(&flaky.calls); n != 2 {
+		t.Errorf("expected 2 calls to reach the server got %d", n)
+	}
+
+	// open -> half-open after the cooldown, a failed probe reopens it
+	time.Sleep(cooldown + 10*time.Millisecond)
+	expectState(BreakerHalfOpen)
+	if _, err := callName(c, "Whoami.Name"); err == nil || err == ErrBreakerOpen {
+		t.Fatalf("expected the probe to fail got %v", err)
+	}
+	expectState(BreakerOpen)
+
+	// half-open -> closed after a successful probe
+	time.Sleep(cooldown + 10*time.Millisecond)
+	expectState(BreakerHalfOpen)
+	atomic.StoreInt32(&flaky.down, 0)
+	if name, err := callName(c, "Whoami.Name"); err != nil || name != "server" {
+		t.Fatalf("expected the probe to succeed got %q, %v", name, err)
+	}
+	expectState(BreakerClosed)
+
+	// errors returned by the server don't count as failures
+	for i := 0; i < 3; i++ {
+		if _, err := callName(c, "Whoami.Unknown"); err == nil || err == ErrBreakerOpen {
+			t.Fatalf("expected a server error got %v", err)
+		}
+	}
+	expectState(BreakerClosed)
+}
+
+// A probe call given up by its caller doesn't keep the breaker from
+// letting the next one through.
+func TestJson2RPC_BreakerCancelledProbe(t *testing.T) {
+	s := rpc.NewServer()
+	s.Register(&Whoami{"server", nil})
+	h := NewHandler(s)
+
+	const (
+		failing = iota
+		hanging
+		serving
+	)
+	var mode int32 = failing
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.LoadInt32(&mode) {
+		case failing:
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		case hanging:
+			<- release
+		default:
+			h.ServeHTTP(w, r)
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	const cooldown = 20 * time.Millisecond
+	breaker := NewBreaker(1, cooldown)
+	c := NewClientHTTP(ts.URL, "/", WithBreaker(breaker))
+
+	if _, err := callName(c, "Whoami.Name"); err == nil || err == ErrBreakerOpen {
+		t.Fatalf("expected a transport error got %v", err)
+	}
+	time.Sleep(cooldown + 10 * time.Millisecond)
+
+	// The single call batches make goes through the breaker the same way
+	for _, batch := range []bool{false, true} {
+		atomic.StoreInt32(&mode, hanging)
+		ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Millisecond)
+		var name string
+		var result *rpc.CallResult
+		if batch {
+			result = c.(BatchClient).CallBatchContext(ctx, []BatchCall{{"Whoami.Name", &Args{}, &name}})[0]
+		} else {
+			result = c.CallContext(ctx, "Whoami.Name", &Args{}, &name)
+		}
+		<- result.Done
+		cancel()
+		if !errors.Is(result.TransportError, context.DeadlineExceeded) {
+			t.Fatalf("batch %v: expected the probe to be given up got %v", batch, result.Error)
+		}
+		if state := breaker.State(); state != BreakerHalfOpen {
+			t.Fatalf("batch %v: expected breaker half-open got %s", batch, state)
+		}
+	}
+
+	atomic.StoreInt32(&mode, serving)
+	if name, err := callName(c, "Whoami.Name"); err != nil || name != "server" {
+		t.Fatalf("expected the next probe to go through got %q, %v", name, err)
+	}
+	if state := breaker.State(); state != BreakerClosed {
+		t.Errorf("expected breaker closed got %s", state)
+	}
+}
+
+// bufferConn is an in-memory connection: writes go to out, reads come
+// from in.
+type bufferConn struct {
+	in, out bytes.Buffer
+}
+
+func (c *bufferConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *bufferConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+func (c *bufferConn) Close() error                { return nil }
+
+func TestJson2RPC_ClientCodec(t *testing.T) {
+	conn := new(bufferConn)
+	codec := NewClientCodec(conn)
+
+	if err := codec.WriteRequest("Arith.Add", 7, &Args{1, 2}); err != nil {
+		t.Fatal("WriteRequest:", err)
+	}
+
+	want := `{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":1,"B":2},"id":7}`
+	if got := strings.TrimSpace(conn.out.String()); got != want {
+		t.Errorf("WriteRequest: expected %s got %s", want, got)
+	}
+
+	conn.in.WriteString(`{"jsonrpc":"2.0","id":7,"result":{"C":3}}`)
+	conn.in.WriteString(`{"jsonrpc":"2.0","id":8,"error":{"code":-32601,"message":"no method"}}`)
+
 	var reply Reply
+	resp := rpc.Response{Reply: &reply}
+	if err := codec.ReadResponse(&resp); err != nil {
+		t.Fatal("ReadResponse:", err)
+	}
+	if resp.Seq != 7 || resp.ServiceMethod != "Arith.Add" || resp.Error != nil || reply.C != 3 {
+		t.Errorf("ReadResponse: unexpected response %+v with reply %+v", resp, reply)
+	}
 
-	once.Do(startServer)
+	resp = rpc.Response{}
+	if err := codec.ReadResponse(&resp); err != nil {
+		t.Fatal("ReadResponse:", err)
+	}
+	if resp.Seq != 8 || resp.Error == nil || resp.Error.Code != rpc.ERR_NO_METHOD {
+		t.Errorf("ReadResponse: expected method not found error got %+v", resp)
+	}
+}
 
-	c := NewClientHTTP(testHttpSrv.URL, "/")
+// countingJSON is encoding/json counting the encoders and decoders made.
+type countingJSON struct {
+	stdJSON
+	encoders, decoders int32
+}
 
-	// Error test
-	args = &Args{7, 0}
-	result = c.Call("Arith.Div", args, &reply)
+func (j *countingJSON) NewEncoder(w io.Writer) Encoder {
+	atomic.AddInt32(&j.encoders, 1)
+	return j.stdJSON.NewEncoder(w)
+}
+
+func (j *countingJSON) NewDecoder(r io.Reader) Decoder {
+	atomic.AddInt32(&j.decoders, 1)
+	return j.stdJSON.NewDecoder(r)
+}
+
+func TestJson2RPC_SetJSON(t *testing.T) {
+	impl := new(countingJSON)
+	SetJSON(impl)
+	t.Cleanup(func() { SetJSON(nil) })
+
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	var reply Reply
+	result := NewClientHTTP(ts.URL, "/").Call("Arith.Add", &Args{1, 2}, &reply)
 	<- result.Done
+	if result.Error != nil || reply.C != 3 {
+		t.Fatalf("Add: expected 3 got %d, %v", reply.C, result.Error)
+	}
 
-	// expect an error: zero divide
-	if result.Error == nil {
-		t.Error("Div: expected error")
-	} else if result.Error.Message != "divide by zero" {
-		t.Error("Div: expected divide by zero error; got", result.Error)
+	// The client encodes the request and decodes the response, the
+	// handler the other way around.
+	if enc, dec := atomic.LoadInt32(&impl.encoders), atomic.LoadInt32(&impl.decoders); enc < 2 || dec < 2 {
+		t.Errorf("expected the JSON set to be used, got %d encoders and %d decoders", enc, dec)
+	}
+}
+
+// rewordedJSON is encoding/json whose decoders wrap the errors they
+// report, as other JSON implementations word theirs differently.
+type rewordedJSON struct {
+	stdJSON
+}
+
+func (rewordedJSON) NewDecoder(r io.Reader) Decoder {
+	return rewordedDecoder{json.NewDecoder(r)}
+}
+
+type rewordedDecoder struct {
+	*json.Decoder
+}
+
+func (d rewordedDecoder) Decode(v interface{}) error {
+	err := d.Decoder.Decode(v)
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return fmt.Errorf("jsonx: %w", err)
+}
+
+func TestJson2RPC_StrictJSON(t *testing.T) {
+	SetJSON(rewordedJSON{})
+	t.Cleanup(func() { SetJSON(nil) })
+
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	ts := httptest.NewServer(NewHandler(s, Strict()))
+	defer ts.Close()
+
+	body := `{"jsonrpc":"2.0","method":"Arith.Add","parms":{"A":1,"B":2},"params":{},"id":1}`
+	resp, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Error *jsonError
+	}
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if err != nil || out.Error == nil || out.Error.Code != rpc.ERR_INVALID_REQ {
+		t.Errorf("expected the unknown member rejected got %+v, %v", out.Error, err)
+	}
+
+	// and so do strict clients the unknown fields of replies
+	g := rpc.NewServer()
+	g.RegisterName("Arith", new(Grocer))
+	gs := httptest.NewServer(NewHandler(g))
+	defer gs.Close()
+
+	result := NewClientHTTP(gs.URL, "/", StrictReplies()).Call("Arith.Add", &Args{1, 2}, &Reply{})
+	<- result.Done
+	if result.Error == nil || result.Error.Code != rpc.ERR_INTERNAL || result.TransportError != nil {
+		t.Errorf("Add: expected a reply mismatch error got %v, %v", result.Error, result.TransportError)
+	}
+}
+
+// noEscapeJSON is encoding/json leaving HTML characters unescaped.
+type noEscapeJSON struct {
+	stdJSON
+}
+
+func (noEscapeJSON) NewEncoder(w io.Writer) Encoder {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc
+}
+
+type Item struct {
+	ID    int
+	Name  string
+	Tags  []string
+	Price float64
+}
+
+// Encodes a reply of about 1MB with the JSON implementations at hand;
+// add one, jsoniter for instance, to compare it with encoding/json.
+func BenchmarkWriteResponseLarge(b *testing.B) {
+	page := make([]Item, 10000)
+	for i := range page {
+		page[i] = Item{ID: i, Name: fmt.Sprintf("<item %d>", i), Tags: []string{"a", "b", "c"}, Price: float64(i) / 3}
+	}
+	jreq := &srvRequest{Version: "2.0", Id: json.RawMessage("1"), Method: "Shop.List"}
+
+	impls := []struct {
+		name string
+		impl JSON
+	}{
+		{"encoding/json", stdJSON{}},
+		{"encoding/json no escaping", noEscapeJSON{}},
+	}
+	for _, tt := range impls {
+		b.Run(tt.name, func(b *testing.B) {
+			SetJSON(tt.impl)
+			defer SetJSON(nil)
+
+			var buf bytes.Buffer
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := writeResponse(&buf, jreq, rpc.NewResult(page, nil)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.SetBytes(int64(buf.Len()))
+		})
 	}
 }
 
@@ -188,6 +3726,26 @@ func BenchmarkServeRequest(b *testing.B) {
 	}	
 }
 
+func BenchmarkServeRequestInProc(b *testing.B) {
+	s := rpc.NewServer()
+	s.Register(new(Arith))
+	c := NewInProcClient(s)
+
+	args := &Args{7, 0}
+	b.ResetTimer()
+
+	var reply Reply
+
+	for i := 0; i < b.N; i++ {
+		result := c.Call("Arith.Add", args, &reply)
+		<- result.Done
+
+		if result.Error != nil {
+			b.Fatalf("Add: expected no error but got string %q", result.Error.Error())
+		}
+	}
+}
+
 func BenchmarkServeRequestParallel(b *testing.B) {
 	once.Do(startServer)
 
@@ -214,54 +3772,35 @@ func BenchmarkServeRequestParallel(b *testing.B) {
 	})
 
 }
-/*
 func BenchmarkServeRequestAsync(b *testing.B) {
 	const MaxConcurrentCalls = 100
 	once.Do(startServer)
 
-	args  := &Args{7, 0}
-	procs := 4 * runtime.GOMAXPROCS(-1)
-	send  := int32(b.N)
-	recv  := int32(b.N)
-
+	args := &Args{7, 0}
 	gate := make(chan bool, MaxConcurrentCalls)
-	//res := make(chan *rpc.CallResult, MaxConcurrentCalls)
 
 	c := NewClientHTTP(testHttpSrv.URL, "/")
 
-	var (
-		result *rpc.CallResult
-		wg sync.WaitGroup
-	)
-	wg.Add(procs)
-
+	var wg sync.WaitGroup
 	b.ResetTimer()
 
-	for p := 0; p < procs; p++ {
-		go func() {
-			for atomic.AddInt32(&send, -1) >= 0 {
-				gate <- true
+	for i := 0; i < b.N; i++ {
+		gate <- true
+		wg.Add(1)
 
-				reply := new(Reply)
-				result = c.Call("Arith.Add", args, reply)
-			}
-		}()
+		// Every call in flight needs a reply of its own, see rpc.Client.
+		result := c.Call("Arith.Add", args, new(Reply))
 		go func() {
-			for call := range result.Done {
-				A := call.Args.(*Args).A
-				B := call.Args.(*Args).B
-				C := call.Reply.(*Reply).C
-				if A+B != C {
-					b.Fatalf("incorrect reply: Add: expected %d got %d", A+B, C)
-				}
-				<-gate
-				if atomic.AddInt32(&recv, -1) == 0 {
-					close(result.Done)
-				}
+			defer wg.Done()
+
+			call := <-result.Done
+			if call.Error != nil {
+				b.Errorf("Add: expected no error but got string %q", call.Error.Error())
+			} else if C := call.Reply.(*Reply).C; C != args.A + args.B {
+				b.Errorf("incorrect reply: Add: expected %d got %d", args.A + args.B, C)
 			}
-			wg.Done()
+			<-gate
 		}()
 	}
 	wg.Wait()
-}
-*/
\ No newline at end of file
+}
\ No newline at end of file
@@ -0,0 +1,131 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"sync"
+
+	"github.com/entuerto/av-vortex/rpc"
+)
+
+// Built-in methods, served by the handler itself under the "system"
+// service rather than by the server's workers. Every handler serves them;
+// like other methods they can be hidden with DenyMethods.
+var systemMethods map[string]func(h *Handler, jreq *srvRequest) (interface{}, error)
+
+func init() {
+	// Set in init as methodExists refers back to the table.
+	systemMethods = map[string]func(h *Handler, jreq *srvRequest) (interface{}, error){
+		"system.methodExists": (*Handler).methodExists,
+		"system.ping":         (*Handler).ping,
+		"system.capabilities": (*Handler).capabilities,
+		"system.cancel":       (*Handler).cancel,
+	}
+}
+
+// MethodArgs are the params of the built-in methods taking a method name,
+// {"method": "Service.Method"} or ["Service.Method"].
+type MethodArgs struct {
+	Method string `json:"method"`
+}
+
+// system.methodExists reports whether the handler would serve a call to
+// the method, without calling it.
+func (h *Handler) methodExists(jreq *srvRequest) (interface{}, error) {
+	var args MethodArgs
+	if err := jreq.DecodeParams(&args); err != nil {
+		return nil, rpc.NewServerError(rpc.ERR_BAD_PARAMS, rpc.ErrInvalidParams.Message, err.Error())
+	}
+
+	service, method, err := h.resolveMethod(args.Method)
+	if err != nil || !h.exposes(args.Method) {
+		return false, nil
+	}
+	if _, builtin := systemMethods[args.Method]; builtin {
+		return true, nil
+	}
+	return h.HasMethod(service, method), nil
+}
+
+// system.ping answers "pong", so that clients can check the whole path of
+// a call, encoding and dispatch included.
+func (h *Handler) ping(jreq *srvRequest) (interface{}, error) {
+	return "pong", nil
+}
+
+// Capabilities describes the features a handler supports, as answered by
+// system.capabilities.
+type Capabilities struct {
+	Batch         bool     `json:"batch"`         // arrays of calls in one request
+	Notifications bool     `json:"notifications"` // calls without an id
+	Streaming     bool     `json:"streaming"`     // results sent in parts
+	Compression   []string `json:"compression"`   // content codings of responses, see CompressAbove
+	MaxBodySize   int64    `json:"maxBodySize"`   // largest request body in bytes, 0 for no limit
+}
+
+// system.capabilities describes the features of the handler.
+func (h *Handler) capabilities(jreq *srvRequest) (interface{}, error) {
+	caps := Capabilities{
+		Batch:         true,
+		Notifications: true,
+		Compression:   []string{},
+	}
+	if h.compress {
+		caps.Compression = append(caps.Compression, "gzip")
+	}
+	return caps, nil
+}
+
+// Returns the capabilities of the handler behind c, fetched with
+// system.capabilities on the first successful call, then remembered.
+func fetchCapabilities(c rpc.Client, cache *capabilitiesCache) (Capabilities, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.caps != nil {
+		return *cache.caps, nil
+	}
+
+	var caps Capabilities
+	result := c.Call("system.capabilities", nil, &caps)
+	<- result.Done
+	if result.Error != nil {
+		return caps, result.Error
+	}
+
+	cache.caps = &caps
+	return caps, nil
+}
+
+// capabilitiesCache keeps the capabilities fetched by a client.
+type capabilitiesCache struct {
+	mutex sync.Mutex
+	caps  *Capabilities
+}
+
+// CapabilitiesClient is implemented by the json2 clients, which learn the
+// capabilities of the server they call with system.capabilities:
+//
+//	caps, err := c.(json2.CapabilitiesClient).Capabilities()
+type CapabilitiesClient interface {
+	rpc.Client
+
+	// Capabilities returns the capabilities of the server, asked on the
+	// first call and remembered after that.
+	Capabilities() (Capabilities, error)
+}
+
+// Runs jreq, on a built-in method or on the server.
+func (h *Handler) dispatch(jreq *srvRequest) *rpc.Result {
+	if method, builtin := systemMethods[jreq.Method]; builtin {
+		return rpc.NewResult(method(h, jreq))
+	}
+
+	req, result := h.intercept(jreq)
+	if result != nil {
+		return result
+	}
+	return h.Dispatch(req) // this blocks
+}
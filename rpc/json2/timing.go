@@ -0,0 +1,107 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/entuerto/av-vortex/rpc"
+)
+
+// ServerTimingHeader is the HTTP header reporting the timing of a call,
+// as the durations in milliseconds of its "queue" wait and its "exec":
+//
+//	Server-Timing: queue;dur=0.042, exec;dur=1.317
+const ServerTimingHeader = "Server-Timing"
+
+// ServerTiming makes the handler report how long the server took over each
+// call in the Server-Timing header of its response, see rpc.CallTiming.
+// The json2 clients expose it as the Timing of their CallResult. Batches,
+// whose calls share a response, and notifications are not reported.
+func ServerTiming() HandlerOption {
+	return func(h *Handler) {
+		h.timing = true
+	}
+}
+
+// callTiming holds the timing of a call, recorded by the worker that
+// served it.
+type callTiming struct {
+	mutex sync.Mutex
+	t     *rpc.CallTiming
+}
+
+func (c *callTiming) set(t rpc.CallTiming) {
+	c.mutex.Lock()
+	c.t = &t
+	c.mutex.Unlock()
+}
+
+// Returns the timing recorded, nil if none was.
+func (c *callTiming) get() *rpc.CallTiming {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.t
+}
+
+// RecordTiming keeps the timing of the call when the handler reports it,
+// see rpc.TimingRecorder.
+func (r srvRequest) RecordTiming(t rpc.CallTiming) {
+	if r.timing != nil {
+		r.timing.set(t)
+	}
+}
+
+// Formats t as the value of the Server-Timing header.
+func formatServerTiming(t *rpc.CallTiming) string {
+	return fmt.Sprintf("queue;dur=%.3f, exec;dur=%.3f", milliseconds(t.Wait), milliseconds(t.Exec))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Parses the value of a Server-Timing header into the timing of a call,
+// nil if it reports neither queue nor exec.
+func parseServerTiming(header string) *rpc.CallTiming {
+	var t rpc.CallTiming
+	found := false
+
+	for _, metric := range strings.Split(header, ",") {
+		params := strings.Split(strings.TrimSpace(metric), ";")
+
+		var d *time.Duration
+		switch strings.TrimSpace(params[0]) {
+		case "queue":
+			d = &t.Wait
+		case "exec":
+			d = &t.Exec
+		default:
+			continue
+		}
+
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "dur=") {
+				continue
+			}
+			ms, err := strconv.ParseFloat(param[len("dur="):], 64)
+			if err != nil {
+				continue
+			}
+			*d = time.Duration(ms * float64(time.Millisecond))
+			found = true
+		}
+	}
+
+	if !found {
+		return nil
+	}
+	return &t
+}
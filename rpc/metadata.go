@@ -0,0 +1,84 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"strings"
+)
+
+// Metadata are key/value pairs a call carries besides its args, such as a
+// trace id or the locale of the caller. Clients attach them to the context
+// of the call with WithMetadata; transports carry them, as headers over
+// HTTP, and methods taking a context read them with MetadataFromContext.
+// Keys are case-insensitive and reach methods in lower case.
+type Metadata map[string]string
+
+// MetadataCarrier is implemented by requests that carry metadata. Requests
+// that don't implement it have none.
+type MetadataCarrier interface {
+	Metadata() Metadata
+}
+
+// WithMetadata returns a copy of ctx with md attached, to be sent with the
+// calls made with the context. Keys already attached to ctx are kept
+// unless md sets them again.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	merged := make(Metadata)
+	for k, v := range OutgoingMetadata(ctx) {
+		merged[k] = v
+	}
+	for k, v := range md {
+		merged[strings.ToLower(k)] = v
+	}
+	return context.WithValue(ctx, outgoingMetadataKey, merged)
+}
+
+// OutgoingMetadata returns the metadata attached to ctx with WithMetadata,
+// for transports to send with a call, or nil. It is not to be modified.
+func OutgoingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(outgoingMetadataKey).(Metadata)
+	return md
+}
+
+// MetadataFromContext returns the metadata of the call a method is
+// serving, or nil when the call has none. It is not to be modified. The
+// metadata are not sent along with the calls the method makes with the
+// context, unless attached with WithMetadata.
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey).(Metadata)
+	return md
+}
+
+// ForwardContext returns the context for the calls a method makes on
+// behalf of the one it serves, ctx being the context the method was
+// handed: the calls share its deadline and are cancelled along with it,
+// and carry its metadata, a trace id among them, on top of those already
+// attached with WithMetadata.
+func ForwardContext(ctx context.Context) context.Context {
+	md := MetadataFromContext(ctx)
+	if len(md) == 0 {
+		return ctx
+	}
+	return WithMetadata(ctx, md)
+}
+
+// Returns the metadata of req with their keys in lower case, or nil.
+func requestMetadata(req Request) Metadata {
+	r, ok := req.(MetadataCarrier)
+	if !ok {
+		return nil
+	}
+	md := r.Metadata()
+	if len(md) == 0 {
+		return nil
+	}
+
+	lower := make(Metadata, len(md))
+	for k, v := range md {
+		lower[strings.ToLower(k)] = v
+	}
+	return lower
+}
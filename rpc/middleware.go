@@ -0,0 +1,26 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+// An ArgsMiddleware observes the args of a call once they are decoded and
+// before the method runs. args holds the value the method will receive,
+// such as Args or *Args as declared by the method, or nil for methods
+// that take none; req tells which method it is. Returning an error rejects
+// the call, the method is not run and the error is answered as if the
+// method returned it.
+//
+// Middleware run on the worker serving the call and must be safe for
+// concurrent use. They must not retain args once they return.
+type ArgsMiddleware func(req Request, args interface{}) error
+
+// Runs the middleware in order, stopping at the first one rejecting args.
+func runArgsMiddleware(middleware []ArgsMiddleware, req Request, args interface{}) error {
+	for _, m := range middleware {
+		if err := m(req, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
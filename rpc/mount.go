@@ -0,0 +1,27 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+)
+
+// A Codec builds the HTTP handler serving the calls to a server in one
+// encoding, such as json2.NewCodec for JSON-RPC 2.0.
+type Codec func(srv *Server) http.Handler
+
+// MountAll exposes srv on mux once per route, each path served by the
+// handler its codec builds. The handlers share the server and its worker
+// pool, so that the same services answer in every encoding:
+//
+//	rpc.MountAll(mux, srv, map[string]rpc.Codec{
+//		"/rpc":        json2.NewCodec(),
+//		"/rpc-strict": json2.NewCodec(json2.Strict()),
+//	})
+func MountAll(mux *http.ServeMux, srv *Server, routes map[string]Codec) {
+	for path, codec := range routes {
+		mux.Handle(path, codec(srv))
+	}
+}
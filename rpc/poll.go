@@ -0,0 +1,247 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnsubscribed is returned by Subscription.Next once the subscription
+// is closed with Unsubscribe.
+var ErrUnsubscribed = NewServerError(ERR_SERVER, "RPC: subscription closed", nil)
+
+//-----------------------------------------------------------------------------
+// Long polls
+//-----------------------------------------------------------------------------
+
+// SetLongPoll serves the methods, named "Service.Method" as requested, as
+// long polls: methods blocking until an event is available. Each of their
+// calls runs on a goroutine of its own rather than on a worker, up to n
+// at once, so that blocked polls never starve the workers other calls
+// need. Calls beyond n wait for one to return, or until their context is
+// done. The last call sets n for all the long polls of the server.
+func (server *Server) SetLongPoll(n int, serviceMethods ...string) {
+	if n < 1 {
+		n = 1
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.polls == nil {
+		server.polls = make(map[string]bool)
+	}
+	for _, m := range serviceMethods {
+		server.polls[m] = true
+	}
+	server.pollSlots = make(chan struct{}, n)
+}
+
+// Returns the slots of the long polls when req calls one, nil otherwise.
+func (server *Server) longPoll(req Request) chan struct{} {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+
+	if !server.polls[req.ServiceName() + "." + req.MethodName()] {
+		return nil
+	}
+	return server.pollSlots
+}
+
+// Serves the long poll j on a goroutine of its own once one of slots is
+// free.
+func (server *Server) poll(j job, slots chan struct{}) {
+	go func() {
+		var result *Result
+
+		select {
+		case slots <- struct{}{}:
+			if requestExpired(j.req) {
+				result = NewResult(nil, ErrTimeout)
+			} else {
+				start := time.Now()
+				result = server.ServeRequest(j.req)
+				recordTiming(j.req, j.queued, start)
+			}
+			<-slots
+		case <-requestDone(j.req):
+			result = NewResult(nil, ErrTimeout)
+		}
+
+		j.sink.Deliver(j.req, result)
+		server.inflight.Done()
+		atomic.AddUint64(&server.served, 1)
+	}()
+}
+
+//-----------------------------------------------------------------------------
+// EventSource
+//-----------------------------------------------------------------------------
+
+// EventSource hands the events it is given to its subscribers, for
+// clients that can't keep a connection open to be pushed events. A client
+// subscribes first, then calls a long poll method again and again, each
+// call returning the next event of its subscription:
+//
+//	func (f *Feed) Subscribe(reply *string) error {
+//		*reply = f.events.Subscribe().ID
+//		return nil
+//	}
+//
+//	func (f *Feed) Next(ctx context.Context, id string, reply *Event) error {
+//		sub, ok := f.events.Lookup(id)
+//		if !ok {
+//			return errUnknownSubscription
+//		}
+//		ctx, cancel := context.WithTimeout(ctx, 30 * time.Second)
+//		defer cancel()
+//
+//		event, err := sub.Next(ctx)
+//		if err != nil {
+//			return err // ErrNoContent when no event came in time
+//		}
+//		*reply = event.(Event)
+//		return nil
+//	}
+//
+// with "Feed.Next" made a long poll with SetLongPoll. An EventSource is
+// safe for concurrent use.
+type EventSource struct {
+	buffer int // events a subscription holds
+	seq    uint64
+
+	mutex sync.Mutex
+	subs  map[string]*Subscription
+}
+
+// NewEventSource returns an EventSource whose subscriptions hold up to
+// buffer events not yet polled, dropping the oldest ones beyond.
+func NewEventSource(buffer int) *EventSource {
+	if buffer < 1 {
+		buffer = 1
+	}
+	return &EventSource{buffer: buffer, subs: make(map[string]*Subscription)}
+}
+
+// Subscribe adds a subscription, receiving the events published from now
+// on.
+func (s *EventSource) Subscribe() *Subscription {
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := &Subscription{
+		ID:     strconv.FormatUint(atomic.AddUint64(&s.seq, 1), 10),
+		ctx:    ctx,
+		cancel: cancel,
+		buffer: s.buffer,
+		ready:  make(chan struct{}, 1),
+	}
+
+	s.mutex.Lock()
+	s.subs[sub.ID] = sub
+	s.mutex.Unlock()
+	return sub
+}
+
+// Lookup returns the subscription with the given id, if any.
+func (s *EventSource) Lookup(id string) (*Subscription, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sub, ok := s.subs[id]
+	return sub, ok
+}
+
+// Unsubscribe closes the subscription with the given id: its context is
+// cancelled, and the poll waiting on it, if any, returns ErrUnsubscribed.
+// Subscriptions whose client went away must be closed, they are kept
+// otherwise.
+func (s *EventSource) Unsubscribe(id string) {
+	s.mutex.Lock()
+	sub, ok := s.subs[id]
+	delete(s.subs, id)
+	s.mutex.Unlock()
+
+	if ok {
+		sub.cancel()
+	}
+}
+
+// Publish hands event to every subscription.
+func (s *EventSource) Publish(event interface{}) {
+	s.mutex.Lock()
+	subs := make([]*Subscription, 0, len(s.subs))
+	for _, sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	s.mutex.Unlock()
+
+	for _, sub := range subs {
+		sub.push(event)
+	}
+}
+
+// Subscription is the queue of events of one subscriber of an
+// EventSource.
+type Subscription struct {
+	ID string // id to poll the subscription with, see EventSource.Lookup
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	buffer int
+
+	mutex  sync.Mutex
+	events []interface{}
+	ready  chan struct{} // signalled when events are pushed
+}
+
+// Context returns the context of the subscription, done once it is
+// closed, for methods to stop the work they do on its behalf.
+func (sub *Subscription) Context() context.Context {
+	return sub.ctx
+}
+
+// Next returns the oldest event not yet polled, waiting for one until ctx
+// is done, which returns ErrNoContent, or the subscription closed, which
+// returns ErrUnsubscribed. A method returning ErrNoContent answers a null
+// result, telling the client to poll again.
+func (sub *Subscription) Next(ctx context.Context) (interface{}, error) {
+	for {
+		sub.mutex.Lock()
+		if len(sub.events) > 0 {
+			event := sub.events[0]
+			sub.events[0] = nil
+			sub.events = sub.events[1:]
+			sub.mutex.Unlock()
+			return event, nil
+		}
+		sub.mutex.Unlock()
+
+		select {
+		case <-sub.ready:
+		case <-sub.ctx.Done():
+			return nil, ErrUnsubscribed
+		case <-ctx.Done():
+			return nil, ErrNoContent
+		}
+	}
+}
+
+func (sub *Subscription) push(event interface{}) {
+	sub.mutex.Lock()
+	if len(sub.events) == sub.buffer {
+		sub.events[0] = nil
+		sub.events = sub.events[1:]
+	}
+	sub.events = append(sub.events, event)
+	sub.mutex.Unlock()
+
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"reflect"
+	"sync"
+)
+
+// valuePool recycles the args and reply values of method calls, keyed
+// by their type.
+type valuePool struct {
+	pools sync.Map // reflect.Type -> *sync.Pool
+}
+
+// Returns a pointer to a zero value of type t.
+func (p *valuePool) get(t reflect.Type) reflect.Value {
+	if tp, ok := p.pools.Load(t); ok {
+		if v := tp.(*sync.Pool).Get(); v != nil {
+			return reflect.ValueOf(v)
+		}
+	}
+	return reflect.New(t)
+}
+
+// Zeroes the value pointed to by v and makes it available to get. The
+// value is reset here, and not in get, so the pool never holds on to
+// data from a previous call.
+func (p *valuePool) put(v reflect.Value) {
+	t := v.Type().Elem()
+	v.Elem().Set(reflect.Zero(t))
+
+	tp, ok := p.pools.Load(t)
+	if !ok {
+		tp, _ = p.pools.LoadOrStore(t, new(sync.Pool))
+	}
+	tp.(*sync.Pool).Put(v.Interface())
+}
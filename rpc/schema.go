@@ -0,0 +1,152 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Schema is a JSON Schema describing the JSON encoding of a Go type.
+type Schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// MethodSchema describes the params and result of a method. Params is nil
+// for methods that take no arguments.
+type MethodSchema struct {
+	Params *Schema `json:"params"`
+	Result *Schema `json:"result"`
+}
+
+var (
+	typeOfTime          = reflect.TypeOf(time.Time{})
+	typeOfMarshaler     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	typeOfTextMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// Schema describes the methods registered in the server, keyed by the
+// "Service.Method" name clients call them with. Struct fields are named as
+// encoding/json names them, honoring json tags; fields that are neither
+// pointers nor tagged omitempty are required. Types with their own JSON
+// encoding are described by an empty schema, which accepts anything.
+func (server *Server) Schema() map[string]*MethodSchema {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+
+	schema := make(map[string]*MethodSchema)
+	for sname, service := range server.serviceMap {
+		for mname, m := range service.method {
+			ms := &MethodSchema{
+				Result: newSchema(m.replyType, make(map[reflect.Type]bool)),
+			}
+			if m.argsType != nil {
+				ms.Params = newSchema(m.argsType, make(map[reflect.Type]bool))
+			}
+			schema[sname + "." + mname] = ms
+		}
+	}
+	return schema
+}
+
+// Returns the schema of t. Structs in seen are being described already, a
+// reference back to one of them is described as a bare object.
+func newSchema(t reflect.Type, seen map[reflect.Type]bool) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == typeOfTime:
+		return &Schema{Type: "string", Format: "date-time"}
+	case reflect.PtrTo(t).Implements(typeOfMarshaler):
+		return &Schema{}
+	case reflect.PtrTo(t).Implements(typeOfTextMarshaler):
+		return &Schema{Type: "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return &Schema{Type: "integer"}
+
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+
+	case reflect.String:
+		return &Schema{Type: "string"}
+
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"} // base64 encoded
+		}
+		return &Schema{Type: "array", Items: newSchema(t.Elem(), seen)}
+
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: newSchema(t.Elem(), seen)}
+
+	case reflect.Struct:
+		if seen[t] {
+			return &Schema{Type: "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		addFields(s, t, seen)
+		return s
+	}
+
+	// Interfaces hold anything
+	return &Schema{}
+}
+
+// Adds the fields of struct t to s, flattening embedded structs as
+// encoding/json does.
+func addFields(s *Schema, t reflect.Type, seen map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, opts = tag[:comma], tag[comma:]
+		}
+
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			addFields(s, ft, seen)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = newSchema(f.Type, seen)
+		if f.Type.Kind() != reflect.Ptr && !strings.Contains(opts, ",omitempty") {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
@@ -14,36 +14,80 @@ Only methods that satisfy these criteria will be made available for remote acces
 other methods will be ignored:
 
 	- the method is exported.
-	- the method has two arguments, both exported (or builtin) types.
-	- the method's second argument is a pointer.
+	- the method has two arguments, both exported (or builtin) types,
+	  only the reply when it takes no arguments, or more than two when
+	  it takes several.
+	- the method's last argument is a pointer.
 	- the method has return type error.
 
 In effect, the method must look schematically like
 
 	func (t *T) MethodName(argType T1, replyType *T2) error
 
+A method may also take a context.Context before its arguments,
+
+	func (t *T) MethodName(ctx context.Context, argType T1, replyType *T2) error
+
+through which it can learn about the request it serves, such as its id
+with RequestIDFromContext. A method that needs no arguments may leave them out,
+
+	func (t *T) MethodName(replyType *T2) error
+
+in which case the params sent by the caller are ignored. One taking
+several arguments lists them before the reply,
+
+	func (t *T) MethodName(a T1, b T2, replyType *T3) error
+
+and gets them from the caller's params in order, as decoded into a struct
+whose fields Arg0, Arg1 and so on hold them; positional params fill it
+with transports, such as JSON-RPC, that support them.
+
 The method's first argument represents the arguments provided by the caller; the
 second argument represents the result parameters to be returned to the caller.
 The method's return value, if non-nil, is passed back as a string that the client
 sees as if created by errors.New.  If an error is returned, the reply parameter
-will not be sent back to the client.
+will not be sent back to the client.  A method with nothing to reply may return
+ErrNoContent, which succeeds with a null result.
 */
 package rpc
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
 )
 
 var (
 	ErrTypeNotExported   = NewServerError(ERR_SERVER, "RPC: type %s is not exported", nil)
+	ErrUnnamedType       = NewServerError(ERR_SERVER, "RPC: type %s has no name, use RegisterName", nil)
 	ErrAlreadyDefined    = NewServerError(ERR_SERVER, "RPC: service already defined: %s", nil)
 	ErrNoExportedMethods = NewServerError(ERR_SERVER, "RPC: type %s has no exported methods of suitable type", nil)
+	ErrInvalidName       = NewServerError(ERR_SERVER, "RPC: invalid service name: %q", nil)
+	ErrInvalidMethodName = NewServerError(ERR_SERVER, "RPC: invalid method name: %q", nil)
+	ErrNoSuchMethod      = NewServerError(ERR_SERVER, "RPC: no suitable method to rename: %s", nil)
+	ErrDuplicateMethod   = NewServerError(ERR_SERVER, "RPC: method name published twice: %s", nil)
+	ErrInvalidVersion    = NewServerError(ERR_SERVER, "RPC: invalid service version: %q", nil)
+	ErrNoSuchVersion     = NewServerError(ERR_SERVER, "RPC: service version not registered: %s", nil)
+	ErrNoSuchService     = NewServerError(ERR_SERVER, "RPC: service not registered: %s", nil)
+	ErrShutdown          = NewServerError(ERR_SERVER, "RPC: server is shutting down", nil)
+	ErrNotReady          = NewServerError(ERR_SERVER, "RPC: server is not ready", nil)
 )
 
 // Client request. When the client sends a request it is in
-// the format "Service.Method"
+// the format "Service.Method". Result is only used by Dispatch;
+// requests handed to DispatchTo may return nil. A channel buffered for
+// one result lets the worker move on without waiting for the reader.
+// DecodeParams may fail with a *ServerError describing the failure, which
+// is answered as is; other errors are answered as ERR_BAD_PARAMS.
 type Request interface {
 	ServiceName() string      
 	MethodName()  string    
@@ -55,6 +99,8 @@ type Request interface {
 type Result struct {
 	Value  interface{}
 	Error  error
+
+	pool *valuePool // owner of Value when value pooling is enabled
 }
 
 // Returns a new result structure
@@ -65,6 +111,18 @@ func NewResult(value interface{}, err error) *Result {
 	}
 }
 
+// Release hands the reply value back to the server for reuse. Transports
+// call it once the result has been encoded; neither the Result nor its
+// Value may be used afterwards. Release is a no-op unless value pooling
+// is enabled on the server.
+func (r *Result) Release() {
+	if r.pool != nil && r.Value != nil {
+		r.pool.put(reflect.ValueOf(r.Value))
+	}
+	r.pool = nil
+	r.Value = nil
+}
+
 //-----------------------------------------------------------------------------
 // Server
 //-----------------------------------------------------------------------------
@@ -73,19 +131,60 @@ var nWorkers = flag.Int("w", 10, "Number of workers")
 
 // Server represents an RPC Server.
 type Server struct {
-	mu          sync.RWMutex         // protects the serviceMap
+	served      uint64               // requests answered by the workers, first to keep it 64-bit aligned
+	busy        int32                // workers serving a request
+	unready     int32                // set while the server is not ready, see SetReady
+	queued      int32                // requests waiting for a worker
+
+	mu          sync.RWMutex         // protects the fields from serviceMap to pollSlots
 	serviceMap  ServiceMap
+	versions    map[string]string    // default version of versioned services
+	pool        *valuePool           // nil unless value pooling is enabled
+	mapErr      ErrorMapper          // translates method errors of every service, may be nil
+	timeout     time.Duration        // limit on the execution of methods, 0 for none
+	timeouts    map[string]time.Duration // overrides of timeout by "Service.Method"
+	strictCodes bool                 // coerce reserved error codes returned by methods
+	cache       ResultCache          // results of calls with an idempotency key, may be nil
+	keyed       keyedCalls           // calls with an idempotency key being served
+	middleware  []ArgsMiddleware     // run on the decoded args of every call
+	fallback    Fallback             // serves calls to unknown methods, may be nil
+	onPanic     PanicHandler         // answers the panics of methods, nil for the default
+	polls       map[string]bool      // "Service.Method" of the long polls, see SetLongPoll
+	pollSlots   chan struct{}        // long polls running
+
+	queues      []chan job           // one per worker, taking requests while it waits
+	shared      chan job             // drained by every worker
+	next        uint32               // round-robin position in queues
+	slots       []workerSlot         // what each worker is serving
+
+	drain       sync.RWMutex         // protects closing against inflight.Add
+	closing     bool                 // set by Shutdown, no more requests are queued
+	inflight    sync.WaitGroup       // requests queued and not yet answered
+	quit        chan struct{}        // closed to stop the workers
+	stop        sync.Once
+	forced      chan struct{}        // closed by a forced Shutdown
+	force       sync.Once
+}
 
-	RequestQueue chan Request
+// Stats is a snapshot of the activity of a server's worker pool.
+type Stats struct {
+	Queued  int    // requests waiting in the queue
+	Workers int    // workers in the pool
+	Busy    int    // workers serving a request
+	Idle    int    // workers waiting for a request
+	Served  uint64 // requests answered since the server started
 }
 
 // Return a new RPC server
 func NewServer() *Server {
 	srv := &Server{
 		serviceMap: make(ServiceMap),
+		versions:   make(map[string]string),
+		quit:       make(chan struct{}),
+		forced:     make(chan struct{}),
 	}
 
-	srv.RequestQueue = workerPool(srv, *nWorkers)
+	srv.shared, srv.queues, srv.slots = workerPool(srv, *nWorkers)
 	return srv
 }
 
@@ -93,8 +192,10 @@ func NewServer() *Server {
 // receiver value that satisfy the following conditions:
 //
 //	- exported method
-//	- two arguments, both of exported type
-//	- the second argument is a pointer
+//	- two arguments, both of exported type, only the reply, or
+//	  several args then the reply, optionally preceded by a
+//	  context.Context
+//	- the last argument is a pointer
 //	- one return value, of type error
 //
 // It returns an error if the receiver is not an exported type or has
@@ -107,11 +208,131 @@ func (server *Server) Register(rcvr interface{}) error {
 }
 
 // RegisterName is like Register but uses the provided name for the type
-// instead of the receiver's concrete type.
+// instead of the receiver's concrete type. A name is required when that
+// type is unnamed, as for an anonymous struct embedding a service.
+//
+// The name may be namespaced with dots, as in "v1.math". Clients then call
+// "v1.math.Add": transports split the method off at the last dot, which is
+// unambiguous since method names cannot contain one.
 func (server *Server) RegisterName(name string, rcvr interface{}) error {
+	if name != "" && !isValidName(name) {
+		return FmtServerErrorMessage(ErrInvalidName, name)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	_, err := server.register(name, rcvr, nil)
+	return err
+}
+
+// RegisterWithNames is like RegisterName but publishes the methods of rcvr
+// under the names given in methods, keyed by their Go name, so that
+// clients may call them with names Go doesn't export, such as "arith.sum"
+// for the method Add. Methods left out of methods keep their Go name.
+// It fails when a key of methods is no suitable method of rcvr, a name
+// is empty or holds a dot, or two methods would share a name.
+func (server *Server) RegisterWithNames(name string, rcvr interface{}, methods map[string]string) error {
+	if name != "" && !isValidName(name) {
+		return FmtServerErrorMessage(ErrInvalidName, name)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	sname, err := server.register(name, rcvr, nil)
+	if err != nil {
+		return err
+	}
+
+	s := server.serviceMap[sname]
+	if s.method, err = renameMethods(s.method, methods); err != nil {
+		delete(server.serviceMap, sname)
+		return err
+	}
+	return nil
+}
+
+// RegisterAll is like calling RegisterName for each name and receiver of
+// rcvrs, in name order, but registers them in one pass under the lock and
+// inspects each receiver type once however many names it is published
+// under. Either all of them are registered, or none when one fails.
+func (server *Server) RegisterAll(rcvrs map[string]interface{}) error {
+	names := make([]string, 0, len(rcvrs))
+	for name := range rcvrs {
+		if name != "" && !isValidName(name) {
+			return FmtServerErrorMessage(ErrInvalidName, name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	methods := make(map[reflect.Type]map[string]*methodType)
+	registered := make([]string, 0, len(names))
+
+	for _, name := range names {
+		sname, err := server.register(name, rcvrs[name], methods)
+		if err != nil {
+			for _, sname := range registered {
+				delete(server.serviceMap, sname)
+			}
+			return err
+		}
+		registered = append(registered, sname)
+	}
+	return nil
+}
+
+// RegisterVersion is like RegisterName but publishes rcvr as one version
+// of the named service. Clients pick a version with "name@version", as in
+// "Calculator@2.Add"; calls to the bare name go to the default version.
+// The first version registered for a name becomes its default.
+func (server *Server) RegisterVersion(name, version string, rcvr interface{}) error {
+	if !isValidName(name) {
+		return FmtServerErrorMessage(ErrInvalidName, name)
+	}
+	if !isValidName(version) {
+		return FmtServerErrorMessage(ErrInvalidVersion, version)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if _, err := server.register(name + "@" + version, rcvr, nil); err != nil {
+		return err
+	}
+
+	if server.versions == nil {
+		server.versions = make(map[string]string)
+	}
+	if _, present := server.versions[name]; !present {
+		server.versions[name] = version
+	}
+	return nil
+}
+
+// SetDefaultVersion selects which registered version of the named service
+// serves calls that don't ask for a version.
+func (server *Server) SetDefaultVersion(name, version string) error {
 	server.mu.Lock()
 	defer server.mu.Unlock()
 
+	if _, present := server.serviceMap[name + "@" + version]; !present {
+		return FmtServerErrorMessage(ErrNoSuchVersion, name + "@" + version)
+	}
+
+	server.versions[name] = version
+	return nil
+}
+
+// Publishes rcvr under name, or under its type name when name is empty,
+// and returns the name. The methods of types already in methods are reused,
+// those of new types are added when methods is not nil. The caller must
+// hold server.mu.
+func (server *Server) register(name string, rcvr interface{}, methods map[reflect.Type]map[string]*methodType) (string, error) {
 	if server.serviceMap == nil {
 		server.serviceMap = make(ServiceMap)
 	}
@@ -121,8 +342,14 @@ func (server *Server) RegisterName(name string, rcvr interface{}) error {
 	s.rcvr = reflect.ValueOf(rcvr)
 	sname := reflect.Indirect(s.rcvr).Type().Name()
 
-	if !isExported(sname) {
-		return FmtServerErrorMessage(ErrTypeNotExported, sname)
+	// Unnamed types, such as anonymous structs embedding a service, can
+	// only be published under an explicit name.
+	if sname == "" {
+		if name == "" {
+			return "", FmtServerErrorMessage(ErrUnnamedType, s.typ)
+		}
+	} else if !isExported(sname) {
+		return "", FmtServerErrorMessage(ErrTypeNotExported, sname)
 	}
 
 	if name != "" {
@@ -130,60 +357,542 @@ func (server *Server) RegisterName(name string, rcvr interface{}) error {
 	}
 
 	if _, present := server.serviceMap[sname]; present {
-		return FmtServerErrorMessage(ErrAlreadyDefined, sname)
+		return "", FmtServerErrorMessage(ErrAlreadyDefined, sname)
 	}
 
 	s.name = sname
-	s.method = installValidMethods(s.typ)
+	if m, present := methods[s.typ]; present {
+		s.method = m
+	} else {
+		s.method = installValidMethods(s.typ)
+		if methods != nil {
+			methods[s.typ] = s.method
+		}
+	}
 
 	if len(s.method) == 0 {
-		return FmtServerErrorMessage(ErrNoExportedMethods, sname)
+		return "", FmtServerErrorMessage(ErrNoExportedMethods, sname)
 	}
 
 	server.serviceMap[s.name] = s
+	return s.name, nil
+}
+
+// Finds the service a client asked for. A bare name that isn't registered
+// as such resolves to the default version of that service. The caller
+// must hold server.mu.
+func (server *Server) lookup(name string) *Service {
+	if service := server.serviceMap[name]; service != nil {
+		return service
+	}
+	if version, present := server.versions[name]; present {
+		return server.serviceMap[name + "@" + version]
+	}
+	return nil
+}
+
+// HasMethod reports whether a call to service.method would reach a
+// registered method, without calling it. Service may carry a version, as
+// in "Arith@v2"; a bare name refers to its default version.
+func (server *Server) HasMethod(service, method string) bool {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+
+	s := server.lookup(service)
+	return s != nil && s.method[method] != nil
+}
+
+// Service returns the service calls to name reach, for introspection. Name
+// may carry a version, as HasMethod's service does.
+func (server *Server) Service(name string) (*Service, bool) {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+
+	s := server.lookup(name)
+	return s, s != nil
+}
+
+// SetErrorMapper sets the mapper translating the errors returned by methods
+// of every service. Mappers set on a service with SetServiceErrorMapper
+// are consulted first. A nil mapper removes it.
+func (server *Server) SetErrorMapper(m ErrorMapper) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.mapErr = m
+}
+
+// SetServiceErrorMapper sets the mapper translating the errors returned by
+// the methods of the named service. For versioned services name selects
+// the default version unless it carries one, as in "Arith@v2". A nil
+// mapper removes it.
+func (server *Server) SetServiceErrorMapper(name string, m ErrorMapper) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	service := server.lookup(name)
+	if service == nil {
+		return FmtServerErrorMessage(ErrNoSuchService, name)
+	}
+
+	service.mapErr = m
 	return nil
 }
 
+// SetMethodTimeout limits how long a method may run. Past d the call fails
+// with ErrMethodTimeout and the worker moves on; methods taking a context
+// see it expire and should stop, the others run to completion in the
+// background. A zero d removes the limit.
+func (server *Server) SetMethodTimeout(d time.Duration) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.timeout = d
+}
+
+// SetMethodTimeoutFor overrides the limit set by SetMethodTimeout for one
+// method, named "Service.Method" as requested. A zero d exempts the method
+// from any limit.
+func (server *Server) SetMethodTimeoutFor(serviceMethod string, d time.Duration) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.timeouts == nil {
+		server.timeouts = make(map[string]time.Duration)
+	}
+	server.timeouts[serviceMethod] = d
+}
+
+// SetStrictErrorCodes makes the server coerce the ServerErrors returned by
+// methods with a code reserved for the protocol, -32768 to -32001, into
+// ERR_SERVER errors, logging a warning. Errors raised by the server itself
+// and those produced by error mappers keep their code.
+func (server *Server) SetStrictErrorCodes(strict bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.strictCodes = strict
+}
+
+// SetResultCache makes the server keep in cache the results of requests
+// carrying an idempotency key, so that a retry with the same key for the
+// same method gets the cached result without running the method again.
+// A retry arriving while the call runs waits for its result. A call
+// reusing the key with other params is answered with ErrKeyReused. Only
+// the results of successful calls and errors of the application are
+// cached: a call that timed out or failed internally runs again when
+// retried. A nil cache turns it off.
+func (server *Server) SetResultCache(cache ResultCache) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.cache = cache
+}
+
+// A Fallback serves calls no registered method matches, named
+// "Service.Method" as requested. The params are decoded with
+// req.DecodeParams; JSON transports decode them into a json.RawMessage as
+// sent. The reply and error are answered as those of a method.
+type Fallback func(serviceMethod string, req Request) (interface{}, error)
+
+// SetFallback makes the server hand calls to unknown services and methods
+// to f, rather than answering ErrMethodNotFound, to proxy them to another
+// backend for instance. A nil f removes it.
+func (server *Server) SetFallback(f Fallback) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.fallback = f
+}
+
+// A PanicHandler answers a call whose method panicked with the value
+// recovered, to log its stack trace with runtime/debug.Stack, count it or
+// answer an error of the application. It runs on the goroutine of the
+// method, before the panicking frames unwind.
+type PanicHandler func(req Request, recovered interface{}) *Result
+
+// SetPanicHandler makes the server answer the calls whose method panicked
+// with the Result of h, rather than logging the panic and answering an
+// ERR_INTERNAL error. Such results are neither mapped by the error mappers
+// nor cached. A nil h restores the default.
+func (server *Server) SetPanicHandler(h PanicHandler) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.onPanic = h
+}
+
+// UseArgsMiddleware appends m to the middleware run on the decoded args
+// of every call, before the method. Middleware run in the order they were
+// added.
+func (server *Server) UseArgsMiddleware(m ...ArgsMiddleware) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.middleware = append(server.middleware, m...)
+}
+
+// SetValuePooling enables or disables recycling of args and reply values
+// between calls, which cuts allocations under load. With pooling enabled
+// methods must not retain their args or reply after returning, and
+// transports should call Release on each Result once it is encoded.
+func (server *Server) SetValuePooling(enabled bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if !enabled {
+		server.pool = nil
+	} else if server.pool == nil {
+		server.pool = new(valuePool)
+	}
+}
+
 // Takes a RPC request and produces result from the specified service
 func (server *Server) ServeRequest(req Request) *Result {
 	// Look up the request.
 	server.mu.RLock()
-	service := server.serviceMap[req.ServiceName()]
+	service := server.lookup(req.ServiceName())
+	cfg := callConfig{server.pool, server.strictCodes, server.middleware, server.onPanic}
+	mapErr := server.mapErr
+	timeout := server.timeout
+	if len(server.timeouts) > 0 {
+		if d, present := server.timeouts[req.ServiceName() + "." + req.MethodName()]; present {
+			timeout = d
+		}
+	}
+	var serviceMapErr ErrorMapper
+	if service != nil {
+		serviceMapErr = service.mapErr
+	}
+	cache := server.cache
+	fallback := server.fallback
 	server.mu.RUnlock()
 
+	if fallback != nil && (service == nil || service.method[req.MethodName()] == nil) {
+		reply, err := fallback(req.ServiceName() + "." + req.MethodName(), req)
+		if errors.Is(err, ErrNoContent) {
+			return NewResult(nil, nil)
+		}
+		if err != nil {
+			err = mapError(err, mapErr)
+		}
+		return NewResult(reply, err)
+	}
+
 	if service == nil {
-		ErrMethodNotFound.Data = req.ServiceName() 
-		return NewResult(nil, ErrMethodNotFound)
+		return NewResult(nil, NewServerError(ERR_NO_METHOD, ErrMethodNotFound.Message, req.ServiceName()))
+	}
+
+	var key, hash string
+	if cache != nil {
+		key = idempotencyKey(req)
+	}
+	if key != "" {
+		hash = callHash(req)
+	}
+	for key != "" {
+		done := server.keyed.claim(key)
+		if done == nil {
+			defer server.keyed.release(key)
+			if result, h, ok := cache.Get(key); ok {
+				if h != hash {
+					return NewResult(nil, ErrKeyReused)
+				}
+				return result
+			}
+			break
+		}
+
+		select {
+		case <-done:
+		case <-requestDone(req):
+			return NewResult(nil, ErrTimeout)
+		}
+	}
+
+	var reply interface{}
+	var err error
+	if timeout > 0 {
+		reply, err = service.callTimeout(req, cfg, timeout)
+	} else {
+		reply, err = service.call(nil, req, cfg)
+	}
+	if p, ok := err.(*handledPanic); ok {
+		if p.result == nil {
+			return NewResult(nil, NewServerError(ERR_INTERNAL, ErrInternal.Message, nil))
+		}
+		return p.result
+	}
+	if err != nil {
+		err = mapError(err, serviceMapErr, mapErr)
+	}
+
+	result := NewResult(reply, err)
+
+	// A cached reply is shared with later retries and not recycled.
+	if key != "" {
+		if cacheable(err) {
+			cache.Put(key, hash, result)
+		}
+	} else if err == nil {
+		result.pool = cfg.pool
+	}
+	return result
+}
+
+// Dispatch hands req to the worker pool and waits for its result on
+// req.Result(). It is the entry point transports use to run requests; the
+// queues behind it are an implementation detail. Requests carrying a
+// context stop waiting once it is done, answering ErrTimeout; the worker
+// then drops their result.
+func (server *Server) Dispatch(req Request) *Result {
+	if !server.Ready() {
+		return NewResult(nil, ErrNotReady)
+	}
+	if !server.admit() {
+		return NewResult(nil, ErrShutdown)
+	}
+	server.enqueue(job{req: req, sink: channelSink{server.forced}})
+
+	select {
+	case result := <-req.Result():
+		return result
+	case <-requestDone(req):
+		return NewResult(nil, ErrTimeout)
+	}
+}
+
+// DispatchTo hands req to the worker pool and returns once a worker has
+// taken it; the result is delivered to sink.
+func (server *Server) DispatchTo(req Request, sink ResultSink) {
+	if !server.Ready() {
+		sink.Deliver(req, NewResult(nil, ErrNotReady))
+		return
+	}
+	if !server.admit() {
+		sink.Deliver(req, NewResult(nil, ErrShutdown))
+		return
+	}
+	server.enqueue(job{req: req, sink: sink})
+}
+
+// Counts a request in flight, unless the server is shutting down.
+func (server *Server) admit() bool {
+	server.drain.RLock()
+	defer server.drain.RUnlock()
+
+	if server.closing {
+		return false
+	}
+	server.inflight.Add(1)
+	return true
+}
+
+// Shutdown stops the server gracefully: it refuses new requests with
+// ErrShutdown, waits for the ones already handed to Dispatch or
+// DispatchTo to be answered, then stops the workers. If ctx is done first
+// Shutdown stops waiting and returns a *ForcedShutdownError naming the
+// methods still running, which it logs; the workers keep running so the
+// calls left can still be answered, and Shutdown may be called again.
+// From then on, the results of Dispatch that nobody reads are dropped
+// rather than blocking their worker, and with it the next Shutdown.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.drain.Lock()
+	server.closing = true
+	server.drain.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		server.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		running := server.running()
+		for _, method := range running {
+			glog.Warningf("RPC: shutdown forced while %s is still running", method)
+		}
+		server.force.Do(func() { close(server.forced) })
+		return &ForcedShutdownError{Running: running, err: ctx.Err()}
+	}
+
+	server.stop.Do(func() { close(server.quit) })
+	return nil
+}
+
+// ForcedShutdownError is returned by Shutdown when its context is done
+// before the calls in flight are answered. It unwraps to the error of
+// the context.
+type ForcedShutdownError struct {
+	Running []string // "Service.Method" of the calls being served, sorted
+	err     error
+}
+
+func (e *ForcedShutdownError) Error() string {
+	if len(e.Running) == 0 {
+		return "RPC: shutdown forced with calls still queued: " + e.err.Error()
+	}
+	return fmt.Sprintf("RPC: shutdown forced with %s still running: %v", strings.Join(e.Running, ", "), e.err)
+}
+
+func (e *ForcedShutdownError) Unwrap() error {
+	return e.err
+}
+
+// Returns the "Service.Method" names of the calls the workers are
+// serving, sorted.
+func (server *Server) running() []string {
+	var methods []string
+	for i := range server.slots {
+		if req := server.slots[i].load(); req != nil {
+			methods = append(methods, req.ServiceName() + "." + req.MethodName())
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// SetReady sets whether the server is ready to serve calls. While it is
+// not, Dispatch and DispatchTo answer ErrNotReady without queueing the
+// requests, so that no call sees a service half initialized. A server is
+// ready once created; one loading data at startup sets it not ready
+// first, then ready once done.
+func (server *Server) SetReady(ready bool) {
+	var unready int32
+	if !ready {
+		unready = 1
+	}
+	atomic.StoreInt32(&server.unready, unready)
+}
+
+// Ready reports whether the server is ready to serve calls, see SetReady.
+func (server *Server) Ready() bool {
+	return atomic.LoadInt32(&server.unready) == 0
+}
+
+// ShuttingDown reports whether Shutdown was called, so transports can
+// tell load balancers to send requests elsewhere.
+func (server *Server) ShuttingDown() bool {
+	server.drain.RLock()
+	defer server.drain.RUnlock()
+
+	return server.closing
+}
+
+// Requests are spread round-robin over the queues of the workers, so that
+// callers don't all contend on a single channel: a request goes to the
+// queue of its turn if that worker waits for one, without trying the
+// others, and otherwise to the queue every worker drains. There enqueue
+// blocks until a worker frees up, which applies backpressure to the
+// transport. Long polls are served apart, see SetLongPoll.
+func (server *Server) enqueue(j job) {
+	j.queued = time.Now()
+
+	if slots := server.longPoll(j.req); slots != nil {
+		server.poll(j, slots)
+		return
+	}
+
+	turn := atomic.AddUint32(&server.next, 1)
+	select {
+	case server.queues[turn % uint32(len(server.queues))] <- j:
+		return
+	default:
 	}
 
-	reply, err := service.Call(req)
+	atomic.AddInt32(&server.queued, 1)
+	server.shared <- j
+	atomic.AddInt32(&server.queued, -1)
+}
 
-	return NewResult(reply, err)
+// Stats returns the current activity of the worker pool. It only reads
+// counters, so it is cheap enough to poll frequently.
+func (server *Server) Stats() Stats {
+	queued := int(atomic.LoadInt32(&server.queued))
+	workers := len(server.slots)
+	busy := int(atomic.LoadInt32(&server.busy))
+
+	return Stats{
+		Queued:  queued,
+		Workers: workers,
+		Busy:    busy,
+		Idle:    workers - busy,
+		Served:  atomic.LoadUint64(&server.served),
+	}
 }
 
 //-----------------------------------------------------------------------------
 // Workers
 //-----------------------------------------------------------------------------
 
-// Initialize a pool of worker goroutines
-func workerPool(srv *Server, n int) chan Request {
-	requests := make(chan Request)
+// Initialize a pool of worker goroutines, each with its own queue and
+// slot, and the queue they all drain.
+func workerPool(srv *Server, n int) (chan job, []chan job, []workerSlot) {
+	shared := make(chan job)
+	queues := make([]chan job, n)
+	slots := make([]workerSlot, n)
 
 	for i := 0; i < n; i++ {
-		go worker(srv, requests)
+		queues[i] = make(chan job)
+		go worker(srv, &slots[i], queues[i], shared)
 	}
 
-	return requests
+	return shared, queues, slots
 }
 
-// Worker function serve requests
-func worker(srv *Server, requests chan Request) {
+// workerSlot holds the request a worker is serving, nil when idle.
+type workerSlot struct {
+	mutex sync.Mutex
+	req   Request
+}
 
-	for r := range requests {
+func (s *workerSlot) store(req Request) {
+	s.mutex.Lock()
+	s.req = req
+	s.mutex.Unlock()
+}
 
-		result := srv.ServeRequest(r)
+func (s *workerSlot) load() Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.req
+}
 
-		r.Result() <- result 
+// Worker function serve requests from its own queue and the shared one.
+// Requests whose context expired while they were queued are answered with
+// ErrTimeout without being served.
+func worker(srv *Server, slot *workerSlot, requests, shared chan job) {
+
+	for {
+		var j job
+
+		select {
+		case j = <-requests:
+		case j = <-shared:
+		case <-srv.quit:
+			return
+		}
+
+		atomic.AddInt32(&srv.busy, 1)
+
+		var result *Result
+		if requestExpired(j.req) {
+			result = NewResult(nil, ErrTimeout)
+		} else {
+			slot.store(j.req)
+			start := time.Now()
+			result = srv.ServeRequest(j.req)
+			recordTiming(j.req, j.queued, start)
+			slot.store(nil)
+		}
+
+		j.sink.Deliver(j.req, result)
+		srv.inflight.Done()
+
+		atomic.AddInt32(&srv.busy, -1)
+		atomic.AddUint64(&srv.served, 1)
 	}
 
 }
\ No newline at end of file
@@ -5,9 +5,20 @@
 package rpc
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/golang/glog"
 )
 
 type Args struct {
@@ -75,6 +86,20 @@ func TestRegistrationError(t *testing.T) {
 	} 
 }
 
+// Check that the methods skipped at registration are not logged by default.
+func TestRegistrationQuiet(t *testing.T) {
+	server := NewServer()
+	infos, warnings := glog.Stats.Info.Lines(), glog.Stats.Warning.Lines()
+
+	for _, rcvr := range []interface{}{new(ReplyNotPointer), new(ArgNotPublic), new(ReplyNotPublic), new(Arith)} {
+		server.Register(rcvr)
+	}
+	if glog.Stats.Info.Lines() != infos || glog.Stats.Warning.Lines() != warnings {
+		t.Errorf("expected nothing logged got %d infos and %d warnings",
+			glog.Stats.Info.Lines() - infos, glog.Stats.Warning.Lines() - warnings)
+	}
+}
+
 //-----------------------------------------------------------------------------
 
 //-----------------------------------------------------------------------------
@@ -113,7 +138,7 @@ func newTestRequest(s, m string, args *Args) *testRequest {
 		serviceName: s,
 		methodName: m, 
 		args: *args,
-		result: make(chan *Result),
+		result: make(chan *Result, 1),
 	}
 }
 
@@ -185,7 +210,7 @@ func TestRPC_MethodNotFound(t *testing.T) {
 	// expect an error
 	if result.Error == nil {
 		t.Error("BadOperation: expected error")
-	} else if result.Error != ErrMethodNotFound {
+	} else if !errors.Is(result.Error, ErrMethodNotFound) {
 		t.Errorf("BadOperation: expected can't find method error; got %q", result.Error)
 	}
 }
@@ -203,7 +228,7 @@ func TestRPC_UnknownService(t *testing.T) {
 	result = srv.ServeRequest(req)
 	if result.Error == nil {
 		t.Error("expected error calling unknown service")
-	} else if result.Error != ErrMethodNotFound {
+	} else if !errors.Is(result.Error, ErrMethodNotFound) {
 		t.Error("expected error about method; got", result.Error)
 	}
 }
@@ -228,44 +253,1674 @@ func TestRPC_MethodErrorMessage(t *testing.T) {
 
 }
 
-func BenchmarkServeRequest(b *testing.B) {
+func TestRPC_Dispatch(t *testing.T) {
 	once.Do(startServer)
 
-	// Good call
-	args := &Args{7, 0}
-	b.ResetTimer()
+	var wg sync.WaitGroup
 
-	for i := 0; i < b.N; i++ {
-		req := newTestRequest("Arith", "Add", args)
-		result := srv.ServeRequest(req) 
-		// expect an error
+	// More concurrent callers than workers, so some find every queue busy.
+	for i := 0; i < 4 * *nWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			args := &Args{i, 3}
+			result := srv.Dispatch(newTestRequest("Arith", "Mul", args))
+			if result.Error != nil {
+				t.Errorf("Mul: expected no error but got string %q", result.Error.Error())
+			} else if reply, ok := result.Value.(*Reply); !ok || reply.C != args.A * args.B {
+				t.Errorf("Mul: expected %d got %v", args.A * args.B, result.Value)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestRPC_NamespacedService(t *testing.T) {
+	once.Do(startServer)
+
+	if err := srv.RegisterName("v1.math", new(Arith)); err != nil {
+		t.Fatal("RegisterName v1.math:", err)
+	}
+
+	args := &Args{7, 8}
+	result := srv.ServeRequest(newTestRequest("v1.math", "Add", args))
+	if result.Error != nil {
+		t.Errorf("v1.math.Add: expected no error but got string %q", result.Error.Error())
+	} else if reply, ok := result.Value.(*Reply); !ok || reply.C != args.A + args.B {
+		t.Errorf("v1.math.Add: expected %d got %v", args.A + args.B, result.Value)
+	}
+
+	for _, name := range []string{"v1..math", ".math", "math."} {
+		if err := srv.RegisterName(name, new(Arith)); err == nil {
+			t.Errorf("expected error registering %q", name)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+type ArithV2 int
+
+// Add in v2 counts B twice, so that tests can tell the versions apart.
+func (t *ArithV2) Add(args Args, reply *Reply) error {
+	reply.C = args.A + 2 * args.B
+	return nil
+}
+
+func TestRPC_Versions(t *testing.T) {
+	once.Do(startServer)
+
+	if err := srv.RegisterVersion("Calc", "1", new(Arith)); err != nil {
+		t.Fatal("RegisterVersion Calc@1:", err)
+	}
+	if err := srv.RegisterVersion("Calc", "2", new(ArithV2)); err != nil {
+		t.Fatal("RegisterVersion Calc@2:", err)
+	}
+
+	call := func(service string) int {
+		result := srv.ServeRequest(newTestRequest(service, "Add", &Args{1, 10}))
 		if result.Error != nil {
-			b.Fatalf("Add: expected no error but got string %q", result.Error.Error())
+			t.Fatalf("%s.Add: expected no error but got string %q", service, result.Error.Error())
 		}
-		if reply, ok := result.Value.(*Reply); !ok || reply.C != args.A + args.B {
-			b.Fatalf("Add: expected %d got %d", args.A + args.B, reply.C)
-		}	
+		return result.Value.(*Reply).C
+	}
+
+	if c := call("Calc@1"); c != 11 {
+		t.Errorf("Calc@1.Add: expected 11 got %d", c)
+	}
+	if c := call("Calc@2"); c != 21 {
+		t.Errorf("Calc@2.Add: expected 21 got %d", c)
+	}
+	// The first version registered is the default
+	if c := call("Calc"); c != 11 {
+		t.Errorf("Calc.Add: expected 11 got %d", c)
+	}
+
+	if err := srv.SetDefaultVersion("Calc", "2"); err != nil {
+		t.Fatal("SetDefaultVersion:", err)
+	}
+	if c := call("Calc"); c != 21 {
+		t.Errorf("Calc.Add: expected 21 got %d", c)
+	}
+
+	if err := srv.SetDefaultVersion("Calc", "3"); err == nil {
+		t.Error("expected error selecting unregistered version Calc@3")
+	}
+	if err := srv.RegisterVersion("Calc", "2", new(ArithV2)); err == nil {
+		t.Error("expected error registering Calc@2 twice")
+	}
+	if err := srv.RegisterName("Calc@3", new(ArithV2)); err == nil {
+		t.Error("expected error registering a name containing a version")
 	}
 }
 
-func BenchmarkServeRequestParallel(b *testing.B) {
+func TestRPC_RegisterUnnamedType(t *testing.T) {
 	once.Do(startServer)
 
-	// Good call
-	args := &Args{7, 0}
-	b.ResetTimer()
+	v := struct{ *Arith }{new(Arith)}
 
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			req := newTestRequest("Arith", "Add", args)
-			result := srv.ServeRequest(req) 
-			// expect an error
-			if result.Error != nil {
-				b.Fatalf("Add: expected no error but got string %q", result.Error.Error())
+	if err := srv.Register(v); err == nil {
+		t.Error("expected error registering an unnamed type without a name")
+	}
+	if err := srv.RegisterName("Svc", v); err != nil {
+		t.Fatal("RegisterName Svc:", err)
+	}
+
+	args := &Args{7, 8}
+	result := srv.ServeRequest(newTestRequest("Svc", "Mul", args))
+	if result.Error != nil {
+		t.Errorf("Svc.Mul: expected no error but got string %q", result.Error.Error())
+	} else if reply, ok := result.Value.(*Reply); !ok || reply.C != args.A * args.B {
+		t.Errorf("Svc.Mul: expected %d got %v", args.A * args.B, result.Value)
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+type Tracer int
+
+func (t *Tracer) ID(ctx context.Context, args Args, reply *string) error {
+	*reply = RequestIDFromContext(ctx)
+	return nil
+}
+
+// idRequest is a testRequest with a client assigned id.
+type idRequest struct {
+	*testRequest
+	id string
+}
+
+func (r idRequest) RequestID() string {
+	return r.id
+}
+
+func TestRPC_RequestID(t *testing.T) {
+	once.Do(startServer)
+
+	if err := srv.Register(new(Tracer)); err != nil {
+		t.Fatal("Register Tracer:", err)
+	}
+
+	req := idRequest{newTestRequest("Tracer", "ID", &Args{}), "call-42"}
+	result := srv.ServeRequest(req)
+	if result.Error != nil {
+		t.Fatalf("ID: expected no error but got string %q", result.Error.Error())
+	}
+	if id := *result.Value.(*string); id != "call-42" {
+		t.Errorf("ID: expected %q got %q", "call-42", id)
+	}
+
+	// Requests without ids leave it empty
+	result = srv.ServeRequest(newTestRequest("Tracer", "ID", &Args{}))
+	if result.Error != nil {
+		t.Fatalf("ID: expected no error but got string %q", result.Error.Error())
+	}
+	if id := *result.Value.(*string); id != "" {
+		t.Errorf("ID: expected empty id got %q", id)
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+type Clock int
+
+func (c *Clock) Now(reply *Reply) error {
+	reply.C = 1
+	return nil
+}
+
+func (c *Clock) Caller(ctx context.Context, reply *string) error {
+	*reply = RequestIDFromContext(ctx)
+	return nil
+}
+
+// badParamsRequest fails to decode any params.
+type badParamsRequest struct {
+	*testRequest
+}
+
+func (r badParamsRequest) DecodeParams(args interface{}) error {
+	return errors.New("params not decodable")
+}
+
+type Adder int
+
+func (a *Adder) Add(x, y int, reply *int) error {
+	*reply = x + y
+	return nil
+}
+
+// fieldsRequest decodes its values into the fields of the args, in order.
+type fieldsRequest struct {
+	*testRequest
+	values []interface{}
+}
+
+func (r fieldsRequest) DecodeParams(args interface{}) error {
+	v := reflect.ValueOf(args).Elem()
+	for i, value := range r.values {
+		v.Field(i).Set(reflect.ValueOf(value))
+	}
+	return nil
+}
+
+func TestRPC_SeveralArgs(t *testing.T) {
+	once.Do(startServer)
+
+	if err := srv.Register(new(Adder)); err != nil {
+		t.Fatal("Register Adder:", err)
+	}
+
+	result := srv.ServeRequest(fieldsRequest{newTestRequest("Adder", "Add", &Args{}), []interface{}{4, 5}})
+	if result.Error != nil {
+		t.Fatalf("Add: expected no error but got string %q", result.Error.Error())
+	}
+	if sum := *result.Value.(*int); sum != 9 {
+		t.Errorf("Add: expected 9 got %d", sum)
+	}
+}
+
+func TestRPC_NoArgs(t *testing.T) {
+	once.Do(startServer)
+
+	if err := srv.Register(new(Clock)); err != nil {
+		t.Fatal("Register Clock:", err)
+	}
+
+	// Params are not decoded for methods without args
+	result := srv.ServeRequest(badParamsRequest{newTestRequest("Clock", "Now", &Args{})})
+	if result.Error != nil {
+		t.Fatalf("Now: expected no error but got string %q", result.Error.Error())
+	}
+	if reply, ok := result.Value.(*Reply); !ok || reply.C != 1 {
+		t.Errorf("Now: expected 1 got %v", result.Value)
+	}
+
+	// With a context
+	req := idRequest{newTestRequest("Clock", "Caller", &Args{}), "call-7"}
+	result = srv.ServeRequest(req)
+	if result.Error != nil {
+		t.Fatalf("Caller: expected no error but got string %q", result.Error.Error())
+	}
+	if id := *result.Value.(*string); id != "call-7" {
+		t.Errorf("Caller: expected %q got %q", "call-7", id)
+	}
+
+	if schema := srv.Schema()["Clock.Now"]; schema == nil || schema.Params != nil {
+		t.Errorf("Schema: expected no params for Clock.Now got %+v", schema)
+	}
+}
+
+type Counter struct {
+	hits int32
+}
+
+func (c *Counter) Hit(args Args, reply *int32) error {
+	*reply = atomic.AddInt32(&c.hits, 1)
+	return nil
+}
+
+// ctxRequest is a testRequest carrying a context.
+type ctxRequest struct {
+	*testRequest
+	ctx context.Context
+}
+
+func (r ctxRequest) Context() context.Context {
+	return r.ctx
+}
+
+type Validator int
+
+var ErrValidation = errors.New("validation failed")
+
+func (v *Validator) Check(args Args, reply *Reply) error {
+	if args.A < 0 {
+		return ErrValidation
+	}
+	return errors.New("unchecked")
+}
+
+func TestRPC_ErrorMapper(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	server.Register(new(Validator))
+
+	if err := server.SetServiceErrorMapper("Unknown", nil); err == nil {
+		t.Error("expected error setting the mapper of an unknown service")
+	}
+
+	server.SetErrorMapper(func(err error) (*ServerError, bool) {
+		return NewServerError(ERR_SERVER, "global: " + err.Error(), nil), true
+	})
+	err := server.SetServiceErrorMapper("Validator", func(err error) (*ServerError, bool) {
+		if err != ErrValidation {
+			return nil, false
+		}
+		return NewServerError(ERR_BAD_PARAMS, err.Error(), "A"), true
+	})
+	if err != nil {
+		t.Fatal("SetServiceErrorMapper:", err)
+	}
+
+	tests := []struct {
+		service, method string
+		args            Args
+		code            int
+		msg             string
+	}{
+		{"Validator", "Check", Args{-1, 0}, ERR_BAD_PARAMS, "validation failed"},
+		{"Validator", "Check", Args{1, 0}, ERR_SERVER, "global: unchecked"},
+		{"Arith", "Div", Args{1, 0}, ERR_SERVER, "global: divide by zero"},
+	}
+	for _, tt := range tests {
+		result := server.ServeRequest(newTestRequest(tt.service, tt.method, &tt.args))
+		serr, ok := result.Error.(*ServerError)
+		if !ok {
+			t.Errorf("%s.%s: expected a ServerError got %v", tt.service, tt.method, result.Error)
+		} else if serr.Code != tt.code || serr.Message != tt.msg {
+			t.Errorf("%s.%s: expected (%d) %q got (%d) %q", tt.service, tt.method, tt.code, tt.msg, serr.Code, serr.Message)
+		}
+	}
+
+	// Errors of the server itself are not mapped
+	result := server.ServeRequest(newTestRequest("Arith", "Unknown", &Args{}))
+	if !errors.Is(result.Error, ErrMethodNotFound) {
+		t.Errorf("expected ErrMethodNotFound got %v", result.Error)
+	}
+}
+
+type Directory int
+
+func (d *Directory) Lookup(args Args, reply *Reply) error {
+	if args.A == 0 {
+		return fmt.Errorf("lookup %d: %w", args.A, ErrNoContent)
+	}
+	reply.C = args.A
+	return nil
+}
+
+func TestRPC_NoContent(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Directory))
+
+	result := server.ServeRequest(newTestRequest("Directory", "Lookup", &Args{0, 0}))
+	if result.Error != nil || result.Value != nil {
+		t.Errorf("Lookup: expected no value and no error got %v, %v", result.Value, result.Error)
+	}
+	result.Release()
+
+	result = server.ServeRequest(newTestRequest("Directory", "Lookup", &Args{7, 0}))
+	if result.Error != nil {
+		t.Fatalf("Lookup: expected no error but got string %q", result.Error.Error())
+	}
+	if reply, ok := result.Value.(*Reply); !ok || reply.C != 7 {
+		t.Errorf("Lookup: expected 7 got %v", result.Value)
+	}
+}
+
+type Sleeper struct {
+	stopped chan struct{}
+}
+
+// Polite stops when its context expires.
+func (s *Sleeper) Polite(ctx context.Context, args Args, reply *Reply) error {
+	select {
+	case <-ctx.Done():
+		close(s.stopped)
+		return ctx.Err()
+	case <-time.After(time.Duration(args.A) * time.Millisecond):
+	}
+	return nil
+}
+
+// Blind ignores its context.
+func (s *Sleeper) Blind(args Args, reply *Reply) error {
+	time.Sleep(time.Duration(args.A) * time.Millisecond)
+	return nil
+}
+
+func TestRPC_MethodTimeout(t *testing.T) {
+	server := NewServer()
+	sleeper := &Sleeper{make(chan struct{})}
+	server.Register(sleeper)
+	server.SetMethodTimeout(20 * time.Millisecond)
+
+	tests := []struct {
+		method string
+		sleep  int // milliseconds
+		err    error
+	}{
+		{"Polite", 1, nil},
+		{"Blind", 1, nil},
+		{"Polite", 1000, ErrMethodTimeout},
+		{"Blind", 300, ErrMethodTimeout},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		result := server.Dispatch(newTestRequest("Sleeper", tt.method, &Args{tt.sleep, 0}))
+		elapsed := time.Since(start)
+
+		if result.Error != tt.err {
+			t.Errorf("%s(%dms): expected error %v got %v", tt.method, tt.sleep, tt.err, result.Error)
+		}
+		if tt.err != nil && elapsed > 200 * time.Millisecond {
+			t.Errorf("%s(%dms): expected the call to give up early, took %v", tt.method, tt.sleep, elapsed)
+		}
+	}
+
+	select {
+	case <-sleeper.stopped:
+	case <-time.After(time.Second):
+		t.Error("Polite: expected the method to see its context expire")
+	}
+}
+
+func TestRPC_MethodTimeoutFor(t *testing.T) {
+	server := NewServer()
+	server.Register(&Sleeper{make(chan struct{})})
+	server.SetMethodTimeout(20 * time.Millisecond)
+	server.SetMethodTimeoutFor("Sleeper.Blind", time.Second)
+
+	// The default still applies to other methods
+	result := server.Dispatch(newTestRequest("Sleeper", "Polite", &Args{200, 0}))
+	if result.Error != ErrMethodTimeout {
+		t.Errorf("Polite: expected ErrMethodTimeout got %v", result.Error)
+	}
+
+	// The override lets a slow method finish
+	result = server.Dispatch(newTestRequest("Sleeper", "Blind", &Args{100, 0}))
+	if result.Error != nil {
+		t.Errorf("Blind: expected no error but got string %q", result.Error.Error())
+	}
+
+	// and still bounds it
+	result = server.Dispatch(newTestRequest("Sleeper", "Blind", &Args{2000, 0}))
+	if result.Error != ErrMethodTimeout {
+		t.Errorf("Blind: expected ErrMethodTimeout got %v", result.Error)
+	}
+}
+
+type Impostor int
+
+func (i *Impostor) Fail(args Args, reply *Reply) error {
+	return NewServerError(args.A, "impostor", "data")
+}
+
+func TestRPC_StrictErrorCodes(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Impostor))
+
+	tests := []struct {
+		code         int
+		strict       bool
+		expectedCode int
+	}{
+		{ERR_NO_METHOD, false, ERR_NO_METHOD},
+		{ERR_NO_METHOD, true, ERR_SERVER},
+		{ERR_SERVER - 1, true, ERR_SERVER},
+		{ERR_SERVER, true, ERR_SERVER},
+		{-31999, true, -31999},
+		{42, true, 42},
+	}
+	for _, tt := range tests {
+		server.SetStrictErrorCodes(tt.strict)
+
+		result := server.ServeRequest(newTestRequest("Impostor", "Fail", &Args{tt.code, 0}))
+		serr, ok := result.Error.(*ServerError)
+		if !ok {
+			t.Errorf("code %d: expected a ServerError got %v", tt.code, result.Error)
+			continue
+		}
+		if serr.Code != tt.expectedCode || serr.Message != "impostor" || serr.Data != "data" {
+			t.Errorf("code %d, strict %v: expected code %d got %+v", tt.code, tt.strict, tt.expectedCode, serr)
+		}
+	}
+
+	// The server's own errors keep their code
+	result := server.ServeRequest(newTestRequest("Impostor", "Unknown", &Args{}))
+	if !errors.Is(result.Error, ErrMethodNotFound) {
+		t.Errorf("expected ErrMethodNotFound got %v", result.Error)
+	}
+}
+
+func TestRPC_ArgsMiddleware(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+
+	var seen []string
+	server.UseArgsMiddleware(
+		func(req Request, args interface{}) error {
+			seen = append(seen, req.ServiceName() + "." + req.MethodName())
+			return nil
+		},
+		func(req Request, args interface{}) error {
+			if req.ServiceName() != "Arith" || req.MethodName() != "Add" {
+				return nil
 			}
-			if reply, ok := result.Value.(*Reply); !ok || reply.C != args.A + args.B {
-				b.Fatalf("Add: expected %d got %d", args.A + args.B, reply.C)
+			if a := args.(Args); a.A < 0 || a.B < 0 {
+				return NewServerError(ERR_BAD_PARAMS, "negative number", a)
 			}
-		}	
-	})
+			return nil
+		},
+	)
+
+	result := server.ServeRequest(newTestRequest("Arith", "Add", &Args{7, 8}))
+	if result.Error != nil {
+		t.Fatal("Add: unexpected error", result.Error)
+	}
+	if reply := result.Value.(*Reply); reply.C != 15 {
+		t.Errorf("Add: expected 15 got %d", reply.C)
+	}
+
+	result = server.ServeRequest(newTestRequest("Arith", "Add", &Args{7, -8}))
+	serr, ok := result.Error.(*ServerError)
+	if !ok || serr.Code != ERR_BAD_PARAMS || serr.Message != "negative number" {
+		t.Errorf("Add: expected a negative number error got %v", result.Error)
+	}
+	if result.Value != nil {
+		t.Errorf("Add: expected no reply got %v", result.Value)
+	}
+
+	// Mul takes *Args and is not checked
+	result = server.ServeRequest(newTestRequest("Arith", "Mul", &Args{7, -8}))
+	if result.Error != nil {
+		t.Fatal("Mul: unexpected error", result.Error)
+	}
+	if reply := result.Value.(*Reply); reply.C != -56 {
+		t.Errorf("Mul: expected -56 got %d", reply.C)
+	}
+
+	expected := []string{"Arith.Add", "Arith.Add", "Arith.Mul"}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("expected middleware to see %v got %v", expected, seen)
+	}
+}
+
+type Catalog int
+
+type Item struct {
+	Name  string            `json:"name"`
+	Tags  []string          `json:"tags,omitempty"`
+	Attrs map[string]int    `json:"attrs"`
+	Price *float64          `json:"price"`
+	Added time.Time         `json:"added"`
+	Skip  int               `json:"-"`
+	Parts []*Item           `json:"parts"`
+	Blob  []byte            `json:"blob"`
+	Extra interface{}       `json:"extra"`
+	hidden int
+}
+
+type Page struct {
+	Items []Item
+	Total int `json:"total"`
+}
+
+func (c *Catalog) List(args Args, reply *Page) error {
+	return nil
+}
+
+func TestRPC_Schema(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	server.Register(new(Catalog))
+
+	schema := server.Schema()
+
+	add := schema["Arith.Add"]
+	if add == nil {
+		t.Fatal("expected a schema for Arith.Add")
+	}
+	expectedArgs := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{"A": {Type: "integer"}, "B": {Type: "integer"}},
+		Required: []string{"A", "B"},
+	}
+	if !reflect.DeepEqual(add.Params, expectedArgs) {
+		t.Errorf("Add params: expected %+v got %+v", expectedArgs, add.Params)
+	}
+	expectedReply := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{"C": {Type: "integer"}},
+		Required: []string{"C"},
+	}
+	if !reflect.DeepEqual(add.Result, expectedReply) {
+		t.Errorf("Add result: expected %+v got %+v", expectedReply, add.Result)
+	}
+	if mul := schema["Arith.Mul"]; mul == nil || !reflect.DeepEqual(mul.Params, expectedArgs) {
+		t.Errorf("Mul params: expected %+v got %+v", expectedArgs, mul)
+	}
+
+	page := schema["Catalog.List"].Result
+	items := page.Properties["Items"]
+	if items == nil || items.Type != "array" || items.Items.Type != "object" {
+		t.Fatalf("expected Items to be an array of objects got %+v", items)
+	}
+	item := items.Items
+	expected := map[string]*Schema{
+		"name":  {Type: "string"},
+		"tags":  {Type: "array", Items: &Schema{Type: "string"}},
+		"attrs": {Type: "object", AdditionalProperties: &Schema{Type: "integer"}},
+		"price": {Type: "number"},
+		"added": {Type: "string", Format: "date-time"},
+		"parts": {Type: "array", Items: &Schema{Type: "object"}}, // recursive
+		"blob":  {Type: "string", Format: "byte"},
+		"extra": {},
+	}
+	if !reflect.DeepEqual(item.Properties, expected) {
+		for name, s := range item.Properties {
+			t.Logf("%s: %+v", name, s)
+		}
+		t.Errorf("Item: unexpected properties")
+	}
+	expectedRequired := []string{"name", "attrs", "added", "parts", "blob", "extra"}
+	if !reflect.DeepEqual(item.Required, expectedRequired) {
+		t.Errorf("Item: expected required %v got %v", expectedRequired, item.Required)
+	}
+	if !reflect.DeepEqual(page.Required, []string{"Items", "total"}) {
+		t.Errorf("Page: expected required [Items total] got %v", page.Required)
+	}
+}
+
+func TestRPC_RegisterAll(t *testing.T) {
+	server := NewServer()
+
+	err := server.RegisterAll(map[string]interface{}{
+		"":         new(Arith),
+		"v1.math":  new(Arith),
+		"Catalog":  new(Catalog),
+	})
+	if err != nil {
+		t.Fatal("RegisterAll:", err)
+	}
+	for _, name := range []string{"Arith", "v1.math", "Catalog"} {
+		if server.serviceMap[name] == nil {
+			t.Errorf("expected %s to be registered", name)
+		}
+	}
+
+	result := server.ServeRequest(newTestRequest("v1.math", "Add", &Args{7, 8}))
+	if result.Error != nil || result.Value.(*Reply).C != 15 {
+		t.Errorf("v1.math.Add: expected 15 got %v, %v", result.Value, result.Error)
+	}
+
+	// Nothing is registered when one fails
+	err = server.RegisterAll(map[string]interface{}{
+		"a.math": new(Arith),
+		"b.math": new(NeedsPtrType),
+		"Arith":  new(Arith),
+	})
+	if err == nil {
+		t.Fatal("RegisterAll: expected an error for Arith")
+	}
+	if server.serviceMap["a.math"] != nil || server.serviceMap["b.math"] != nil {
+		t.Error("expected a failed RegisterAll to register nothing")
+	}
+
+	if err := server.RegisterAll(map[string]interface{}{"bad..name": new(Arith)}); err == nil {
+		t.Error("RegisterAll: expected an error for an invalid name")
+	}
+}
+
+func TestRPC_HasMethod(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	server.RegisterVersion("Calc", "v2", new(ArithV2))
+
+	tests := []struct {
+		service, method string
+		expected        bool
+	}{
+		{"Arith", "Add", true},
+		{"Arith", "Pow", false},
+		{"Unknown", "Add", false},
+		{"Calc", "Add", true},
+		{"Calc@v2", "Add", true},
+		{"Calc@v3", "Add", false},
+		{"Calc", "Mul", false},
+	}
+	for _, tt := range tests {
+		if got := server.HasMethod(tt.service, tt.method); got != tt.expected {
+			t.Errorf("HasMethod(%q, %q): expected %v got %v", tt.service, tt.method, tt.expected, got)
+		}
+	}
+}
+
+// keyedRequest is a testRequest carrying an idempotency key.
+type keyedRequest struct {
+	*testRequest
+	key string
+}
+
+func (r keyedRequest) IdempotencyKey() string {
+	return r.key
+}
+
+// DecodeParams gives the args as JSON too, as transports do, for the
+// server to hash them.
+func (r keyedRequest) DecodeParams(args interface{}) error {
+	if raw, ok := args.(*json.RawMessage); ok {
+		data, err := json.Marshal(r.args)
+		*raw = data
+		return err
+	}
+	return r.testRequest.DecodeParams(args)
+}
+
+func TestRPC_ResultCache(t *testing.T) {
+	server := NewServer()
+	counter := new(Counter)
+	server.Register(counter)
+	server.SetResultCache(NewMemoryCache(50 * time.Millisecond))
+
+	call := func(key string) int32 {
+		result := server.ServeRequest(keyedRequest{newTestRequest("Counter", "Hit", &Args{}), key})
+		if result.Error != nil {
+			t.Fatalf("Hit %q: unexpected error %v", key, result.Error)
+		}
+		return *result.Value.(*int32)
+	}
+
+	if hits := call("k1"); hits != 1 {
+		t.Errorf("k1: expected 1 hit got %d", hits)
+	}
+	if hits := call("k1"); hits != 1 {
+		t.Errorf("k1 retried: expected the cached hit 1 got %d", hits)
+	}
+	if hits := call("k2"); hits != 2 {
+		t.Errorf("k2: expected 2 hits got %d", hits)
+	}
+
+	// Requests without a key are never cached
+	if hits := call(""); hits != 3 {
+		t.Errorf("no key: expected 3 hits got %d", hits)
+	}
+	if hits := call(""); hits != 4 {
+		t.Errorf("no key: expected 4 hits got %d", hits)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if hits := call("k1"); hits != 5 {
+		t.Errorf("k1 expired: expected 5 hits got %d", hits)
+	}
+	if n := atomic.LoadInt32(&counter.hits); n != 5 {
+		t.Errorf("expected the method to run 5 times got %d", n)
+	}
+}
+
+// Slow counts its calls, taking args.A milliseconds to complete them.
+type Slow struct {
+	hits int32
+}
+
+func (s *Slow) Hit(args Args, reply *int32) error {
+	*reply = atomic.AddInt32(&s.hits, 1)
+	time.Sleep(time.Duration(args.A) * time.Millisecond)
+	return nil
+}
+
+func TestRPC_ResultCacheFailures(t *testing.T) {
+	server := NewServer()
+	slow := new(Slow)
+	server.Register(slow)
+	server.SetResultCache(NewMemoryCache(time.Minute))
+	server.SetMethodTimeout(20 * time.Millisecond)
+
+	call := func(ms int) *Result {
+		return server.ServeRequest(keyedRequest{newTestRequest("Slow", "Hit", &Args{A: ms}), "k"})
+	}
+
+	if result := call(50); result.Error != ErrMethodTimeout {
+		t.Fatalf("expected ErrMethodTimeout got %v", result.Error)
+	}
+
+	// The timeout isn't cached, the retry runs the method again
+	result := call(0)
+	if result.Error != nil || *result.Value.(*int32) != 2 {
+		t.Fatalf("retry: expected hit 2 got %v, %v", result.Value, result.Error)
+	}
+	if result := call(0); result.Error != nil || *result.Value.(*int32) != 2 {
+		t.Errorf("retried again: expected the cached hit 2 got %v, %v", result.Value, result.Error)
+	}
+}
+
+func TestRPC_ResultCacheInFlight(t *testing.T) {
+	server := NewServer()
+	slow := new(Slow)
+	server.Register(slow)
+	server.SetResultCache(NewMemoryCache(time.Minute))
+
+	first := make(chan *Result, 1)
+	go func() {
+		first <- server.ServeRequest(keyedRequest{newTestRequest("Slow", "Hit", &Args{A: 50}), "k"})
+	}()
+	for atomic.LoadInt32(&slow.hits) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The retry waits for the call running rather than running it again
+	retry := server.ServeRequest(keyedRequest{newTestRequest("Slow", "Hit", &Args{A: 50}), "k"})
+	if retry.Error != nil || *retry.Value.(*int32) != 1 {
+		t.Errorf("retry: expected the hit 1 of the first call got %v, %v", retry.Value, retry.Error)
+	}
+	if result := <-first; result.Error != nil || *result.Value.(*int32) != 1 {
+		t.Errorf("first: expected hit 1 got %v, %v", result.Value, result.Error)
+	}
+	if n := atomic.LoadInt32(&slow.hits); n != 1 {
+		t.Errorf("expected the method to run once got %d", n)
+	}
+}
+
+func TestRPC_ResultCacheKeyReused(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	server.SetResultCache(NewMemoryCache(time.Minute))
+
+	call := func(key string, args *Args) *Result {
+		return server.ServeRequest(keyedRequest{newTestRequest("Arith", "Add", args), key})
+	}
+
+	if result := call("k", &Args{1, 2}); result.Error != nil || result.Value.(*Reply).C != 3 {
+		t.Fatalf("Add: expected 3 got %v, %v", result.Value, result.Error)
+	}
+	if result := call("k", &Args{1, 2}); result.Error != nil || result.Value.(*Reply).C != 3 {
+		t.Errorf("Add retried: expected the cached 3 got %v, %v", result.Value, result.Error)
+	}
+
+	// The key of another call isn't answered with its result
+	result := call("k", &Args{5, 6})
+	if result.Error != ErrKeyReused {
+		t.Errorf("Add with other params: expected ErrKeyReused got %v, %v", result.Value, result.Error)
+	}
+	if serr, ok := result.Error.(*ServerError); !ok || serr.Code != ERR_INVALID_REQ {
+		t.Errorf("Add with other params: expected ERR_INVALID_REQ got %v", result.Error)
+	}
+	if result := call("k2", &Args{5, 6}); result.Error != nil || result.Value.(*Reply).C != 11 {
+		t.Errorf("Add with another key: expected 11 got %v, %v", result.Value, result.Error)
+	}
+}
+
+func TestRPC_ServerErrorUnmarshalData(t *testing.T) {
+	type Detail struct {
+		Field  string
+		Reason string
+	}
+	want := Detail{"A", "negative"}
+
+	tests := []struct {
+		name string
+		data interface{}
+	}{
+		{"raw", json.RawMessage(`{"Field":"A","Reason":"negative"}`)},
+		{"value", want},
+		{"map", map[string]string{"field": "A", "reason": "negative"}},
+	}
+	for _, tt := range tests {
+		var got Detail
+		if err := NewServerError(ERR_BAD_PARAMS, "invalid", tt.data).UnmarshalData(&got); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if got != want {
+			t.Errorf("%s: expected %+v got %+v", tt.name, want, got)
+		}
+	}
+
+	var got Detail
+	if err := NewServerError(ERR_SERVER, "no data", nil).UnmarshalData(&got); err != nil || got != (Detail{}) {
+		t.Errorf("no data: expected nothing decoded got %+v, %v", got, err)
+	}
+}
+
+func TestRPC_RegisterErrorCode(t *testing.T) {
+	errNotFound := errors.New("not found")
+	errGone := errors.New("gone")
+
+	RegisterErrorCode(errNotFound, ERR_SERVER - 10)
+	RegisterErrorCode(errGone, ERR_SERVER - 11)
+	RegisterErrorCode(errGone, ERR_SERVER - 12)
+
+	tests := []struct {
+		err  error
+		code int
+		ok   bool
+	}{
+		{errNotFound, ERR_SERVER - 10, true},
+		{fmt.Errorf("lookup: %w", errNotFound), ERR_SERVER - 10, true},
+		{fmt.Errorf("outer: %w", fmt.Errorf("inner: %w", errGone)), ERR_SERVER - 12, true},
+		{errors.New("not found"), 0, false},
+	}
+	for _, tt := range tests {
+		code, ok := ErrorCode(tt.err)
+		if code != tt.code || ok != tt.ok {
+			t.Errorf("ErrorCode(%v): expected %d, %v got %d, %v", tt.err, tt.code, tt.ok, code, ok)
+		}
+	}
+}
+
+func TestRPC_DispatchTo(t *testing.T) {
+	once.Do(startServer)
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]*Result)
+	)
+
+	// A single sink for every request, correlating results by id like a
+	// multiplexed transport would.
+	sink := ResultSinkFunc(func(req Request, result *Result) {
+		mu.Lock()
+		results[req.(RequestIDer).RequestID()] = result
+		mu.Unlock()
+		wg.Done()
+	})
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		req := &testRequest{serviceName: "Arith", methodName: "Mul", args: Args{i, 3}}
+		srv.DispatchTo(idRequest{req, fmt.Sprint(i)}, sink)
+	}
+	wg.Wait()
+
+	if len(results) != n {
+		t.Fatalf("expected %d results got %d", n, len(results))
+	}
+	for i := 0; i < n; i++ {
+		result := results[fmt.Sprint(i)]
+		if result.Error != nil {
+			t.Errorf("Mul: expected no error but got string %q", result.Error.Error())
+		} else if reply := result.Value.(*Reply); reply.C != i * 3 {
+			t.Errorf("Mul: expected %d got %d", i * 3, reply.C)
+		}
+	}
+}
+
+func TestRPC_DispatchExpired(t *testing.T) {
+	once.Do(startServer)
+
+	counter := new(Counter)
+	if err := srv.Register(counter); err != nil {
+		t.Fatal("Register Counter:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result := srv.Dispatch(ctxRequest{newTestRequest("Counter", "Hit", &Args{}), ctx})
+	if result.Error != ErrTimeout {
+		t.Errorf("Hit: expected ErrTimeout got %v", result.Error)
+	}
+	if hits := atomic.LoadInt32(&counter.hits); hits != 0 {
+		t.Errorf("Hit: expected the expired request to be skipped, ran %d times", hits)
+	}
+
+	// Live contexts are served as usual
+	result = srv.Dispatch(ctxRequest{newTestRequest("Counter", "Hit", &Args{}), context.Background()})
+	if result.Error != nil {
+		t.Fatalf("Hit: expected no error but got string %q", result.Error.Error())
+	}
+	if hits := *result.Value.(*int32); hits != 1 {
+		t.Errorf("Hit: expected 1 hit got %d", hits)
+	}
+}
+
+func TestRPC_DispatchAbandoned(t *testing.T) {
+	server := NewServer()
+	gate := &Gate{make(chan struct{})}
+	server.Register(gate)
+
+	// The caller goes away while its request is being served
+	ctx, cancel := context.WithCancel(context.Background())
+	dispatched := make(chan *Result)
+	go func() {
+		dispatched <- server.Dispatch(ctxRequest{newTestRequest("Gate", "Wait", &Args{}), ctx})
+	}()
+	for server.Stats().Busy == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case result := <-dispatched:
+		if result.Error != ErrTimeout {
+			t.Errorf("Wait: expected ErrTimeout got %v", result.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait: expected Dispatch to return once the context is done")
+	}
+
+	// Nobody reads the result, the worker must not block on it
+	close(gate.open)
+	deadline := time.Now().Add(time.Second)
+	for server.Stats().Served == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := server.Stats(); stats.Served != 1 || stats.Busy != 0 {
+		t.Errorf("expected the worker to complete the abandoned request got %+v", stats)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: expected no request left in flight got %v", err)
+	}
+}
+
+// Gate blocks its callers until open is closed.
+type Gate struct {
+	open chan struct{}
+}
+
+func (g *Gate) Wait(args Args, reply *int) error {
+	<-g.open
+	return nil
+}
+
+func TestRPC_Stats(t *testing.T) {
+	server := NewServer()
+	gate := &Gate{make(chan struct{})}
+	if err := server.Register(gate); err != nil {
+		t.Fatal("Register Gate:", err)
+	}
+
+	// Polls server stats until cond holds, the workers update them
+	// concurrently with the callers.
+	waitStats := func(cond func(Stats) bool) Stats {
+		deadline := time.Now().Add(time.Second)
+		for {
+			stats := server.Stats()
+			if cond(stats) || time.Now().After(deadline) {
+				return stats
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	stats := server.Stats()
+	if stats.Workers != *nWorkers || stats.Busy != 0 || stats.Idle != *nWorkers || stats.Served != 0 {
+		t.Errorf("expected %d idle workers and nothing served got %+v", *nWorkers, stats)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Dispatch(newTestRequest("Gate", "Wait", &Args{}))
+		}()
+	}
+
+	stats = waitStats(func(s Stats) bool { return s.Busy == 3 })
+	if stats.Busy != 3 || stats.Idle != *nWorkers - 3 || stats.Queued != 0 {
+		t.Errorf("expected 3 busy workers got %+v", stats)
+	}
+
+	// Past the workers requests wait in the queue
+	for i := 3; i < *nWorkers + 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Dispatch(newTestRequest("Gate", "Wait", &Args{}))
+		}()
+	}
+
+	stats = waitStats(func(s Stats) bool { return s.Busy == *nWorkers && s.Queued == 2 })
+	if stats.Busy != *nWorkers || stats.Idle != 0 || stats.Queued != 2 {
+		t.Errorf("expected every worker busy and 2 requests queued got %+v", stats)
+	}
+
+	close(gate.open)
+	wg.Wait()
+
+	served := uint64(*nWorkers + 2)
+	stats = waitStats(func(s Stats) bool { return s.Busy == 0 && s.Served == served })
+	if stats.Busy != 0 || stats.Served != served || stats.Queued != 0 {
+		t.Errorf("expected %d requests served and no busy worker got %+v", served, stats)
+	}
+}
+
+func TestRPC_Shutdown(t *testing.T) {
+	server := NewServer()
+	gate := &Gate{make(chan struct{})}
+	server.Register(gate)
+
+	// A call in flight
+	served := make(chan *Result)
+	go func() {
+		served <- server.Dispatch(newTestRequest("Gate", "Wait", &Args{}))
+	}()
+	for server.Stats().Busy == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- server.Shutdown(context.Background())
+	}()
+	for !server.ShuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// New requests are refused while the call drains
+	if result := server.Dispatch(newTestRequest("Gate", "Wait", &Args{})); result.Error != ErrShutdown {
+		t.Errorf("expected ErrShutdown got %v", result.Error)
+	}
+
+	select {
+	case err := <-stopped:
+		t.Fatalf("Shutdown returned before the call in flight completed: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(gate.open)
+	if result := <-served; result.Error != nil {
+		t.Errorf("Wait: expected no error but got string %q", result.Error.Error())
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
+
+func TestRPC_SetReady(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+
+	server.SetReady(false)
+	if result := server.Dispatch(newTestRequest("Arith", "Add", &Args{1, 2})); result.Error != ErrNotReady {
+		t.Errorf("not ready: expected ErrNotReady got %v", result.Error)
+	}
+
+	server.SetReady(true)
+	result := server.Dispatch(newTestRequest("Arith", "Add", &Args{1, 2}))
+	if result.Error != nil {
+		t.Fatalf("ready: expected no error but got string %q", result.Error.Error())
+	}
+	if reply, ok := result.Value.(*Reply); !ok || reply.C != 3 {
+		t.Errorf("ready: expected 3 got %v", result.Value)
+	}
+}
+
+func TestRPC_ShutdownDeadline(t *testing.T) {
+	server := NewServer()
+	gate := &Gate{make(chan struct{})}
+	defer close(gate.open)
+	server.Register(gate)
+
+	go server.Dispatch(newTestRequest("Gate", "Wait", &Args{}))
+	for server.Stats().Busy == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+	defer cancel()
+
+	// Wait ignores cancellation, Shutdown gives up on it
+	start := time.Now()
+	err := server.Shutdown(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown returned %v after its deadline", elapsed)
+	}
+
+	var forced *ForcedShutdownError
+	if !errors.As(err, &forced) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a forced shutdown error got %v", err)
+	}
+	if len(forced.Running) != 1 || forced.Running[0] != "Gate.Wait" {
+		t.Errorf("expected Gate.Wait still running got %v", forced.Running)
+	}
+}
+
+// A worker delivering a result nobody reads is freed by a forced shutdown.
+func TestRPC_UnreadResult(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+
+	// The result channel is not buffered, and not read
+	req := newTestRequest("Arith", "Add", &Args{1, 2})
+	req.result = make(chan *Result)
+	if !server.admit() {
+		t.Fatal("expected the request to be admitted")
+	}
+	server.enqueue(job{req: req, sink: channelSink{server.forced}})
+	for server.Stats().Busy == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a forced shutdown got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("expected the worker to drop the result and the server to stop got %v", err)
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+type Echo int
+
+func (t *Echo) Echo(args Args, reply *Reply) error {
+	reply.C = args.A
+	return nil
+}
+
+// Services registered while the worker pool is serving traffic must become
+// callable without racing the readers of the service map.
+func TestRPC_RegisterWhileServing(t *testing.T) {
+	once.Do(startServer)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(done)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		args := &Args{7, 8}
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			result := srv.Dispatch(newTestRequest("Arith", "Add", args))
+			if result.Error != nil {
+				t.Errorf("Add: expected no error but got string %q", result.Error.Error())
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("Echo%d", i)
+		if err := srv.RegisterName(name, new(Echo)); err != nil {
+			t.Fatalf("RegisterName %s: %v", name, err)
+		}
+
+		args := &Args{i, 0}
+		result := srv.ServeRequest(newTestRequest(name, "Echo", args))
+		if result.Error != nil {
+			t.Errorf("%s.Echo: expected no error but got string %q", name, result.Error.Error())
+		} else if reply, ok := result.Value.(*Reply); !ok || reply.C != i {
+			t.Errorf("%s.Echo: expected %d got %v", name, i, result.Value)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+type Recycled int
+
+// Set fails when handed args or a reply left over from a previous call.
+func (t *Recycled) Set(args *Args, reply *Reply) error {
+	if args.B != 0 || reply.C != 0 {
+		return errors.New("value not reset")
+	}
+	reply.C = args.A
+	args.B = args.A
+	return nil
+}
+
+// partialRequest only decodes the A field of the args, as a transport
+// would for params that leave fields out.
+type partialRequest struct {
+	*testRequest
+}
+
+func (r partialRequest) DecodeParams(args interface{}) error {
+	if a, ok := args.(*Args); ok {
+		a.A = r.args.A
+	}
+	return nil
+}
+
+func TestRPC_ValuePooling(t *testing.T) {
+	pooled := NewServer()
+	pooled.Register(new(Arith))
+	pooled.Register(new(Recycled))
+	pooled.SetValuePooling(true)
+
+	for i := 1; i <= 10; i++ {
+		// Value args
+		args := &Args{i, 2}
+		result := pooled.ServeRequest(newTestRequest("Arith", "Add", args))
+		if result.Error != nil {
+			t.Fatalf("Add: expected no error but got string %q", result.Error.Error())
+		}
+		if reply, ok := result.Value.(*Reply); !ok || reply.C != args.A + args.B {
+			t.Errorf("Add: expected %d got %v", args.A + args.B, result.Value)
+		}
+		result.Release()
+
+		// Pointer args
+		result = pooled.ServeRequest(newTestRequest("Arith", "Mul", args))
+		if result.Error != nil {
+			t.Fatalf("Mul: expected no error but got string %q", result.Error.Error())
+		}
+		if reply, ok := result.Value.(*Reply); !ok || reply.C != args.A * args.B {
+			t.Errorf("Mul: expected %d got %v", args.A * args.B, result.Value)
+		}
+		result.Release()
+
+		// Recycled values must come back zeroed
+		req := partialRequest{newTestRequest("Recycled", "Set", &Args{i, 0})}
+		result = pooled.ServeRequest(req)
+		if result.Error != nil {
+			t.Fatalf("Set: expected no error but got string %q", result.Error.Error())
+		}
+		if reply, ok := result.Value.(*Reply); !ok || reply.C != i {
+			t.Errorf("Set: expected %d got %v", i, result.Value)
+		}
+		result.Release()
+	}
+}
+
+// Receivers published under bulkServices names, for the registration
+// benchmarks.
+func bulkServices() map[string]interface{} {
+	rcvrs := make(map[string]interface{})
+	for i := 0; i < 200; i++ {
+		rcvrs[fmt.Sprintf("arith%d", i)] = new(Arith)
+		rcvrs[fmt.Sprintf("catalog%d", i)] = new(Catalog)
+	}
+	return rcvrs
+}
+
+func BenchmarkRegisterName(b *testing.B) {
+	rcvrs := bulkServices()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		server := new(Server)
+		for name, rcvr := range rcvrs {
+			if err := server.RegisterName(name, rcvr); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkRegisterAll(b *testing.B) {
+	rcvrs := bulkServices()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		server := new(Server)
+		if err := server.RegisterAll(rcvrs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkServeRequest(b *testing.B) {
+	once.Do(startServer)
+
+	// Good call
+	args := &Args{7, 0}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		req := newTestRequest("Arith", "Add", args)
+		result := srv.ServeRequest(req) 
+		// expect an error
+		if result.Error != nil {
+			b.Fatalf("Add: expected no error but got string %q", result.Error.Error())
+		}
+		if reply, ok := result.Value.(*Reply); !ok || reply.C != args.A + args.B {
+			b.Fatalf("Add: expected %d got %d", args.A + args.B, reply.C)
+		}	
+	}
+}
+
+func BenchmarkServeRequestSeveralArgs(b *testing.B) {
+	server := NewServer()
+	if err := server.Register(new(Adder)); err != nil {
+		b.Fatal("Register Adder:", err)
+	}
+
+	values := []interface{}{4, 5}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		result := server.ServeRequest(fieldsRequest{newTestRequest("Adder", "Add", &Args{}), values})
+		if result.Error != nil {
+			b.Fatalf("Add: expected no error but got string %q", result.Error.Error())
+		}
+		if sum := *result.Value.(*int); sum != 9 {
+			b.Fatalf("Add: expected 9 got %d", sum)
+		}
+	}
+}
+
+func BenchmarkServeRequestParallel(b *testing.B) {
+	once.Do(startServer)
+
+	// Good call
+	args := &Args{7, 0}
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := newTestRequest("Arith", "Add", args)
+			result := srv.ServeRequest(req) 
+			// expect an error
+			if result.Error != nil {
+				b.Fatalf("Add: expected no error but got string %q", result.Error.Error())
+			}
+			if reply, ok := result.Value.(*Reply); !ok || reply.C != args.A + args.B {
+				b.Fatalf("Add: expected %d got %d", args.A + args.B, reply.C)
+			}
+		}	
+	})
+}
+
+
+func BenchmarkServeRequestParallelPooled(b *testing.B) {
+	pooled := NewServer()
+	pooled.Register(new(Arith))
+	pooled.SetValuePooling(true)
+
+	// Good call
+	args := &Args{7, 0}
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := newTestRequest("Arith", "Add", args)
+			result := pooled.ServeRequest(req)
+			if result.Error != nil {
+				b.Fatalf("Add: expected no error but got string %q", result.Error.Error())
+			}
+			if reply, ok := result.Value.(*Reply); !ok || reply.C != args.A + args.B {
+				b.Fatalf("Add: expected %d got %d", args.A + args.B, reply.C)
+			}
+			result.Release()
+		}
+	})
+}
+
+func BenchmarkDispatchParallel(b *testing.B) {
+	once.Do(startServer)
+
+	// Good call
+	args := &Args{7, 0}
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := newTestRequest("Arith", "Add", args)
+			result := srv.Dispatch(req)
+			if result.Error != nil {
+				b.Fatalf("Add: expected no error but got string %q", result.Error.Error())
+			}
+			if reply, ok := result.Value.(*Reply); !ok || reply.C != args.A + args.B {
+				b.Fatalf("Add: expected %d got %d", args.A + args.B, reply.C)
+			}
+		}
+	})
+}
+
+// Feed serves the events of its source as long polls, the subscription
+// id in Args.A.
+type Feed struct {
+	events *EventSource
+}
+
+func (f *Feed) Next(ctx context.Context, args Args, reply *Reply) error {
+	sub, ok := f.events.Lookup(strconv.Itoa(args.A))
+	if !ok {
+		return errors.New("unknown subscription")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 300 * time.Millisecond)
+	defer cancel()
+
+	event, err := sub.Next(ctx)
+	if err != nil {
+		return err
+	}
+	reply.C = event.(int)
+	return nil
+}
+
+func TestRPC_LongPoll(t *testing.T) {
+	server := NewServer()
+	feed := &Feed{NewEventSource(4)}
+	server.Register(feed)
+	server.Register(new(Arith))
+	server.SetLongPoll(100, "Feed.Next")
+
+	poll := func(sub *Subscription) *testRequest {
+		id, _ := strconv.Atoi(sub.ID)
+		return newTestRequest("Feed", "Next", &Args{A: id})
+	}
+
+	// More polls block than there are workers
+	n := *nWorkers * 2
+	results := make(chan *Result, n)
+	sink := ResultSinkFunc(func(req Request, result *Result) { results <- result })
+	for i := 0; i < n; i++ {
+		server.DispatchTo(poll(feed.events.Subscribe()), sink)
+	}
+
+	// without holding up the other calls
+	done := make(chan *Result, 1)
+	go func() { done <- server.Dispatch(newTestRequest("Arith", "Add", &Args{1, 2})) }()
+	select {
+	case result := <-done:
+		if result.Error != nil || result.Value.(*Reply).C != 3 {
+			t.Errorf("Add: expected 3 got %v, %v", result.Value, result.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Add: starved by the long polls")
+	}
+
+	feed.events.Publish(42)
+	for i := 0; i < n; i++ {
+		select {
+		case result := <-results:
+			if result.Error != nil || result.Value.(*Reply).C != 42 {
+				t.Errorf("Next: expected 42 got %v, %v", result.Value, result.Error)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Next: %d polls of %d answered", i, n)
+		}
+	}
+
+	// A poll without event answers no content, for the client to poll again
+	sub := feed.events.Subscribe()
+	result := server.Dispatch(poll(sub))
+	if result.Error != nil || result.Value != nil {
+		t.Errorf("Next: expected no content got %v, %v", result.Value, result.Error)
+	}
+
+	// and one whose subscription is closed fails
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		feed.events.Unsubscribe(sub.ID)
+	}()
+	result = server.Dispatch(poll(sub))
+	if !errors.Is(result.Error, ErrUnsubscribed) {
+		t.Errorf("Next: expected ErrUnsubscribed got %v", result.Error)
+	}
+	if sub.Context().Err() == nil {
+		t.Errorf("expected the context of the subscription to be done")
+	}
+}
+
+func TestRPC_RegisterWithNames(t *testing.T) {
+	server := NewServer()
+	if err := server.RegisterWithNames("arith", new(Arith), map[string]string{"Add": "sum"}); err != nil {
+		t.Fatal("RegisterWithNames:", err)
+	}
+
+	result := server.ServeRequest(newTestRequest("arith", "sum", &Args{7, 8}))
+	if result.Error != nil || result.Value.(*Reply).C != 15 {
+		t.Errorf("arith.sum: expected 15 got %v, %v", result.Value, result.Error)
+	}
+
+	// The Go name is no longer published, other methods keep theirs
+	if server.HasMethod("arith", "Add") {
+		t.Errorf("expected arith.Add not to be published")
+	}
+	if !server.HasMethod("arith", "Mul") {
+		t.Errorf("expected arith.Mul to be published")
+	}
+
+	for _, names := range []map[string]string{
+		{"Sum": "sum"},              // no such method
+		{"Add": "a.b"},              // invalid name
+		{"Add": "Mul"},              // shared with Mul
+	} {
+		if err := server.RegisterWithNames("arith2", new(Arith), names); err == nil {
+			t.Errorf("RegisterWithNames %v: expected an error", names)
+		}
+		if server.HasMethod("arith2", "Mul") {
+			t.Errorf("RegisterWithNames %v: expected nothing to be registered", names)
+		}
+	}
+}
+
+func TestRPC_MethodInfo(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Tracer))
+	if err := server.RegisterWithNames("arith", new(Arith), map[string]string{"Add": "sum"}); err != nil {
+		t.Fatal("RegisterWithNames:", err)
+	}
+
+	s, ok := server.Service("arith")
+	if !ok || s.Name() != "arith" {
+		t.Fatalf("Service: expected arith got %v, %v", s, ok)
+	}
+	if _, ok := server.Service("Nope"); ok {
+		t.Errorf("Service: expected Nope not to be found")
+	}
+
+	info, ok := s.Method("sum")
+	if !ok {
+		t.Fatal("Method: expected sum to be found")
+	}
+	if info.Method.Name != "Add" || info.ArgsType != reflect.TypeOf(Args{}) ||
+		info.ReplyType != reflect.TypeOf(&Reply{}) || info.HasContext {
+		t.Errorf("Method: unexpected info for sum %+v", info)
+	}
+	if _, ok := s.Method("Add"); ok {
+		t.Errorf("Method: expected Add not to be published")
+	}
+
+	if names := s.Methods(); len(names) == 0 || names[len(names) - 1] != "sum" {
+		t.Errorf("Methods: expected sum last got %v", names)
+	}
+
+	s, _ = server.Service("Tracer")
+	if info, ok := s.Method("ID"); !ok || !info.HasContext {
+		t.Errorf("Method: expected Tracer.ID to take a context got %+v", info)
+	}
+}
+
+type Panicker int
+
+func (t *Panicker) Boom(args Args, reply *Reply) error {
+	panic("boom")
+}
+
+func TestRPC_PanicHandler(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Panicker))
+	// Run the method on a goroutine of its own, the panic must not escape it
+	server.SetMethodTimeoutFor("Panicker.Boom", time.Second)
+
+	// By default the panic is answered as an internal error
+	result := server.ServeRequest(newTestRequest("Panicker", "Boom", &Args{1, 2}))
+	if serr, ok := result.Error.(*ServerError); !ok || serr.Code != ERR_INTERNAL {
+		t.Errorf("Boom: expected an internal error got %v", result.Error)
+	}
+
+	var recovered interface{}
+	var stack string
+	server.SetPanicHandler(func(req Request, r interface{}) *Result {
+		recovered, stack = r, string(debug.Stack())
+		return NewResult(nil, NewServerError(ERR_SERVER, "out of order", req.MethodName()))
+	})
+
+	result = server.ServeRequest(newTestRequest("Panicker", "Boom", &Args{1, 2}))
+	if serr, ok := result.Error.(*ServerError); !ok || serr.Message != "out of order" || serr.Data != "Boom" {
+		t.Errorf("Boom: expected the handler's error got %v", result.Error)
+	}
+	if recovered != "boom" {
+		t.Errorf("handler: expected boom got %v", recovered)
+	}
+	if !strings.Contains(stack, "Panicker).Boom") {
+		t.Errorf("handler: expected the stack to show Boom got %s", stack)
+	}
 }
@@ -5,7 +5,16 @@
 package rpc
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"reflect"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -19,12 +28,130 @@ type Service struct {
 	rcvr   reflect.Value          // receiver of methods for the service
 	typ    reflect.Type           // type of the receiver
 	method map[string]*methodType // registered methods
+	mapErr ErrorMapper            // translates the errors of its methods, may be nil
 }
 
 type methodType struct {
 	method    reflect.Method // receiver method
-	argsType  reflect.Type   // type of the request argument
+	argsType  reflect.Type   // type of the request argument, nil if the method takes none, see argsOf
 	replyType reflect.Type   // type of the response argument
+
+	argElem    reflect.Type // type allocated to decode the args into
+	argIsValue bool         // if true, args are passed by value
+	hasContext bool         // if true, the method takes a context first
+	invoke     invoker      // calls the method, bound at registration
+}
+
+// MethodInfo describes a registered method, for tools generating clients
+// or mocks from the server. It is a copy: changing it has no effect on the
+// method.
+type MethodInfo struct {
+	Method     reflect.Method // receiver method; its Name is the Go name
+	ArgsType   reflect.Type   // type of the args, nil if the method takes none, a struct of them if several
+	ReplyType  reflect.Type   // type of the reply argument, a pointer
+	HasContext bool           // if true, the method takes a context first
+}
+
+// Name returns the name the service is registered under.
+func (s *Service) Name() string {
+	return s.name
+}
+
+// Method returns the method the service publishes as name, which differs
+// from the Go name of methods registered with RegisterWithNames.
+func (s *Service) Method(name string) (MethodInfo, bool) {
+	m, ok := s.method[name]
+	if !ok {
+		return MethodInfo{}, false
+	}
+	return MethodInfo{
+		Method:     m.method,
+		ArgsType:   m.argsType,
+		ReplyType:  m.replyType,
+		HasContext: m.hasContext,
+	}, true
+}
+
+// Methods returns the names of the methods the service publishes, sorted.
+func (s *Service) Methods() []string {
+	names := make([]string, 0, len(s.method))
+	for name := range s.method {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// An invoker calls a registered method with the receiver, args and reply
+// values and returns the method's error. The context is only passed on to
+// methods that take one, the args to methods that take some.
+type invoker func(ctx context.Context, rcvr, argv, replyv reflect.Value) error
+
+// newInvoker binds the reflect plumbing for method once, at registration,
+// so that a call only has to supply the argument values. Methods taking
+// nargs > 1 args get the fields of argv, in order.
+func newInvoker(method reflect.Method, hasContext bool, nargs int) invoker {
+	function := method.Func
+
+	if nargs > 1 {
+		// The argument slices are recycled, function.Call doesn't keep them.
+		ins := &sync.Pool{New: func() interface{} {
+			in := make([]reflect.Value, 0, nargs + 3)
+			return &in
+		}}
+		return func(ctx context.Context, rcvr, argv, replyv reflect.Value) error {
+			pin := ins.Get().(*[]reflect.Value)
+			in := append((*pin)[:0], rcvr)
+			if hasContext {
+				in = append(in, reflect.ValueOf(ctx))
+			}
+			for i := 0; i < nargs; i++ {
+				in = append(in, argv.Field(i))
+			}
+			in = append(in, replyv)
+			returnValues := function.Call(in)
+
+			for i := range in {
+				in[i] = reflect.Value{}
+			}
+			*pin = in[:0]
+			ins.Put(pin)
+			return errorValue(returnValues[0])
+		}
+	}
+
+	if nargs == 0 {
+		if hasContext {
+			return func(ctx context.Context, rcvr, argv, replyv reflect.Value) error {
+				returnValues := function.Call([]reflect.Value{rcvr, reflect.ValueOf(ctx), replyv})
+				return errorValue(returnValues[0])
+			}
+		}
+		return func(ctx context.Context, rcvr, argv, replyv reflect.Value) error {
+			returnValues := function.Call([]reflect.Value{rcvr, replyv})
+			return errorValue(returnValues[0])
+		}
+	}
+
+	if hasContext {
+		return func(ctx context.Context, rcvr, argv, replyv reflect.Value) error {
+			returnValues := function.Call([]reflect.Value{rcvr, reflect.ValueOf(ctx), argv, replyv})
+			return errorValue(returnValues[0])
+		}
+	}
+
+	return func(ctx context.Context, rcvr, argv, replyv reflect.Value) error {
+		returnValues := function.Call([]reflect.Value{rcvr, argv, replyv})
+		return errorValue(returnValues[0])
+	}
+}
+
+// Returns the error held by v, the return value of a method.
+func errorValue(v reflect.Value) error {
+	if errInter := v.Interface(); errInter != nil {
+		return errInter.(error)
+	}
+	return nil
 }
 
 // Precompute the reflect type for error.  Can't use error directly
@@ -32,53 +159,174 @@ type methodType struct {
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
 
 func (s *Service) Call(req Request) (interface{}, error) {
+	return s.call(nil, req, callConfig{})
+}
+
+// Server settings a call runs with.
+type callConfig struct {
+	pool        *valuePool // nil unless value pooling is enabled
+	strictCodes bool       // coerce reserved error codes returned by methods
+	middleware  []ArgsMiddleware
+	onPanic     PanicHandler // nil for the default, see SetPanicHandler
+}
+
+// call invokes the requested method. Methods taking a context get ctx, or
+// one built from req when ctx is nil. When cfg.pool is not nil the args and
+// reply values are drawn from it; args are returned to the pool once the
+// method returns, the reply is left for the caller to release. The
+// middleware in cfg see the args once decoded and may reject the call. A
+// panic of the method is recovered and handed to cfg.onPanic.
+func (s *Service) call(ctx context.Context, req Request, cfg callConfig) (reply interface{}, err error) {
+	pool := cfg.pool
+
+	defer func() {
+		if r := recover(); r != nil {
+			reply, err = nil, recoverPanic(req, r, cfg.onPanic)
+		}
+	}()
+
 	// Find Method
 	serviceMethod := s.method[req.MethodName()]
 	if serviceMethod == nil {
-		ErrMethodNotFound.Data = req.MethodName()
-		return nil, ErrMethodNotFound
+		return nil, NewServerError(ERR_NO_METHOD, ErrMethodNotFound.Message, req.MethodName())
 	}
 
 	var argv, replyv reflect.Value
 
-	// Decode the argument value.
-	argIsValue := false // if true, need to indirect before calling.
-	if serviceMethod.argsType.Kind() == reflect.Ptr {
-		argv = reflect.New(serviceMethod.argsType.Elem())
-	} else {
- 		argv = reflect.New(serviceMethod.argsType)
- 		argIsValue = true
- 	}
+	// Methods without args ignore the params.
+	if serviceMethod.argsType != nil {
+		var argp reflect.Value
 
-	// Decode the args.
-	req.DecodeParams(argv.Interface())
+		// Decode the argument value.
+		if pool != nil {
+			argp = pool.get(serviceMethod.argElem)
+			defer pool.put(argp)
+		} else {
+			argp = reflect.New(serviceMethod.argElem)
+		}
+
+		// Decode the args.
+		if err := req.DecodeParams(argp.Interface()); err != nil {
+			// Requests may describe the failure themselves.
+			if serr, ok := err.(*ServerError); ok {
+				return nil, serr
+			}
+			return nil, NewServerError(ERR_BAD_PARAMS, ErrInvalidParams.Message, err.Error())
+		}
+
+		argv = argp
+		if serviceMethod.argIsValue {
+			argv = argv.Elem()
+		}
+	}
 
-	if argIsValue {
- 		argv = argv.Elem()
- 	}
+	if len(cfg.middleware) > 0 {
+		var args interface{}
+		if argv.IsValid() {
+			args = argv.Interface()
+		}
+		if err := runArgsMiddleware(cfg.middleware, req, args); err != nil {
+			return nil, err
+		}
+	}
 
 	// Call the service method.
-	replyv = reflect.New(serviceMethod.replyType.Elem())
+	if pool != nil {
+		replyv = pool.get(serviceMethod.replyType.Elem())
+	} else {
+		replyv = reflect.New(serviceMethod.replyType.Elem())
+	}
 
-	function := serviceMethod.method.Func
+	if serviceMethod.hasContext && ctx == nil {
+		ctx = newCallContext(req)
+	}
 
 	// Invoke the method, providing a new value for the reply.
-	returnValues := function.Call([]reflect.Value{s.rcvr, argv, replyv,})
-
-	errInter := returnValues[0].Interface()
-	if err, ok := errInter.(error); ok && err != nil {
+	if err := serviceMethod.invoke(ctx, s.rcvr, argv, replyv); err != nil {
+		if pool != nil {
+			pool.put(replyv)
+		}
+		if errors.Is(err, ErrNoContent) {
+			return nil, nil
+		}
+		if cfg.strictCodes {
+			err = coerceReservedCode(s.name + "." + req.MethodName(), err)
+		}
 		return nil, err
 	}
 
 	return replyv.Interface(), nil
 } 
 
+// handledPanic carries the result a PanicHandler answered for a panic up
+// to ServeRequest.
+type handledPanic struct {
+	result *Result
+}
+
+func (p *handledPanic) Error() string {
+	return "rpc: method panicked"
+}
+
+// Returns the error answering the panic r of the method req calls: h is
+// run while the panicking goroutine is still on the stack, so that
+// runtime/debug.Stack reports where it happened. Without h the panic and
+// its stack are logged and ErrInternal is answered.
+func recoverPanic(req Request, r interface{}, h PanicHandler) error {
+	if h != nil {
+		return &handledPanic{h(req, r)}
+	}
+	glog.Errorf("rpc: %s.%s panicked: %v\n%s", req.ServiceName(), req.MethodName(), r, debug.Stack())
+	return NewServerError(ERR_INTERNAL, ErrInternal.Message, nil)
+}
+
 // Is this an exported - upper case - name?
 func isExported(name string) bool {
 	rune, _ := utf8.DecodeRuneInString(name)
 	return unicode.IsUpper(rune)
 }
 
+// callTimeout invokes the requested method like call, giving up with
+// ErrMethodTimeout after d. Methods taking a context see it expire; the
+// others keep running in the background and their reply is dropped.
+func (s *Service) callTimeout(req Request, cfg callConfig, d time.Duration) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(newCallContext(req), d)
+	defer cancel()
+
+	type outcome struct {
+		reply interface{}
+		err   error
+	}
+	done := make(chan outcome, 1)
+
+	go func() {
+		reply, err := s.call(ctx, req, cfg)
+		done <- outcome{reply, err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.reply, o.err
+	case <-ctx.Done():
+		return nil, ErrMethodTimeout
+	}
+}
+
+// Is this a usable service name? Every dot separated part of it must be
+// non-empty, otherwise "Service.Method" could not be split back apart, and
+// the name must not contain the '@' that introduces a version.
+func isValidName(name string) bool {
+	if strings.Contains(name, "@") {
+		return false
+	}
+	for _, part := range strings.Split(name, ".") {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
+
 // Is this type exported or a builtin?
 func isExportedOrBuiltinType(t reflect.Type) bool {
 	for t.Kind() == reflect.Ptr {
@@ -90,7 +338,35 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 	return isExported(t.Name()) || t.PkgPath() == ""
 }
 
-// installValidMethods returns valid Rpc methods of typ.
+// Returns methods with those named in names, by their Go name, under
+// their new name.
+func renameMethods(methods map[string]*methodType, names map[string]string) (map[string]*methodType, error) {
+	for mname, name := range names {
+		if methods[mname] == nil {
+			return nil, NewServerError(ERR_SERVER, fmt.Sprintf(ErrNoSuchMethod.Message, mname), nil)
+		}
+		if name == "" || strings.ContainsAny(name, ".@") {
+			return nil, NewServerError(ERR_SERVER, fmt.Sprintf(ErrInvalidMethodName.Message, name), nil)
+		}
+	}
+
+	renamed := make(map[string]*methodType, len(methods))
+	for mname, mtype := range methods {
+		name := mname
+		if n, present := names[mname]; present {
+			name = n
+		}
+		if _, present := renamed[name]; present {
+			return nil, NewServerError(ERR_SERVER, fmt.Sprintf(ErrDuplicateMethod.Message, name), nil)
+		}
+		renamed[name] = mtype
+	}
+	return renamed, nil
+}
+
+// installValidMethods returns valid Rpc methods of typ. The methods it
+// skips are only logged at verbosity 2, types commonly having methods,
+// embedded ones notably, that are not meant to be published.
 func installValidMethods(typ reflect.Type) map[string]*methodType {
 	methods := make(map[string]*methodType)
 
@@ -104,49 +380,107 @@ func installValidMethods(typ reflect.Type) map[string]*methodType {
 			continue
 		}
 
-		// Method needs three ins: receiver, *args, *reply.
-		if mtype.NumIn() != 3 {
-			glog.Warningln("method", mname, "has wrong number of ins:", mtype.NumIn())
+		// Method may take a context before its arguments.
+		first := 1
+		hasContext := mtype.NumIn() > 1 && mtype.In(1) == typeOfContext
+		if hasContext {
+			first = 2
+		}
+
+		// Method needs three ins: receiver, *args, *reply, or two for
+		// methods without args: receiver, *reply. Methods may also take
+		// several args before the reply.
+		nargs := mtype.NumIn() - first - 1
+		if nargs < 0 {
+			glog.V(2).Infoln("method", mname, "has wrong number of ins:", mtype.NumIn())
 			continue
 		}
 
-		// First arg need not be a pointer.
-		argType := mtype.In(1)
-		if !isExportedOrBuiltinType(argType) {
-			glog.Warningln(mname, "argument type not exported:", argType)
+		// Args need not be pointers.
+		argType, ok := argsOf(mname, mtype, first, nargs)
+		if !ok {
 			continue
 		}
 
 		// Second arg must be a pointer.
-		replyType := mtype.In(2)
+		replyType := mtype.In(mtype.NumIn() - 1)
 		if replyType.Kind() != reflect.Ptr {
-			glog.Warningln("method", mname, "reply type not a pointer:", replyType)
+			glog.V(2).Infoln("method", mname, "reply type not a pointer:", replyType)
 			continue
 		}
 
 		// Reply type must be exported.
 		if !isExportedOrBuiltinType(replyType) {
-			glog.Warningln("method", mname, "reply type not exported:", replyType)
+			glog.V(2).Infoln("method", mname, "reply type not exported:", replyType)
 			continue
 		}
 
 		// Method needs one out.
 		if mtype.NumOut() != 1 {
-			glog.Warningln("method", mname, "has wrong number of outs:", mtype.NumOut())
+			glog.V(2).Infoln("method", mname, "has wrong number of outs:", mtype.NumOut())
 			continue
 		}
 
 		// The return type of the method must be error.
 		if returnType := mtype.Out(0); returnType != typeOfError {
-			glog.Warningln("method", mname, "returns", returnType.String(), "not error")
+			glog.V(2).Infoln("method", mname, "returns", returnType.String(), "not error")
 			continue
 		}
 
-		methods[mname] = &methodType{
-			method:    method, 
-			argsType:  argType, 
-			replyType: replyType,
+		mt := &methodType{
+			method:     method,
+			argsType:   argType,
+			replyType:  replyType,
+			argElem:    argType,
+			hasContext: hasContext,
+			invoke:     newInvoker(method, hasContext, nargs),
+		}
+
+		if argType != nil {
+			if argType.Kind() == reflect.Ptr {
+				mt.argElem = argType.Elem()
+			} else {
+				mt.argIsValue = true
+			}
 		}
+
+		methods[mname] = mt
 	}
 	return methods
-}
\ No newline at end of file
+}
+
+// Returns the type of the args of a method of type mtype taking nargs
+// args from its in first: nil if it takes none, or, for several args, a
+// struct whose fields Arg0, Arg1 and so on hold them in order, for the
+// params to be decoded into. Reports false if an arg type is not
+// exported.
+func argsOf(mname string, mtype reflect.Type, first, nargs int) (reflect.Type, bool) {
+	var fields []reflect.StructField
+	for i := 0; i < nargs; i++ {
+		argType := mtype.In(first + i)
+		if !isExportedOrBuiltinType(argType) {
+			glog.V(2).Infoln(mname, "argument type not exported:", argType)
+			return nil, false
+		}
+		fields = append(fields, reflect.StructField{Name: "Arg" + strconv.Itoa(i), Type: argType})
+	}
+
+	switch nargs {
+	case 0:
+		return nil, true
+	case 1:
+		return fields[0].Type, true
+	}
+	return reflect.StructOf(fields), true
+}
+
+// ReplyTypes returns the reply types of the methods of rcvr that Register
+// would publish, keyed by method name. Transports use it to check at
+// registration that they can encode the replies.
+func ReplyTypes(rcvr interface{}) map[string]reflect.Type {
+	types := make(map[string]reflect.Type)
+	for name, m := range installValidMethods(reflect.TypeOf(rcvr)) {
+		types[name] = m.replyType
+	}
+	return types
+}
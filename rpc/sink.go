@@ -0,0 +1,66 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ResultSink receives the results of the requests handed to DispatchTo.
+//
+// Request/response transports wait on each request's Result channel
+// through Dispatch. Multiplexed transports, where one connection carries
+// many calls, can instead give every request the same sink and correlate
+// the results by request id, for instance through RequestIDer.
+//
+// Deliver is called from the worker goroutines, possibly concurrently.
+type ResultSink interface {
+	Deliver(req Request, result *Result)
+}
+
+// The ResultSinkFunc type is an adapter to allow the use of ordinary
+// functions as result sinks.
+type ResultSinkFunc func(req Request, result *Result)
+
+// Deliver calls f(req, result).
+func (f ResultSinkFunc) Deliver(req Request, result *Result) {
+	f(req, result)
+}
+
+// Delivers results on the request's own Result channel. A result whose
+// caller went away, its context done, is dropped rather than blocking the
+// worker on a channel nobody reads, as are the results not read once a
+// Shutdown was forced, forced being closed then.
+type channelSink struct {
+	forced <-chan struct{}
+}
+
+func (s channelSink) Deliver(req Request, result *Result) {
+	// A reader waiting gets its result, whatever else is ready.
+	select {
+	case req.Result() <- result:
+		return
+	default:
+	}
+
+	select {
+	case req.Result() <- result:
+	case <-requestDone(req):
+		glog.V(2).Infof("RPC: result of %s.%s dropped, its caller went away", req.ServiceName(), req.MethodName())
+		result.Release()
+	case <-s.forced:
+		glog.Warningf("RPC: result of %s.%s dropped, nobody read it after a forced shutdown", req.ServiceName(), req.MethodName())
+		result.Release()
+	}
+}
+
+// A request queued for the workers, and where its result goes.
+type job struct {
+	req    Request
+	sink   ResultSink
+	queued time.Time // when it was queued, see CallTiming
+}
@@ -0,0 +1,32 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"time"
+)
+
+// CallTiming is how long the server took over a call: Wait in the queue
+// before a worker took it, Exec serving it, decoding its args included.
+type CallTiming struct {
+	Wait time.Duration
+	Exec time.Duration
+}
+
+// TimingRecorder is implemented by requests that want to know the timing
+// of their call, for transports to report it to clients. RecordTiming is
+// called once the call is served, before its result is delivered; calls
+// that expired while queued are not timed.
+type TimingRecorder interface {
+	RecordTiming(t CallTiming)
+}
+
+// Hands the timing of the call req, queued then started at the given
+// times, to req if it wants it.
+func recordTiming(req Request, queued, start time.Time) {
+	if r, ok := req.(TimingRecorder); ok {
+		r.RecordTiming(CallTiming{Wait: start.Sub(queued), Exec: time.Since(start)})
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package rpc
+
+import (
+	"context"
+)
+
+// Unary adapts a function taking args and returning a reply into a
+// service with a single method, Call, in the form Register expects, so
+// that typed handlers need no pointer reply:
+//
+//	func add(ctx context.Context, args Args) (Reply, error) {
+//		return Reply{args.A + args.B}, nil
+//	}
+//
+//	srv.RegisterName("Add", rpc.Unary[Args, Reply](add))
+//
+// serves add as "Add.Call". In and Out must be exported or builtin types,
+// as for any method; the context is the one methods taking one get.
+type Unary[In, Out any] func(ctx context.Context, args In) (Out, error)
+
+// Call runs the function, storing its result in reply unless it fails.
+func (f Unary[In, Out]) Call(ctx context.Context, args In, reply *Out) error {
+	out, err := f(ctx, args)
+	if err != nil {
+		return err
+	}
+	*reply = out
+	return nil
+}
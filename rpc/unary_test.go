@@ -0,0 +1,41 @@
+// Copyright 2015 The av-vortex Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRPC_Unary(t *testing.T) {
+	server := NewServer()
+
+	add := func(ctx context.Context, args Args) (Reply, error) {
+		if args.B < 0 {
+			return Reply{}, errors.New("negative")
+		}
+		return Reply{args.A + args.B}, nil
+	}
+	if err := server.RegisterName("Add", Unary[Args, Reply](add)); err != nil {
+		t.Fatal("RegisterName Add:", err)
+	}
+
+	result := server.ServeRequest(newTestRequest("Add", "Call", &Args{7, 8}))
+	if result.Error != nil {
+		t.Fatalf("Add: expected no error but got string %q", result.Error.Error())
+	}
+	if reply, ok := result.Value.(*Reply); !ok || reply.C != 15 {
+		t.Errorf("Add: expected 15 got %v", result.Value)
+	}
+
+	result = server.ServeRequest(newTestRequest("Add", "Call", &Args{7, -1}))
+	if result.Error == nil || result.Error.Error() != "negative" {
+		t.Errorf("Add: expected the function's error got %v", result.Error)
+	}
+}